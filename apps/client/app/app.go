@@ -2,12 +2,11 @@ package app
 
 import (
 	"context"
-	"os"
-	"os/signal"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -25,10 +24,16 @@ type App struct {
 	logger        *logger.Logger
 	latency       *latency
 	latencyMetric metric.Float64Histogram
+	health        *health.Recorder
+	// Changes which are requested over the HTTP server
+	durationChannel chan time.Duration
+	httpServer      *httpServer
 }
 
 func New(
 	logger *logger.Logger,
+	health *health.Recorder,
+	status controllerStatus,
 ) *App {
 
 	// Create custom latency histogram
@@ -42,34 +47,36 @@ func New(
 		panic(err)
 	}
 
+	durationChannel := make(chan time.Duration)
+
 	return &App{
 		logger: logger,
 		latency: &latency{
 			duration: time.Second,
 			mutex:    &sync.Mutex{},
 		},
-		latencyMetric: latencyMetric,
+		latencyMetric:   latencyMetric,
+		health:          health,
+		durationChannel: durationChannel,
+		httpServer:      newHttpServer(logger, durationChannel, status),
 	}
 }
 
-func (a *App) Run() {
-
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	durationChannel := make(chan time.Duration)
+// Runs the application until the context is canceled.
+func (a *App) Run(
+	ctx context.Context,
+) {
 
 	// Start HTTP server to change latency
-	hs := newHttpServer(a.logger, durationChannel)
-	go hs.serve()
+	go a.httpServer.serve()
 
 	// Run the application
-	go a.runApp()
+	go a.runApp(ctx)
 
 	for {
 		select {
 		// Check for latency change
-		case duration := <-durationChannel:
+		case duration := <-a.durationChannel:
 			a.logger.LogWithFields(
 				logrus.InfoLevel,
 				"Latency change request is received.",
@@ -80,21 +87,41 @@ func (a *App) Run() {
 			// Set the new duration
 			a.setLatencyDuration(duration)
 
-			// Watch for sigterm
-		case <-interrupt:
+			// Watch for the shutdown
+		case <-ctx.Done():
 			a.logger.LogWithFields(
-				logrus.ErrorLevel,
-				"Interrupt received, shutting down the application...",
+				logrus.InfoLevel,
+				"Shutting down the application...",
 				map[string]string{
 					"component.name": "application",
 				})
-			// cancel()
 			return
 		}
 	}
 }
 
-func (a *App) runApp() {
+// Shuts down the HTTP server. The changes which the requests in progress
+// hand over are dropped.
+func (a *App) Shutdown(
+	ctx context.Context,
+) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- a.httpServer.shutdown(ctx)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-a.durationChannel:
+		}
+	}
+}
+
+func (a *App) runApp(
+	ctx context.Context,
+) {
 
 	a.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -103,7 +130,7 @@ func (a *App) runApp() {
 			"component.name": "application",
 		})
 
-	for {
+	for ctx.Err() == nil {
 
 		// Start timer
 		startTime := time.Now()
@@ -123,8 +150,10 @@ func (a *App) runApp() {
 		attrs := make([]attribute.KeyValue, 0, 1)
 		attrs = append(attrs, attribute.String("component.name", "application"))
 
-		elapsedTime := float64(time.Since(startTime)) / float64(time.Millisecond)
+		elapsed := time.Since(startTime)
+		elapsedTime := float64(elapsed) / float64(time.Millisecond)
 		a.latencyMetric.Record(context.Background(), elapsedTime, metric.WithAttributes(attrs...))
+		a.health.RecordLatency(elapsed)
 	}
 }
 
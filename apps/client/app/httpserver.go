@@ -3,10 +3,9 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-	"os/signal"
 	"strconv"
 	"time"
 
@@ -17,77 +16,63 @@ import (
 type httpServer struct {
 	logger          *logger.Logger
 	durationChannel chan time.Duration
+	status          controllerStatus
+	server          *http.Server
 }
 
 func newHttpServer(
 	logger *logger.Logger,
 	durationChannel chan time.Duration,
+	status controllerStatus,
 ) *httpServer {
 	return &httpServer{
 		logger:          logger,
 		durationChannel: durationChannel,
+		status:          status,
+		server: &http.Server{
+			Addr: "localhost:" + HTTP_SERVER_PORT,
+		},
 	}
 }
 
 func (hs *httpServer) serve() {
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latency", http.HandlerFunc(hs.handle))
+	mux.HandleFunc("GET /healthz", hs.handleHealthz)
+	mux.HandleFunc("GET /readyz", hs.handleReadyz)
+	hs.server.Handler = mux
 
-	// Run the server in a goroutine
-	ctx, cancel := context.WithCancel(context.Background())
-	go func(
-		ctx context.Context,
-	) {
-
-		mux := http.NewServeMux()
-		mux.HandleFunc("/latency", http.HandlerFunc(hs.handle))
-
-		server := &http.Server{
-			Addr:    "localhost:" + HTTP_SERVER_PORT,
-			Handler: mux,
-		}
-
-		hs.logger.LogWithFields(
-			logrus.InfoLevel,
-			"HTTP server is running on localhost:"+HTTP_SERVER_PORT,
-			map[string]string{
-				"component.name": "httpserver",
-			})
-
-		err := server.ListenAndServe()
-		if err != nil {
-			hs.logger.LogWithFields(
-				logrus.ErrorLevel,
-				"HTTP server failed.",
-				map[string]string{
-					"component.name": "httpserver",
-					"error.message":  err.Error(),
-				})
-		}
-
-		<-ctx.Done()
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		"HTTP server is running on localhost:"+HTTP_SERVER_PORT,
+		map[string]string{
+			"component.name": "httpserver",
+		})
 
+	err := hs.server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		hs.logger.LogWithFields(
-			logrus.InfoLevel,
-			"Shutting down HTTP server...",
+			logrus.ErrorLevel,
+			"HTTP server failed.",
 			map[string]string{
 				"component.name": "httpserver",
+				"error.message":  err.Error(),
 			})
-		server.Shutdown(ctx)
-
-	}(ctx)
-
-	// Wait for the context to be canceled or for the server to be shut down
-	<-interrupt
-	cancel()
+	}
+}
 
+// Stops accepting requests and waits for the ones in progress.
+func (hs *httpServer) shutdown(
+	ctx context.Context,
+) error {
 	hs.logger.LogWithFields(
 		logrus.InfoLevel,
-		"HTTP server is shut down successfully.",
+		"Shutting down HTTP server...",
 		map[string]string{
 			"component.name": "httpserver",
 		})
+	return hs.server.Shutdown(ctx)
 }
 
 func (hs *httpServer) handle(
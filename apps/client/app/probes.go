@@ -0,0 +1,94 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/controller"
+)
+
+const (
+	PROBE_STATUS_OK     = "ok"
+	PROBE_STATUS_FAILED = "failed"
+)
+
+// Provides the state of the controller to the probes.
+type controllerStatus interface {
+	Status() *controller.Status
+}
+
+// Outcome of a probe together with the checks it is based on and the
+// state of the controller which they are taken from.
+type probeResult struct {
+	Status     string                 `json:"status"`
+	Checks     map[string]*probeCheck `json:"checks"`
+	Controller *controller.Status     `json:"controller"`
+}
+
+type probeCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Reports whether the collector runs and the last command could be
+// applied. A lost control connection does not fail it, the controller
+// reconnects on its own.
+func (hs *httpServer) handleHealthz(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	hs.writeProbe(w, false)
+}
+
+// Reports whether the client is controllable, which additionally
+// requires the control connection to the server.
+func (hs *httpServer) handleReadyz(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	hs.writeProbe(w, true)
+}
+
+func (hs *httpServer) writeProbe(
+	w http.ResponseWriter,
+	withConnection bool,
+) {
+	status := hs.status.Status()
+	result := &probeResult{
+		Status:     PROBE_STATUS_OK,
+		Checks:     map[string]*probeCheck{},
+		Controller: status,
+	}
+	check := func(name string, err string) {
+		if err == "" {
+			result.Checks[name] = &probeCheck{Status: PROBE_STATUS_OK}
+			return
+		}
+		result.Checks[name] = &probeCheck{Status: PROBE_STATUS_FAILED, Error: err}
+		result.Status = PROBE_STATUS_FAILED
+	}
+
+	if status.CollectorRunning {
+		check("collector", "")
+	} else {
+		check("collector", "collector is not running")
+	}
+	if status.LastApply != nil && status.LastApply.Error != "" {
+		check("lastApply", status.LastApply.Error)
+	} else {
+		check("lastApply", "")
+	}
+	if withConnection {
+		if status.Connected {
+			check("connection", "")
+		} else {
+			check("connection", "not connected to the server")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != PROBE_STATUS_OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
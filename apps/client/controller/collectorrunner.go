@@ -1,42 +1,63 @@
 package controller
 
 import (
-	"os"
-	"os/signal"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
 )
 
+// Default minimum interval between two restarts of the collector.
+const COLLECTOR_MIN_RESTART_INTERVAL = 10 * time.Second
+
+// Applies the commands to the collector. The collector is only
+// restarted if the mode changes and at most once per minimum restart
+// interval. The commands which arrive in between are coalesced to the
+// latest one and the others are reported as superseded.
 type collectorRunner struct {
-	logger            *logger.Logger
-	wg                *sync.WaitGroup
-	controllerChannel chan bool
-	otelcol           *otelcollector.Collector
+	logger             *logger.Logger
+	wg                 *sync.WaitGroup
+	controllerChannel  chan *modeCommand
+	reportChannel      chan *protocol.Envelope
+	otelcol            *otelcollector.Collector
+	status             *statusRecorder
+	signals            *shutdownSignals
+	minRestartInterval time.Duration
+	lastRestartAt      time.Time
+	// Closed once the runner returns
+	done chan struct{}
 }
 
 func newCollectorRunner(
 	logger *logger.Logger,
 	wg *sync.WaitGroup,
-	controllerChannel chan bool,
+	controllerChannel chan *modeCommand,
+	reportChannel chan *protocol.Envelope,
+	otelcol *otelcollector.Collector,
+	status *statusRecorder,
+	signals *shutdownSignals,
+	minRestartInterval time.Duration,
 ) *collectorRunner {
-	otelcol := otelcollector.New(logger)
-
 	return &collectorRunner{
-		logger:            logger,
-		wg:                wg,
-		controllerChannel: controllerChannel,
-		otelcol:           otelcol,
+		logger:             logger,
+		wg:                 wg,
+		controllerChannel:  controllerChannel,
+		reportChannel:      reportChannel,
+		otelcol:            otelcol,
+		status:             status,
+		signals:            signals,
+		minRestartInterval: minRestartInterval,
+		done:               make(chan struct{}),
 	}
 }
 
 func (cr *collectorRunner) run() {
 	defer cr.wg.Done()
-
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	defer close(cr.done)
 
 	cr.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -45,7 +66,9 @@ func (cr *collectorRunner) run() {
 			"component.name": "controllerrunner",
 		})
 	err := cr.otelcol.Start(false)
+	cr.lastRestartAt = time.Now()
 	if err != nil {
+		// Keep listening, the following commands retry to start it
 		cr.logger.LogWithFields(
 			logrus.ErrorLevel,
 			"Starting controller runner is failed.",
@@ -53,7 +76,6 @@ func (cr *collectorRunner) run() {
 				"component.name": "controllerrunner",
 				"error.message":  err.Error(),
 			})
-		return
 	}
 
 	cr.logger.LogWithFields(
@@ -63,21 +85,216 @@ func (cr *collectorRunner) run() {
 			"component.name": "controllerrunner",
 		})
 
+	// The timer of the running command whose TTL has not elapsed yet
+	var expiryTimer *time.Timer
+	var expiry <-chan time.Time
+	var expiryCommandId string
+
+	// The command which waits for the minimum restart interval to pass
+	var pending *modeCommand
+	var pendingTimer *time.Timer
+	var pendingRestart <-chan time.Time
+
 	for {
 		select {
-		case <-interrupt:
+		case <-expiry:
+			// Revert locally so that a forgotten debug session ends
+			// even if the server is not reachable
+			expiryTimer = nil
+			expiry = nil
 			cr.logger.LogWithFields(
-				logrus.ErrorLevel,
-				"Interrupt received, stopping OTel collector...",
+				logrus.InfoLevel,
+				"TTL of the command elapsed, reverting to default mode...",
+				map[string]string{
+					"component.name":     "controllerrunner",
+					"message.command.id": expiryCommandId,
+				})
+			cmd := &modeCommand{
+				id:      expiryCommandId,
+				isDebug: false,
+			}
+			err := cr.apply(cmd)
+			cr.status.setApplied(cmd, err)
+			cr.report(newModeExpiredMessage(expiryCommandId, err))
+
+		case <-cr.signals.stopRunner:
+			// The collector is stopped by the controller afterwards
+			cr.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Client shuts down, stopping controller runner...",
 				map[string]string{
 					"component.name": "controllerrunner",
 				})
-			cr.otelcol.Stop()
+			if expiryTimer != nil {
+				expiryTimer.Stop()
+			}
+			if pending != nil {
+				pendingTimer.Stop()
+				cr.report(newAckMessage(
+					&commandResult{
+						id:  pending.id,
+						err: errClientShuttingDown,
+					},
+					false,
+				))
+			}
 			return
 
-		case isDebug := <-cr.controllerChannel:
-			cr.otelcol.Stop()
-			cr.otelcol.Start(isDebug)
+		case cmd := <-cr.controllerChannel:
+			if expiryTimer != nil {
+				expiryTimer.Stop()
+				expiryTimer = nil
+				expiry = nil
+			}
+
+			// Only the latest of the commands which wait is applied
+			if pending != nil {
+				pendingTimer.Stop()
+				pendingTimer = nil
+				pendingRestart = nil
+				cr.supersede(pending, cmd)
+				pending = nil
+			}
+
+			wait := cr.minRestartInterval - time.Since(cr.lastRestartAt)
+			if !cr.isNoop(cmd) && wait > 0 {
+				cr.logger.LogWithFields(
+					logrus.InfoLevel,
+					"Collector is restarted recently, deferring command...",
+					map[string]string{
+						"component.name":     "controllerrunner",
+						"message.command.id": cmd.id,
+						"otelcol.restart.in": wait.Round(time.Millisecond).String(),
+					})
+				pending = cmd
+				pendingTimer = time.NewTimer(wait)
+				pendingRestart = pendingTimer.C
+				continue
+			}
+
+			expiryTimer, expiry = cr.execute(cmd)
+			if expiry != nil {
+				expiryCommandId = cmd.id
+			}
+
+		case <-pendingRestart:
+			cmd := pending
+			pending = nil
+			pendingTimer = nil
+			pendingRestart = nil
+
+			expiryTimer, expiry = cr.execute(cmd)
+			if expiry != nil {
+				expiryCommandId = cmd.id
+			}
 		}
 	}
 }
+
+// Applies the command and reports its outcome. Returns the timer of its
+// TTL, if it has one.
+func (cr *collectorRunner) execute(
+	cmd *modeCommand,
+) (
+	*time.Timer,
+	<-chan time.Time,
+) {
+	err := cr.apply(cmd)
+	cr.status.setApplied(cmd, err)
+	cr.report(newAckMessage(
+		&commandResult{
+			id:  cmd.id,
+			err: err,
+		},
+		true,
+	))
+
+	if err != nil || !cmd.isDebug || cmd.ttl <= 0 {
+		return nil, nil
+	}
+	timer := time.NewTimer(cmd.ttl)
+	return timer, timer.C
+}
+
+// Reports the command which is dropped in favor of a newer one.
+func (cr *collectorRunner) supersede(
+	cmd *modeCommand,
+	by *modeCommand,
+) {
+	cr.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Command is superseded by a newer one before it is applied.",
+		map[string]string{
+			"component.name":               "controllerrunner",
+			"message.command.id":           cmd.id,
+			"message.command.supersededBy": by.id,
+		})
+	cr.report(newSupersededMessage(cmd.id, by.id))
+}
+
+// Queues the message for the server. The queue is only drained while
+// the client is connected, so the message is dropped instead of
+// blocking the runner once it is stopped.
+func (cr *collectorRunner) report(
+	message *protocol.Envelope,
+) {
+	// Preferred over the stop as long as the queue has room
+	select {
+	case cr.reportChannel <- message:
+		return
+	default:
+	}
+
+	select {
+	case cr.reportChannel <- message:
+	case <-cr.signals.stopRunner:
+		cr.logger.LogWithFields(
+			logrus.WarnLevel,
+			"Client shuts down while the reports are not delivered, dropping report.",
+			map[string]string{
+				"component.name":     "controllerrunner",
+				"message.type":       string(message.Type),
+				"message.command.id": message.CommandId,
+			})
+	}
+}
+
+// Returns whether the collector already runs in the mode of the
+// command.
+func (cr *collectorRunner) isNoop(
+	cmd *modeCommand,
+) bool {
+	return cr.otelcol.IsRunning() && cr.otelcol.IsDebug() == cmd.isDebug
+}
+
+func (cr *collectorRunner) apply(
+	cmd *modeCommand,
+) error {
+	cr.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Applying command...",
+		map[string]string{
+			"component.name":     "controllerrunner",
+			"message.command.id": cmd.id,
+			"otelcol.mode.debug": strconv.FormatBool(cmd.isDebug),
+			"otelcol.mode.ttl":   cmd.ttl.String(),
+		})
+
+	if cr.isNoop(cmd) {
+		cr.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Collector already runs in the desired mode, skipping restart.",
+			map[string]string{
+				"component.name":     "controllerrunner",
+				"message.command.id": cmd.id,
+			})
+		return nil
+	}
+
+	cr.lastRestartAt = time.Now()
+	err := cr.otelcol.Stop()
+	if err != nil {
+		return err
+	}
+	return cr.otelcol.Start(cmd.isDebug)
+}
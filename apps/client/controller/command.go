@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Command which is received from the server to switch the collector.
+// If the TTL is set, the collector is reverted to the default mode
+// after it elapses.
+type modeCommand struct {
+	id      string
+	isDebug bool
+	ttl     time.Duration
+}
+
+// Outcome of applying a command to the collector.
+type commandResult struct {
+	id  string
+	err error
+}
+
+// Creates the acknowledgement for the command. A result without an
+// error is reported as accepted if it is not applied yet.
+func newAckMessage(
+	result *commandResult,
+	isApplied bool,
+) *protocol.Envelope {
+	payload := &protocol.AckPayload{
+		Status: protocol.CommandStatusAccepted,
+	}
+	if result.err != nil {
+		payload.Status = protocol.CommandStatusFailed
+		payload.Error = result.err.Error()
+	} else if isApplied {
+		payload.Status = protocol.CommandStatusApplied
+	}
+
+	// Marshalling the ack payload cannot fail
+	message, _ := protocol.NewEnvelope(protocol.MessageTypeAck, result.id, payload)
+	return message
+}
+
+// Creates the report of the command whose TTL has elapsed.
+func newModeExpiredMessage(
+	commandId string,
+	err error,
+) *protocol.Envelope {
+	payload := &protocol.ModeExpiredPayload{
+		Mode:      protocol.ModeDefault,
+		ExpiredAt: time.Now().UTC(),
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	// Marshalling the payload cannot fail
+	message, _ := protocol.NewEnvelope(protocol.MessageTypeModeExpired, commandId, payload)
+	return message
+}
+
+// Creates the report of the command which is not applied since a newer
+// one arrived while it waited for the collector to be restarted.
+func newSupersededMessage(
+	commandId string,
+	supersededBy string,
+) *protocol.Envelope {
+	payload := &protocol.AckPayload{
+		Status: protocol.CommandStatusSuperseded,
+		Error:  "superseded by command " + supersededBy,
+	}
+
+	// Marshalling the ack payload cannot fail
+	message, _ := protocol.NewEnvelope(protocol.MessageTypeAck, commandId, payload)
+	return message
+}
+
+// Creates the report of the collector which exited without being
+// stopped.
+func newCollectorCrashedPayload(
+	otelcol *otelcollector.Collector,
+	err error,
+) *protocol.CollectorCrashedPayload {
+	mode := protocol.ModeDefault
+	if otelcol.IsDebug() {
+		mode = protocol.ModeDebug
+	}
+	return &protocol.CollectorCrashedPayload{
+		Mode:      mode,
+		CrashedAt: time.Now().UTC(),
+		Error:     err.Error(),
+	}
+}
+
+func newCollectorCrashedMessage(
+	otelcol *otelcollector.Collector,
+	err error,
+) *protocol.Envelope {
+	// Marshalling the payload cannot fail
+	message, _ := protocol.NewEnvelope(protocol.MessageTypeCollectorCrashed, "", newCollectorCrashedPayload(otelcol, err))
+	return message
+}
+
+// Creates the summary of the application health since the last one.
+func newHealthMessage(
+	recorder *health.Recorder,
+) *protocol.Envelope {
+	// Marshalling the health payload cannot fail
+	message, _ := protocol.NewEnvelope(protocol.MessageTypeHealth, "", recorder.Summarize())
+	return message
+}
@@ -1,46 +1,134 @@
 package controller
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
 )
 
+const (
+	TRANSPORT_WEBSOCKET = "websocket"
+	TRANSPORT_OPAMP     = "opamp"
+)
+
+// Interval of the health summaries which are sent to the server.
+const HEALTH_REPORT_INTERVAL = 30 * time.Second
+
+// Config of the controller.
+type Config struct {
+	// Transport to the server, either websocket or opamp
+	Transport string
+	ServerUrl string
+	// CA bundle to verify the server certificate with. The system roots
+	// are used if it is not given.
+	TlsCaFile string
+	// Certificate and key which the client identifies itself with. The
+	// common name of the certificate becomes the client ID.
+	TlsCertFile string
+	TlsKeyFile  string
+	// Public key of the server, PEM encoded, which the signatures of the
+	// commands are verified against. It is required unless the server is
+	// on a loopback address or InsecureSkipVerify is set.
+	SigningPublicKeyFile string
+	// Accepts the commands without verifying them if no public key is
+	// given, whichever server the client connects to.
+	InsecureSkipVerify bool
+	// Minimum interval between two restarts of the collector. Zero
+	// disables it.
+	MinRestartInterval time.Duration
+	// Token which the client enrolls with on its first connection. The
+	// credential which is issued by the server is used afterwards.
+	EnrollmentToken string
+	// Recorder of the application health which is summarized to the
+	// server periodically. Nothing is reported if it is not given.
+	Health *health.Recorder
+}
+
+// Client which receives the commands from the server and reports their
+// outcome back.
+type serverClient interface {
+	run()
+}
+
 type Controller struct {
 	logger            *logger.Logger
-	controllerChannel chan bool
+	controllerChannel chan *modeCommand
+	reportChannel     chan *protocol.Envelope
 	wg                *sync.WaitGroup
-	webSocketClient   *websocketClient
+	serverClient      serverClient
 	collectorRunner   *collectorRunner
+	otelcol           *otelcollector.Collector
+	status            *statusRecorder
+	signals           *shutdownSignals
 }
 
+// Creates the controller. Returns an error if the TLS config or the
+// public key of the server could not be loaded.
 func New(
 	logger *logger.Logger,
-	webSocketUrl string,
-) *Controller {
+	cfg *Config,
+) (
+	*Controller,
+	error,
+) {
 
-	controllerChannel := make(chan bool)
+	tlsConfig, err := newClientTlsConfig(cfg.TlsCaFile, cfg.TlsCertFile, cfg.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS config could not be created: %w", err)
+	}
+	clientId, err := loadClientId(logger, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("client ID could not be loaded: %w", err)
+	}
+	verifier, err := newCommandVerifier(logger, clientId, cfg.SigningPublicKeyFile, cfg.ServerUrl, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("public key of the server could not be loaded: %w", err)
+	}
+	creds := newCredentials(logger, cfg.EnrollmentToken)
+
+	controllerChannel := make(chan *modeCommand)
+	reportChannel := make(chan *protocol.Envelope, 16)
 
 	wg := &sync.WaitGroup{}
 
+	otelcol := otelcollector.New(logger)
+	status := newStatusRecorder(otelcol)
+	signals := newShutdownSignals()
+
 	wg.Add(2)
-	cr := newCollectorRunner(logger, wg, controllerChannel)
-	wc := newWebSocketClient(logger, wg, controllerChannel, webSocketUrl)
+	cr := newCollectorRunner(logger, wg, controllerChannel, reportChannel, otelcol, status, signals, cfg.MinRestartInterval)
+
+	var sc serverClient
+	if cfg.Transport == TRANSPORT_OPAMP {
+		sc = newOpampClient(logger, wg, controllerChannel, reportChannel, otelcol, status, signals, cfg.ServerUrl, tlsConfig, creds, verifier, cfg.Health)
+	} else {
+		sc = newWebSocketClient(logger, wg, controllerChannel, reportChannel, otelcol, status, signals, cfg.ServerUrl, tlsConfig, creds, verifier, cfg.Health)
+	}
 
 	return &Controller{
 		logger:            logger,
 		controllerChannel: controllerChannel,
+		reportChannel:     reportChannel,
 		wg:                wg,
-		webSocketClient:   wc,
+		serverClient:      sc,
 		collectorRunner:   cr,
-	}
+		otelcol:           otelcol,
+		status:            status,
+		signals:           signals,
+	}, nil
 }
 
 func (c *Controller) Run() {
 
 	go c.collectorRunner.run()
-	go c.webSocketClient.run()
+	go c.serverClient.run()
 
 	c.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -50,3 +138,54 @@ func (c *Controller) Run() {
 		})
 	c.wg.Wait()
 }
+
+// Stops passing the commands of the server to the collector. The ones
+// which arrive afterwards are reported as failed.
+func (c *Controller) StopCommands() {
+	c.signals.stopAcceptingCommands()
+}
+
+// Stops the collector gracefully and closes the connection to the
+// server afterwards, so that the outcome of the last commands is still
+// reported. Returns once both are done or the context is done.
+func (c *Controller) Shutdown(
+	ctx context.Context,
+) error {
+	c.StopCommands()
+
+	close(c.signals.stopRunner)
+	select {
+	case <-c.collectorRunner.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := c.otelcol.Shutdown(ctx)
+	if err != nil {
+		c.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"OTel collector could not be stopped gracefully.",
+			map[string]string{
+				"component.name": "controller",
+				"error.message":  err.Error(),
+			})
+	}
+
+	close(c.signals.disconnect)
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the state of the control connection, the collector and the
+// last command which is applied.
+func (c *Controller) Status() *Status {
+	return c.status.status()
+}
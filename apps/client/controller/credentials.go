@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+)
+
+const CREDENTIAL_FILE_PATH = "./bin/credential"
+
+// Secrets which the client authenticates to the server with. The
+// enrollment token is only used until the server issues the credential
+// of the client, which is persisted for the next connections.
+type credentials struct {
+	logger          *logger.Logger
+	enrollmentToken string
+	credential      string
+	mutex           *sync.Mutex
+}
+
+func newCredentials(
+	logger *logger.Logger,
+	enrollmentToken string,
+) *credentials {
+	credential := ""
+	data, err := os.ReadFile(CREDENTIAL_FILE_PATH)
+	if err == nil {
+		credential = strings.TrimSpace(string(data))
+	}
+
+	return &credentials{
+		logger:          logger,
+		enrollmentToken: enrollmentToken,
+		credential:      credential,
+		mutex:           &sync.Mutex{},
+	}
+}
+
+// Returns the value of the authorization header. The credential is
+// preferred over the enrollment token. Returns empty if there is none.
+func (c *credentials) authorization() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.credential != "" {
+		return "Bearer " + c.credential
+	}
+	if c.enrollmentToken != "" {
+		return "Bearer " + c.enrollmentToken
+	}
+	return ""
+}
+
+// Persists the credential which is issued by the server.
+func (c *credentials) save(
+	credential string,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if credential == c.credential {
+		return
+	}
+	c.credential = credential
+
+	err := os.MkdirAll(filepath.Dir(CREDENTIAL_FILE_PATH), 0700)
+	if err == nil {
+		err = os.WriteFile(CREDENTIAL_FILE_PATH, []byte(credential), 0600)
+	}
+	if err != nil {
+		c.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Credential is not persisted.",
+			map[string]string{
+				"component.name": "controller",
+				"error.message":  err.Error(),
+			})
+		return
+	}
+
+	c.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Credential is received from the server.",
+		map[string]string{
+			"component.name": "controller",
+		})
+}
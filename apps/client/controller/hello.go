@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+const CLIENT_VERSION = "0.1.0"
+const INSTANCE_ID_FILE_PATH = "./bin/instance-id"
+
+func newHelloMessage(
+	logger *logger.Logger,
+	otelcol *otelcollector.Collector,
+) *protocol.HelloPayload {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Hostname is not retrieved.",
+			map[string]string{
+				"component.name": "websocketclient",
+				"error.message":  err.Error(),
+			})
+	}
+
+	mode := protocol.ModeDefault
+	if otelcol.IsDebug() {
+		mode = protocol.ModeDebug
+	}
+
+	_, timeZoneOffset := time.Now().Zone()
+
+	return &protocol.HelloPayload{
+		InstanceId:       loadInstanceId(logger),
+		Hostname:         hostname,
+		Os:               runtime.GOOS,
+		Arch:             runtime.GOARCH,
+		ClientVersion:    CLIENT_VERSION,
+		ServiceName:      os.Getenv("OTEL_SERVICE_NAME"),
+		CollectorVersion: otelcol.Version(),
+		Mode:             mode,
+		Group:            os.Getenv("CLIENT_GROUP"),
+		TimeZoneOffset:   timeZoneOffset,
+	}
+}
+
+// Returns the instance ID of this client. The ID is generated once and
+// persisted so that the client keeps its identity across restarts.
+func loadInstanceId(
+	logger *logger.Logger,
+) string {
+	data, err := os.ReadFile(INSTANCE_ID_FILE_PATH)
+	if err == nil && len(strings.TrimSpace(string(data))) != 0 {
+		return strings.TrimSpace(string(data))
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	instanceId := hex.EncodeToString(b)
+
+	err = os.MkdirAll(filepath.Dir(INSTANCE_ID_FILE_PATH), 0700)
+	if err == nil {
+		err = os.WriteFile(INSTANCE_ID_FILE_PATH, []byte(instanceId), 0600)
+	}
+	if err != nil {
+		logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Instance ID is not persisted.",
+			map[string]string{
+				"component.name": "websocketclient",
+				"error.message":  err.Error(),
+			})
+	}
+	return instanceId
+}
+
+// Returns the ID which the server knows this client by and signs its
+// commands for. It is the common name of the client certificate if one
+// is presented, otherwise the instance ID which the client reports.
+func loadClientId(
+	logger *logger.Logger,
+	tlsConfig *tls.Config,
+) (
+	string,
+	error,
+) {
+	if tlsConfig != nil && len(tlsConfig.Certificates) != 0 {
+		cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			return "", err
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	}
+
+	return loadInstanceId(logger), nil
+}
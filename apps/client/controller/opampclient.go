@@ -0,0 +1,598 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the collector config file in the effective config.
+const OPAMP_COLLECTOR_CONFIG_NAME = "otel-config.yaml"
+
+// Talks to an OpAMP server instead of the custom web socket protocol.
+// The mode is received as a remote config file and the outcome of the
+// commands is reported as the remote config status. The reconnects are
+// handled by the OpAMP client itself.
+type opampClient struct {
+	logger            *logger.Logger
+	wg                *sync.WaitGroup
+	controllerChannel chan *modeCommand
+	reportChannel     chan *protocol.Envelope
+	otelcol           *otelcollector.Collector
+	status            *statusRecorder
+	signals           *shutdownSignals
+	opampServerUrl    string
+	tlsConfig         *tls.Config
+	credentials       *credentials
+	verifier          *commandVerifier
+	health            *health.Recorder
+	client            client.OpAMPClient
+	// Mode file which is applied last, reported in the effective config
+	modeConfig *protocol.OpampModeConfig
+	// Hash of the remote config which carried the command, keyed by
+	// command ID
+	configHashes   map[string][]byte
+	lastConfigHash []byte
+	lastError      string
+	mutex          *sync.Mutex
+}
+
+func newOpampClient(
+	logger *logger.Logger,
+	wg *sync.WaitGroup,
+	controllerChannel chan *modeCommand,
+	reportChannel chan *protocol.Envelope,
+	otelcol *otelcollector.Collector,
+	status *statusRecorder,
+	signals *shutdownSignals,
+	opampServerUrl string,
+	tlsConfig *tls.Config,
+	credentials *credentials,
+	verifier *commandVerifier,
+	health *health.Recorder,
+) *opampClient {
+	return &opampClient{
+		logger:            logger,
+		wg:                wg,
+		controllerChannel: controllerChannel,
+		reportChannel:     reportChannel,
+		otelcol:           otelcol,
+		status:            status,
+		signals:           signals,
+		opampServerUrl:    opampServerUrl,
+		tlsConfig:         tlsConfig,
+		credentials:       credentials,
+		verifier:          verifier,
+		health:            health,
+		modeConfig:        protocol.NewOpampModeConfig("", protocol.ModeDefault, "", nil),
+		configHashes:      map[string][]byte{},
+		mutex:             &sync.Mutex{},
+	}
+}
+
+func (oc *opampClient) run() {
+	defer oc.wg.Done()
+
+	oc.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Starting OpAMP client...",
+		map[string]string{
+			"component.name": "opampclient",
+		})
+
+	hello := newHelloMessage(oc.logger, oc.otelcol)
+
+	oc.client = client.NewWebSocket(&opampLogger{logger: oc.logger})
+	err := oc.client.SetAgentDescription(newAgentDescription(hello))
+	if err == nil {
+		err = oc.client.SetHealth(oc.newHealth())
+	}
+	if err == nil {
+		err = oc.client.SetCustomCapabilities(&protobufs.CustomCapabilities{
+			Capabilities: []string{protocol.OpampHealthCapability},
+		})
+	}
+	if err == nil {
+		err = oc.client.Start(context.Background(), types.StartSettings{
+			OpAMPServerURL: oc.opampServerUrl,
+			TLSConfig:      oc.tlsConfig,
+			HeaderFunc:     oc.header,
+			InstanceUid:    newInstanceUid(hello.InstanceId),
+			Capabilities: protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig |
+				protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth |
+				protobufs.AgentCapabilities_AgentCapabilities_AcceptsOpAMPConnectionSettings,
+			Callbacks: types.Callbacks{
+				OnConnect: func(ctx context.Context) {
+					oc.status.setConnected(true)
+					oc.logger.LogWithFields(
+						logrus.InfoLevel,
+						"Connected to the OpAMP server.",
+						map[string]string{
+							"component.name":    "opampclient",
+							"client.instanceId": hello.InstanceId,
+						})
+				},
+				OnConnectFailed: func(ctx context.Context, err error) {
+					// The OpAMP client reports no disconnects, the lost
+					// connection shows up as a failed reconnect
+					oc.status.setConnected(false)
+					oc.logger.LogWithFields(
+						logrus.ErrorLevel,
+						"Connecting to the OpAMP server is failed.",
+						map[string]string{
+							"component.name": "opampclient",
+							"error.message":  err.Error(),
+						})
+				},
+				OnMessage:                 oc.handleMessage,
+				OnOpampConnectionSettings: oc.handleConnectionSettings,
+				GetEffectiveConfig:        oc.getEffectiveConfig,
+			},
+		})
+	}
+	if err != nil {
+		oc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Starting OpAMP client is failed.",
+			map[string]string{
+				"component.name": "opampclient",
+				"error.message":  err.Error(),
+			})
+		return
+	}
+	defer oc.status.setConnected(false)
+
+	healthReport := time.NewTicker(WEB_SOCKET_STATE_REPORT_INTERVAL)
+	defer healthReport.Stop()
+
+	healthSummary := time.NewTicker(HEALTH_REPORT_INTERVAL)
+	defer healthSummary.Stop()
+
+	for {
+		select {
+		case report := <-oc.reportChannel:
+			oc.report(report)
+			oc.client.SetHealth(oc.newHealth())
+		case err := <-oc.otelcol.Crashes():
+			oc.reportCrash(err)
+		case <-healthReport.C:
+			oc.client.SetHealth(oc.newHealth())
+		case <-healthSummary.C:
+			if oc.health != nil {
+				oc.sendHealthSummary()
+			}
+		case <-oc.signals.disconnect:
+			oc.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Client shuts down, stopping OpAMP client...",
+				map[string]string{
+					"component.name": "opampclient",
+				})
+
+			// Report what is left before the connection is closed
+			for len(oc.reportChannel) > 0 {
+				oc.report(<-oc.reportChannel)
+			}
+			oc.client.SetHealth(oc.newHealth())
+
+			// The client sends the close frame and waits for the reply
+			ctx, cancel := context.WithTimeout(context.Background(), WEB_SOCKET_CLOSE_TIMEOUT)
+			defer cancel()
+			oc.client.Stop(ctx)
+			return
+		}
+	}
+}
+
+// Handles the message which is received from the OpAMP server. Only
+// the remote config is processed, the mode file in it is passed to the
+// runner as a command.
+func (oc *opampClient) handleMessage(
+	ctx context.Context,
+	message *types.MessageData,
+) {
+	if message.RemoteConfig == nil {
+		return
+	}
+	hash := message.RemoteConfig.ConfigHash
+
+	oc.mutex.Lock()
+	isApplied := oc.lastConfigHash != nil && hex.EncodeToString(oc.lastConfigHash) == hex.EncodeToString(hash)
+	oc.mutex.Unlock()
+	if isApplied {
+		return
+	}
+
+	cmd, err := parseModeConfig(message.RemoteConfig.Config, oc.verifier)
+	if err != nil {
+		oc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Remote config is not valid.",
+			map[string]string{
+				"component.name": "opampclient",
+				"error.message":  err.Error(),
+			})
+		oc.client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			ErrorMessage:         err.Error(),
+		})
+		return
+	}
+
+	oc.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Remote config is received.",
+		map[string]string{
+			"component.name":     "opampclient",
+			"message.command.id": cmd.id,
+			"otelcol.mode.debug": strconv.FormatBool(cmd.isDebug),
+			"otelcol.mode.ttl":   cmd.ttl.String(),
+		})
+
+	oc.mutex.Lock()
+	oc.lastConfigHash = hash
+	oc.configHashes[cmd.id] = hash
+	oc.mutex.Unlock()
+
+	// The command is acknowledged before it is passed to the runner so
+	// that the acceptance precedes the outcome
+	oc.client.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: hash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING,
+	})
+	if rejection := oc.signals.forward(oc.controllerChannel, cmd); rejection != nil {
+		oc.report(rejection)
+	}
+}
+
+// Sends the health summary of the application as a custom message. The
+// summary is dropped if the previous one is not sent yet.
+func (oc *opampClient) sendHealthSummary() {
+	// Marshalling the health payload cannot fail
+	data, _ := json.Marshal(oc.health.Summarize())
+	_, err := oc.client.SendCustomMessage(&protobufs.CustomMessage{
+		Capability: protocol.OpampHealthCapability,
+		Type:       protocol.OpampHealthMessageType,
+		Data:       data,
+	})
+	if err != nil {
+		oc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Health summary could not be sent.",
+			map[string]string{
+				"component.name": "opampclient",
+				"error.message":  err.Error(),
+			})
+	}
+}
+
+// Reports the crash of the collector in the health of the agent and as
+// a custom message so that the server can tell it from a failed command.
+func (oc *opampClient) reportCrash(
+	err error,
+) {
+	oc.mutex.Lock()
+	oc.lastError = "collector crashed: " + err.Error()
+	oc.mutex.Unlock()
+	oc.client.SetHealth(oc.newHealth())
+
+	// Marshalling the payload cannot fail
+	data, _ := json.Marshal(newCollectorCrashedPayload(oc.otelcol, err))
+	_, err = oc.client.SendCustomMessage(&protobufs.CustomMessage{
+		Capability: protocol.OpampHealthCapability,
+		Type:       protocol.OpampCollectorCrashedMessageType,
+		Data:       data,
+	})
+	if err != nil {
+		oc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Collector crash could not be reported.",
+			map[string]string{
+				"component.name": "opampclient",
+				"error.message":  err.Error(),
+			})
+	}
+}
+
+// Translates the report of the runner to the remote config status and
+// the effective config.
+func (oc *opampClient) report(
+	message *protocol.Envelope,
+) {
+	switch message.Type {
+	case protocol.MessageTypeAck:
+		payload := &protocol.AckPayload{}
+		message.DecodePayload(payload)
+
+		// Only the status of the last remote config is reported, which
+		// belongs to the command that superseded this one
+		if payload.Status == protocol.CommandStatusSuperseded {
+			oc.mutex.Lock()
+			delete(oc.configHashes, message.CommandId)
+			oc.mutex.Unlock()
+			return
+		}
+
+		oc.mutex.Lock()
+		hash, ok := oc.configHashes[message.CommandId]
+		delete(oc.configHashes, message.CommandId)
+		if payload.Status == protocol.CommandStatusApplied {
+			oc.modeConfig = oc.pendingModeConfig(message.CommandId)
+		}
+		oc.lastError = payload.Error
+		oc.mutex.Unlock()
+		if !ok {
+			return
+		}
+
+		status := &protobufs.RemoteConfigStatus{
+			LastRemoteConfigHash: hash,
+			Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+		}
+		if payload.Status == protocol.CommandStatusFailed {
+			status.Status = protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED
+			status.ErrorMessage = payload.Error
+		}
+		oc.client.SetRemoteConfigStatus(status)
+		oc.client.UpdateEffectiveConfig(context.Background())
+
+	case protocol.MessageTypeModeExpired:
+		payload := &protocol.ModeExpiredPayload{}
+		message.DecodePayload(payload)
+
+		oc.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Reporting the expired TTL as effective config.",
+			map[string]string{
+				"component.name":     "opampclient",
+				"message.command.id": message.CommandId,
+			})
+
+		oc.mutex.Lock()
+		oc.modeConfig = protocol.NewOpampModeConfig(message.CommandId, protocol.ModeDefault, "", nil)
+		oc.lastError = payload.Error
+		oc.mutex.Unlock()
+		oc.client.UpdateEffectiveConfig(context.Background())
+	}
+}
+
+// Sets the authorization header of the connection requests. The
+// credential replaces the enrollment token once the server issues it.
+func (oc *opampClient) header(
+	header http.Header,
+) http.Header {
+	if authorization := oc.credentials.authorization(); authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	return header
+}
+
+// Persists the credential which the server offers as the authorization
+// header of the connection settings. The other settings are ignored.
+func (oc *opampClient) handleConnectionSettings(
+	ctx context.Context,
+	settings *protobufs.OpAMPConnectionSettings,
+) error {
+	for _, header := range settings.GetHeaders().GetHeaders() {
+		if !strings.EqualFold(header.Key, "Authorization") {
+			continue
+		}
+
+		credential, ok := strings.CutPrefix(header.Value, "Bearer ")
+		if !ok || credential == "" {
+			return errors.New("authorization header is not a bearer token")
+		}
+		oc.credentials.save(credential)
+	}
+	return nil
+}
+
+// Returns the mode file of the command which is applied. The mode is
+// taken from the collector since it is the one which is started.
+func (oc *opampClient) pendingModeConfig(
+	commandId string,
+) *protocol.OpampModeConfig {
+	mode := protocol.ModeDefault
+	if oc.otelcol.IsDebug() {
+		mode = protocol.ModeDebug
+	}
+	return protocol.NewOpampModeConfig(commandId, mode, "", nil)
+}
+
+// Returns the collector config and the mode file as effective config.
+func (oc *opampClient) getEffectiveConfig(
+	ctx context.Context,
+) (
+	*protobufs.EffectiveConfig,
+	error,
+) {
+	oc.mutex.Lock()
+	modeConfig, err := yaml.Marshal(oc.modeConfig)
+	oc.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	configMap := map[string]*protobufs.AgentConfigFile{
+		protocol.OpampModeConfigName: {
+			Body:        modeConfig,
+			ContentType: protocol.OpampModeConfigContentType,
+		},
+	}
+
+	// The collector config is missing until the collector is started
+	collectorConfig, err := oc.otelcol.Config()
+	if err == nil {
+		configMap[OPAMP_COLLECTOR_CONFIG_NAME] = &protobufs.AgentConfigFile{
+			Body:        collectorConfig,
+			ContentType: "text/yaml",
+		}
+	}
+
+	return &protobufs.EffectiveConfig{
+		ConfigMap: &protobufs.AgentConfigMap{
+			ConfigMap: configMap,
+		},
+	}, nil
+}
+
+func (oc *opampClient) newHealth() *protobufs.ComponentHealth {
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+
+	health := &protobufs.ComponentHealth{
+		Healthy:   oc.otelcol.IsRunning(),
+		Status:    "stopped",
+		LastError: oc.lastError,
+	}
+	if health.Healthy {
+		health.Status = "running"
+	}
+	return health
+}
+
+// Parses the mode file of the remote config into a command. A remote
+// config without the mode file switches the collector to default mode.
+// The command is rejected if it cannot be verified.
+func parseModeConfig(
+	config *protobufs.AgentConfigMap,
+	verifier *commandVerifier,
+) (
+	*modeCommand,
+	error,
+) {
+	modeConfig := protocol.NewOpampModeConfig("", protocol.ModeDefault, "", nil)
+	if config != nil {
+		if file, ok := config.ConfigMap[protocol.OpampModeConfigName]; ok {
+			err := yaml.Unmarshal(file.Body, modeConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	level := modeConfig.Service.Telemetry.Logs.Level
+	if level != protocol.OpampLogLevelDebug && level != protocol.OpampLogLevelDefault {
+		return nil, errors.New("log level is unknown: " + level)
+	}
+
+	var ttl time.Duration
+	if modeConfig.Ttl() != "" {
+		var err error
+		ttl, err = time.ParseDuration(modeConfig.Ttl())
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("ttl is invalid: " + modeConfig.Ttl())
+		}
+	}
+
+	// The command which cannot be verified never reaches the runner
+	err := verifier.verify(modeConfig.CommandId(), modeConfig.Mode(), modeConfig.Ttl(), modeConfig.Signature())
+	if err != nil {
+		return nil, err
+	}
+
+	return &modeCommand{
+		id:      modeConfig.CommandId(),
+		isDebug: modeConfig.Mode() == protocol.ModeDebug,
+		ttl:     ttl,
+	}, nil
+}
+
+// Maps the metadata of the hello message to the agent description.
+func newAgentDescription(
+	hello *protocol.HelloPayload,
+) *protobufs.AgentDescription {
+	newAttribute := func(key string, value string) *protobufs.KeyValue {
+		return &protobufs.KeyValue{
+			Key: key,
+			Value: &protobufs.AnyValue{
+				Value: &protobufs.AnyValue_StringValue{StringValue: value},
+			},
+		}
+	}
+
+	return &protobufs.AgentDescription{
+		IdentifyingAttributes: []*protobufs.KeyValue{
+			newAttribute("service.name", hello.ServiceName),
+			newAttribute("service.version", hello.ClientVersion),
+			newAttribute("service.instance.id", hello.InstanceId),
+		},
+		NonIdentifyingAttributes: []*protobufs.KeyValue{
+			newAttribute("host.name", hello.Hostname),
+			newAttribute("os.type", hello.Os),
+			newAttribute("host.arch", hello.Arch),
+			newAttribute(protocol.OpampAttributeCollectorVersion, hello.CollectorVersion),
+			newAttribute(protocol.OpampAttributeGroup, hello.Group),
+			newAttribute(protocol.OpampAttributeTimeZoneOffset, strconv.Itoa(hello.TimeZoneOffset)),
+		},
+	}
+}
+
+// Returns the OpAMP instance UID for the instance ID. The generated
+// instance IDs are already 16 bytes, others are hashed into 16 bytes.
+func newInstanceUid(
+	instanceId string,
+) types.InstanceUid {
+	var uid types.InstanceUid
+	if b, err := hex.DecodeString(instanceId); err == nil && len(b) == len(uid) {
+		copy(uid[:], b)
+		return uid
+	}
+	hash := sha256.Sum256([]byte(instanceId))
+	copy(uid[:], hash[:])
+	return uid
+}
+
+// Adapts the logger to the one which the OpAMP client expects.
+type opampLogger struct {
+	logger *logger.Logger
+}
+
+func (ol *opampLogger) Debugf(
+	ctx context.Context,
+	format string,
+	v ...interface{},
+) {
+	ol.logger.LogWithFields(
+		logrus.DebugLevel,
+		fmt.Sprintf(format, v...),
+		map[string]string{
+			"component.name": "opampclient",
+		})
+}
+
+func (ol *opampLogger) Errorf(
+	ctx context.Context,
+	format string,
+	v ...interface{},
+) {
+	ol.logger.LogWithFields(
+		logrus.ErrorLevel,
+		fmt.Sprintf(format, v...),
+		map[string]string{
+			"component.name": "opampclient",
+		})
+}
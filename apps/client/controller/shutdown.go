@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+var errClientShuttingDown = errors.New("client is shutting down")
+
+// Signals of the ordered shutdown which the runner and the server
+// clients watch. Each one is closed once.
+type shutdownSignals struct {
+	// Closed once no more commands are passed to the runner
+	stopCommands chan struct{}
+	// Closed once the runner should return so that the collector can be
+	// stopped
+	stopRunner chan struct{}
+	// Closed once the connection to the server should be closed
+	disconnect chan struct{}
+	once       *sync.Once
+}
+
+func newShutdownSignals() *shutdownSignals {
+	return &shutdownSignals{
+		stopCommands: make(chan struct{}),
+		stopRunner:   make(chan struct{}),
+		disconnect:   make(chan struct{}),
+		once:         &sync.Once{},
+	}
+}
+
+func (s *shutdownSignals) stopAcceptingCommands() {
+	s.once.Do(func() {
+		close(s.stopCommands)
+	})
+}
+
+// Passes the command to the runner unless the commands are stopped.
+// Returns the acknowledgement of its failure otherwise.
+func (s *shutdownSignals) forward(
+	controllerChannel chan *modeCommand,
+	cmd *modeCommand,
+) *protocol.Envelope {
+	rejection := newAckMessage(
+		&commandResult{
+			id:  cmd.id,
+			err: errClientShuttingDown,
+		},
+		false,
+	)
+
+	// Checked first since a send to the runner could win otherwise
+	select {
+	case <-s.stopCommands:
+		return rejection
+	default:
+	}
+
+	select {
+	case <-s.stopCommands:
+		return rejection
+	case controllerChannel <- cmd:
+		return nil
+	}
+}
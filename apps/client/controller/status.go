@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// State of the controller which the local probes report.
+type Status struct {
+	// Whether the control connection to the server is established
+	Connected bool `json:"connected"`
+	// Time of the last connect or disconnect, if any
+	ConnectionChangedAt *time.Time    `json:"connectionChangedAt,omitempty"`
+	CollectorRunning    bool          `json:"collectorRunning"`
+	CollectorMode       protocol.Mode `json:"collectorMode"`
+	// Outcome of the last command which is applied to the collector
+	LastApply *ApplyResult `json:"lastApply,omitempty"`
+}
+
+// Outcome of a command which is applied to the collector.
+type ApplyResult struct {
+	CommandId string        `json:"commandId"`
+	Mode      protocol.Mode `json:"mode"`
+	AppliedAt time.Time     `json:"appliedAt"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Records the state of the control connection and of the commands which
+// are applied. The state of the collector is taken from the collector
+// itself.
+type statusRecorder struct {
+	otelcol             *otelcollector.Collector
+	connected           bool
+	connectionChangedAt *time.Time
+	lastApply           *ApplyResult
+	mutex               *sync.Mutex
+}
+
+func newStatusRecorder(
+	otelcol *otelcollector.Collector,
+) *statusRecorder {
+	return &statusRecorder{
+		otelcol: otelcol,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (sr *statusRecorder) setConnected(
+	connected bool,
+) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if sr.connected == connected && sr.connectionChangedAt != nil {
+		return
+	}
+	now := time.Now().UTC()
+	sr.connected = connected
+	sr.connectionChangedAt = &now
+}
+
+func (sr *statusRecorder) setApplied(
+	cmd *modeCommand,
+	err error,
+) {
+	result := &ApplyResult{
+		CommandId: cmd.id,
+		Mode:      protocol.ModeDefault,
+		AppliedAt: time.Now().UTC(),
+	}
+	if cmd.isDebug {
+		result.Mode = protocol.ModeDebug
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.lastApply = result
+}
+
+func (sr *statusRecorder) status() *Status {
+	status := &Status{
+		CollectorRunning: sr.otelcol.IsRunning(),
+		CollectorMode:    protocol.ModeDefault,
+	}
+	if sr.otelcol.IsDebug() {
+		status.CollectorMode = protocol.ModeDebug
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	status.Connected = sr.connected
+	status.ConnectionChangedAt = sr.connectionChangedAt
+	status.LastApply = sr.lastApply
+	return status
+}
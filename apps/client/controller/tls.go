@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// Creates the TLS config which the client connects to the server with.
+// The CA bundle replaces the system roots if it is given and the client
+// certificate is presented to the servers which require one. Returns nil
+// if nothing is configured.
+func newClientTlsConfig(
+	caFile string,
+	certFile string,
+	keyFile string,
+) (
+	*tls.Config,
+	error,
+) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA bundle does not contain any certificate")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
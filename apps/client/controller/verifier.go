@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+var (
+	errCommandIsReplayed   = errors.New("command is replayed")
+	errPublicKeyIsRequired = errors.New("public key of the server is required unless the server is on a loopback address or the verification is skipped explicitly")
+)
+
+// Verifies the signature of the commands against the pinned public key
+// of the server before they reach the runner. Only the commands which
+// are signed for the ID of this client are accepted. The nonces are
+// kept until the commands expire, after which they are rejected anyway.
+// They are only kept in memory, so a command can be replayed within its
+// validity after the client restarts.
+type commandVerifier struct {
+	clientId  string
+	publicKey ed25519.PublicKey
+	nonces    map[string]time.Time
+	mutex     *sync.Mutex
+}
+
+// Loads the PEM encoded public key of the server. The commands are only
+// accepted without verification if no file is given and either the
+// server is on a loopback address or the verification is skipped
+// explicitly.
+func newCommandVerifier(
+	logger *logger.Logger,
+	clientId string,
+	publicKeyFile string,
+	serverUrl string,
+	skipVerify bool,
+) (
+	*commandVerifier,
+	error,
+) {
+	cv := &commandVerifier{
+		clientId: clientId,
+		nonces:   map[string]time.Time{},
+		mutex:    &sync.Mutex{},
+	}
+
+	if publicKeyFile == "" {
+		if !skipVerify && !isLoopback(serverUrl) {
+			return nil, errPublicKeyIsRequired
+		}
+		logger.LogWithFields(
+			logrus.WarnLevel,
+			"No public key of the server is pinned, the commands are not verified.",
+			map[string]string{
+				"component.name": "controller",
+			})
+		return cv, nil
+	}
+
+	data, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key file does not contain a PEM block")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+	cv.publicKey = publicKey
+	return cv, nil
+}
+
+// Rejects the command if its signature is missing or invalid, if it is
+// signed for another client, if it is expired or if its nonce is
+// already seen.
+func (cv *commandVerifier) verify(
+	commandId string,
+	mode protocol.Mode,
+	ttl string,
+	signature *protocol.CommandSignature,
+) error {
+	if cv.publicKey == nil {
+		return nil
+	}
+
+	now := time.Now()
+	err := protocol.VerifyCommand(cv.publicKey, cv.clientId, commandId, mode, ttl, signature, now)
+	if err != nil {
+		return err
+	}
+
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	for nonce, expiresAt := range cv.nonces {
+		if !now.Before(expiresAt) {
+			delete(cv.nonces, nonce)
+		}
+	}
+	if _, ok := cv.nonces[signature.Nonce]; ok {
+		return errCommandIsReplayed
+	}
+	cv.nonces[signature.Nonce] = signature.ExpiresAt
+	return nil
+}
+
+// Returns whether the host of the URL is a loopback address, where the
+// commands cannot be spoofed by others on the network.
+func isLoopback(
+	serverUrl string,
+) bool {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
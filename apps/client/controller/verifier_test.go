@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+func TestCommandVerifierVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv := newTestCommandVerifier(t, publicKey)
+
+	signature, err := protocol.SignCommand(privateKey, "client", "command", protocol.ModeDebug, "30m", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forOtherClient, err := protocol.SignCommand(privateKey, "other", "command", protocol.ModeDebug, "30m", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := protocol.SignCommand(privateKey, "client", "command", protocol.ModeDebug, "30m", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cases run in order and share the nonces of the verifier.
+	tests := []struct {
+		name      string
+		commandId string
+		mode      protocol.Mode
+		signature *protocol.CommandSignature
+		expected  error
+	}{
+		{
+			name:      "tampered",
+			commandId: "command",
+			mode:      protocol.ModeDefault,
+			signature: signature,
+			expected:  protocol.ErrSignatureIsInvalid,
+		},
+		{
+			name:      "signed for another client",
+			commandId: "command",
+			mode:      protocol.ModeDebug,
+			signature: forOtherClient,
+			expected:  protocol.ErrSignatureIsInvalid,
+		},
+		{
+			name:      "unsigned",
+			commandId: "command",
+			mode:      protocol.ModeDebug,
+			signature: nil,
+			expected:  protocol.ErrSignatureIsMissing,
+		},
+		{
+			name:      "expired",
+			commandId: "command",
+			mode:      protocol.ModeDebug,
+			signature: expired,
+			expected:  protocol.ErrCommandIsExpired,
+		},
+		{
+			name:      "valid",
+			commandId: "command",
+			mode:      protocol.ModeDebug,
+			signature: signature,
+		},
+		{
+			name:      "replayed",
+			commandId: "command",
+			mode:      protocol.ModeDebug,
+			signature: signature,
+			expected:  errCommandIsReplayed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := cv.verify(test.commandId, test.mode, "30m", test.signature)
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestNewCommandVerifierRequiresPublicKey(t *testing.T) {
+	_, err := newCommandVerifier(nil, "client", "", "wss://controller.example.com/ws", false)
+	if !errors.Is(err, errPublicKeyIsRequired) {
+		t.Errorf("expected %v, got %v", errPublicKeyIsRequired, err)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		serverUrl string
+		expected  bool
+	}{
+		{serverUrl: "ws://localhost:8081/ws", expected: true},
+		{serverUrl: "ws://127.0.0.1:8081/ws", expected: true},
+		{serverUrl: "ws://[::1]:8081/ws", expected: true},
+		{serverUrl: "wss://controller.example.com/ws", expected: false},
+		{serverUrl: "ws://10.0.0.1:8081/ws", expected: false},
+		{serverUrl: "ws://localhost.example.com/ws", expected: false},
+		{serverUrl: "://", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.serverUrl, func(t *testing.T) {
+			if actual := isLoopback(test.serverUrl); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+// Writes the public key as PEM and loads it like the client does.
+func newTestCommandVerifier(
+	t *testing.T,
+	publicKey ed25519.PublicKey,
+) *commandVerifier {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile := filepath.Join(t.TempDir(), "server.pub")
+	err = os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cv, err := newCommandVerifier(nil, "client", publicKeyFile, "wss://controller.example.com/ws", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cv
+}
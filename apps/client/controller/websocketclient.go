@@ -1,43 +1,78 @@
 package controller
 
 import (
-	"os"
-	"os/signal"
+	"crypto/tls"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otelcollector"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
 )
 
+const WEB_SOCKET_MIN_RECONNECT_BACKOFF = time.Second
+const WEB_SOCKET_MAX_RECONNECT_BACKOFF = 30 * time.Second
+const WEB_SOCKET_STATE_REPORT_INTERVAL = 30 * time.Second
+
+// Time which the server is given to reply to the close frame.
+const WEB_SOCKET_CLOSE_TIMEOUT = time.Second
+
 type websocketClient struct {
 	logger             *logger.Logger
 	wg                 *sync.WaitGroup
-	controllerChannel  chan bool
+	controllerChannel  chan *modeCommand
+	reportChannel      chan *protocol.Envelope
+	otelcol            *otelcollector.Collector
+	status             *statusRecorder
+	signals            *shutdownSignals
 	websocketServerUrl string
+	dialer             *websocket.Dialer
+	credentials        *credentials
+	verifier           *commandVerifier
+	health             *health.Recorder
 }
 
 func newWebSocketClient(
 	logger *logger.Logger,
 	wg *sync.WaitGroup,
-	controllerChannel chan bool,
+	controllerChannel chan *modeCommand,
+	reportChannel chan *protocol.Envelope,
+	otelcol *otelcollector.Collector,
+	status *statusRecorder,
+	signals *shutdownSignals,
 	websocketServerUrl string,
+	tlsConfig *tls.Config,
+	credentials *credentials,
+	verifier *commandVerifier,
+	health *health.Recorder,
 ) *websocketClient {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+
 	return &websocketClient{
 		logger:             logger,
 		wg:                 wg,
 		controllerChannel:  controllerChannel,
+		reportChannel:      reportChannel,
+		otelcol:            otelcol,
+		status:             status,
+		signals:            signals,
 		websocketServerUrl: websocketServerUrl,
+		dialer:             &dialer,
+		credentials:        credentials,
+		verifier:           verifier,
+		health:             health,
 	}
 }
 
 func (wc *websocketClient) run() {
 	defer wc.wg.Done()
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
 	wc.logger.LogWithFields(
 		logrus.InfoLevel,
 		"Starting web socket client...",
@@ -45,27 +80,106 @@ func (wc *websocketClient) run() {
 			"component.name": "websocketclient",
 		})
 
-	conn, _, err := websocket.DefaultDialer.Dial(wc.websocketServerUrl, nil)
+	// Reconnect with an exponential backoff whenever the connection is
+	// lost, until the client shuts down
+	backoff := WEB_SOCKET_MIN_RECONNECT_BACKOFF
+	for {
+		isConnected, isDisconnected := wc.runSession()
+		if isDisconnected {
+			return
+		}
+		if isConnected {
+			backoff = WEB_SOCKET_MIN_RECONNECT_BACKOFF
+		}
+
+		wc.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Reconnecting to the server...",
+			map[string]string{
+				"component.name": "websocketclient",
+				"backoff":        backoff.String(),
+			})
+
+		select {
+		case <-wc.signals.disconnect:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > WEB_SOCKET_MAX_RECONNECT_BACKOFF {
+			backoff = WEB_SOCKET_MAX_RECONNECT_BACKOFF
+		}
+	}
+}
+
+// Connects to the server and serves the connection until it is lost
+// or the client shuts down. Returns whether the connection was
+// established and whether it is closed for the shutdown.
+func (wc *websocketClient) runSession() (
+	bool,
+	bool,
+) {
+	header := http.Header{}
+	if authorization := wc.credentials.authorization(); authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+
+	conn, resp, err := wc.dialer.Dial(wc.websocketServerUrl, header)
+	if err != nil {
+		fields := map[string]string{
+			"component.name": "websocketclient",
+			"error.message":  err.Error(),
+		}
+		if resp != nil {
+			fields["http.response.status_code"] = strconv.Itoa(resp.StatusCode)
+		}
+		wc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Connecting to the server is failed.",
+			fields)
+		wc.status.setConnected(false)
+		return false, false
+	}
+	defer conn.Close()
+
+	wc.status.setConnected(true)
+	defer wc.status.setConnected(false)
+
+	// Introduce the client to the server
+	hello := newHelloMessage(wc.logger, wc.otelcol)
+	message, err := protocol.NewEnvelope(protocol.MessageTypeHello, "", hello)
+	if err == nil {
+		err = conn.WriteJSON(message)
+	}
 	if err != nil {
 		wc.logger.LogWithFields(
 			logrus.ErrorLevel,
-			"Starting web socket client is failed,",
+			"Sending hello message is failed.",
 			map[string]string{
 				"component.name": "websocketclient",
 				"error.message":  err.Error(),
 			})
-		return
+		return true, false
 	}
-	defer conn.Close()
+	wc.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Hello message is sent.",
+		map[string]string{
+			"component.name":    "websocketclient",
+			"client.instanceId": hello.InstanceId,
+		})
 
+	// Replies are written by this goroutine only since the connection
+	// does not support concurrent writers
+	replies := make(chan *protocol.Envelope, 16)
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
-		defer close(wc.controllerChannel)
 
 		for {
-			_, message, err := conn.ReadMessage()
+			_, data, err := conn.ReadMessage()
 			if err != nil {
 				wc.logger.LogWithFields(
 					logrus.ErrorLevel,
@@ -76,20 +190,17 @@ func (wc *websocketClient) run() {
 					})
 				return
 			}
-			wc.logger.LogWithFields(
-				logrus.InfoLevel,
-				"Message is read.",
-				map[string]string{
-					"component.name": "websocketclient",
-					"signal":         string(message),
-				})
 
-			msg := string(message)
-			if msg == "debug" {
-				wc.controllerChannel <- true
-
-			} else if msg == "default" {
-				wc.controllerChannel <- false
+			// The command is acknowledged before it is passed to the
+			// runner so that the acceptance precedes the outcome
+			cmd, reply := wc.handleMessage(data)
+			if reply != nil {
+				replies <- reply
+			}
+			if cmd != nil {
+				if rejection := wc.signals.forward(wc.controllerChannel, cmd); rejection != nil {
+					replies <- rejection
+				}
 			}
 		}
 	}()
@@ -97,16 +208,36 @@ func (wc *websocketClient) run() {
 	healthCheck := time.NewTicker(5 * time.Second)
 	defer healthCheck.Stop()
 
+	stateReport := time.NewTicker(WEB_SOCKET_STATE_REPORT_INTERVAL)
+	defer stateReport.Stop()
+
+	healthReport := time.NewTicker(HEALTH_REPORT_INTERVAL)
+	defer healthReport.Stop()
+
 	for {
 		select {
 		case <-done:
 			wc.logger.LogWithFields(
 				logrus.InfoLevel,
-				"Application is shut down gracefully.",
+				"Connection to the server is closed.",
 				map[string]string{
 					"component.name": "websocketclient",
 				})
-			return
+			return true, false
+		case reply := <-replies:
+			wc.send(conn, reply)
+		case report := <-wc.reportChannel:
+			wc.send(conn, report)
+			wc.send(conn, wc.newStateMessage())
+		case err := <-wc.otelcol.Crashes():
+			wc.send(conn, newCollectorCrashedMessage(wc.otelcol, err))
+			wc.send(conn, wc.newStateMessage())
+		case <-stateReport.C:
+			wc.send(conn, wc.newStateMessage())
+		case <-healthReport.C:
+			if wc.health != nil {
+				wc.send(conn, newHealthMessage(wc.health))
+			}
 		case <-healthCheck.C:
 			// Do nothing, just wait for messages from the server
 			wc.logger.LogWithFields(
@@ -115,13 +246,18 @@ func (wc *websocketClient) run() {
 				map[string]string{
 					"component.name": "websocketclient",
 				})
-		case <-interrupt:
+		case <-wc.signals.disconnect:
 			wc.logger.LogWithFields(
-				logrus.ErrorLevel,
-				"Interrupt received, closing connection...",
+				logrus.InfoLevel,
+				"Client shuts down, closing connection...",
 				map[string]string{
 					"component.name": "websocketclient",
 				})
+
+			// Report what is left before the connection is closed
+			for len(wc.reportChannel) > 0 {
+				wc.send(conn, <-wc.reportChannel)
+			}
 			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
 				wc.logger.LogWithFields(
@@ -131,8 +267,166 @@ func (wc *websocketClient) run() {
 						"component.name": "websocketclient",
 						"error.message":  err.Error(),
 					})
+				return true, true
 			}
-			return
+
+			// The connection is closed once the server replies
+			select {
+			case <-done:
+			case <-time.After(WEB_SOCKET_CLOSE_TIMEOUT):
+			}
+			return true, true
 		}
 	}
 }
+
+// Creates the report of the actual collector state so that the server
+// can detect a drift from the desired state.
+func (wc *websocketClient) newStateMessage() *protocol.Envelope {
+	mode := protocol.ModeDefault
+	if wc.otelcol.IsDebug() {
+		mode = protocol.ModeDebug
+	}
+
+	// Marshalling the state payload cannot fail
+	message, _ := protocol.NewEnvelope(
+		protocol.MessageTypeState,
+		"",
+		&protocol.StatePayload{
+			Mode:      mode,
+			IsRunning: wc.otelcol.IsRunning(),
+		},
+	)
+	return message
+}
+
+// Handles the message which is read from the server. Returns the
+// command to be applied and the reply to the message, if any.
+func (wc *websocketClient) handleMessage(
+	data []byte,
+) (
+	*modeCommand,
+	*protocol.Envelope,
+) {
+	message, err := protocol.Decode(data)
+	if err != nil {
+		wc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Message could not be decoded.",
+			map[string]string{
+				"component.name": "websocketclient",
+				"error.message":  err.Error(),
+			})
+		return nil, protocol.NewErrorEnvelope(message, protocol.DecodeErrorCode(err), err.Error())
+	}
+
+	wc.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Message is read.",
+		map[string]string{
+			"component.name":     "websocketclient",
+			"message.type":       string(message.Type),
+			"message.command.id": message.CommandId,
+		})
+
+	switch message.Type {
+	case protocol.MessageTypeSetMode:
+		payload := &protocol.SetModePayload{}
+		err := message.DecodePayload(payload)
+		if err != nil {
+			return nil, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error())
+		}
+
+		if payload.Mode != protocol.ModeDebug && payload.Mode != protocol.ModeDefault {
+			return nil, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, "mode is unknown: "+string(payload.Mode))
+		}
+
+		var ttl time.Duration
+		if payload.Ttl != "" {
+			ttl, err = time.ParseDuration(payload.Ttl)
+			if err != nil || ttl <= 0 {
+				return nil, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, "ttl is invalid: "+payload.Ttl)
+			}
+		}
+
+		// The command which cannot be verified never reaches the runner
+		err = wc.verifier.verify(message.CommandId, payload.Mode, payload.Ttl, payload.Signature)
+		if err != nil {
+			wc.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Command is rejected.",
+				map[string]string{
+					"component.name":     "websocketclient",
+					"message.command.id": message.CommandId,
+					"error.message":      err.Error(),
+				})
+			return nil, newAckMessage(&commandResult{id: message.CommandId, err: err}, false)
+		}
+
+		cmd := &modeCommand{
+			id:      message.CommandId,
+			isDebug: payload.Mode == protocol.ModeDebug,
+			ttl:     ttl,
+		}
+		return cmd, newAckMessage(&commandResult{id: cmd.id}, false)
+
+	case protocol.MessageTypeEnrolled:
+		payload := &protocol.EnrolledPayload{}
+		err := message.DecodePayload(payload)
+		if err != nil || payload.Credential == "" {
+			return nil, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, "credential is missing")
+		}
+
+		wc.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Client is enrolled.",
+			map[string]string{
+				"component.name": "websocketclient",
+				"client.id":      payload.ClientId,
+			})
+		wc.credentials.save(payload.Credential)
+		return nil, nil
+
+	case protocol.MessageTypeError:
+		payload := &protocol.ErrorPayload{}
+		message.DecodePayload(payload)
+		wc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Server replied with an error.",
+			map[string]string{
+				"component.name":     "websocketclient",
+				"message.command.id": message.CommandId,
+				"error.code":         string(payload.Code),
+				"error.message":      payload.Message,
+			})
+		return nil, nil
+
+	default:
+		wc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Message type is unknown.",
+			map[string]string{
+				"component.name": "websocketclient",
+				"message.type":   string(message.Type),
+			})
+		return nil, protocol.NewErrorEnvelope(message, protocol.ErrorCodeUnknownMessageType, "message type is unknown: "+string(message.Type))
+	}
+}
+
+func (wc *websocketClient) send(
+	conn *websocket.Conn,
+	message *protocol.Envelope,
+) {
+	err := conn.WriteJSON(message)
+	if err != nil {
+		wc.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Error occurred during sending message.",
+			map[string]string{
+				"component.name":     "websocketclient",
+				"message.type":       string(message.Type),
+				"message.command.id": message.CommandId,
+				"error.message":      err.Error(),
+			})
+	}
+}
@@ -0,0 +1,80 @@
+package health
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Maximum number of latencies which are kept per window. The ones
+// beyond are counted but not taken into the percentiles.
+const MAX_SAMPLES_PER_WINDOW = 10000
+
+// Records the latencies of the application and summarizes them per
+// window for the server.
+type Recorder struct {
+	latencies   []float64
+	count       int
+	windowStart time.Time
+	mutex       *sync.Mutex
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		latencies:   []float64{},
+		windowStart: time.Now(),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (r *Recorder) RecordLatency(
+	duration time.Duration,
+) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.count++
+	if len(r.latencies) < MAX_SAMPLES_PER_WINDOW {
+		r.latencies = append(r.latencies, float64(duration)/float64(time.Millisecond))
+	}
+}
+
+// Returns the summary of the window since the last call and starts a
+// new one.
+func (r *Recorder) Summarize() *protocol.HealthPayload {
+	r.mutex.Lock()
+	latencies := r.latencies
+	summary := &protocol.HealthPayload{
+		Window: time.Since(r.windowStart).Round(time.Second).String(),
+		Count:  r.count,
+	}
+	r.latencies = []float64{}
+	r.count = 0
+	r.windowStart = time.Now()
+	r.mutex.Unlock()
+
+	sort.Float64s(latencies)
+	summary.LatencyP50Ms = percentile(latencies, 50)
+	summary.LatencyP95Ms = percentile(latencies, 95)
+	summary.LatencyP99Ms = percentile(latencies, 99)
+	return summary
+}
+
+// Returns the given percentile of the sorted values with the nearest
+// rank method.
+func percentile(
+	sorted []float64,
+	p float64,
+) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return math.Round(sorted[rank-1]*100) / 100
+}
@@ -2,29 +2,163 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/app"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/controller"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/client/health"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 )
 
+// Deadline of the whole shutdown. The collector is killed and the
+// connection is dropped if they are not closed by then.
+const SHUTDOWN_TIMEOUT = 15 * time.Second
+
 func main() {
 
-	ctx := context.Background()
+	// The client shuts down once the process is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Create metric provider
-	mp := otel.NewMetricProvider(ctx)
-	defer otel.ShutdownMetricProvider(ctx, mp)
+	mp := otel.NewMetricProvider(context.Background())
 
 	// Instantiate logger
 	l := logger.New()
 
+	// Instantiate health recorder which the application records to and
+	// the controller summarizes to the server
+	h := health.NewRecorder()
+
 	// Run controller
-	c := controller.New(l, "ws://localhost:8081/ws")
+	transport := os.Getenv("CONTROLLER_TRANSPORT")
+	serverUrl := os.Getenv("CONTROLLER_SERVER_URL")
+	if serverUrl == "" {
+		serverUrl = "ws://localhost:8081/ws"
+		if transport == controller.TRANSPORT_OPAMP {
+			serverUrl = "ws://localhost:8081/v1/opamp"
+		}
+	}
+	minRestartInterval := controller.COLLECTOR_MIN_RESTART_INTERVAL
+	if value := os.Getenv("CONTROLLER_MIN_RESTART_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			l.LogWithFields(
+				logrus.ErrorLevel,
+				"Minimum restart interval is not valid: "+value,
+				map[string]string{
+					"component.name": "main",
+				})
+			os.Exit(1)
+		}
+		minRestartInterval = interval
+	}
+
+	insecureSkipVerify := false
+	if value := os.Getenv("CONTROLLER_INSECURE_SKIP_VERIFY"); value != "" {
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			l.LogWithFields(
+				logrus.ErrorLevel,
+				"Insecure skip verify is not a boolean: "+value,
+				map[string]string{
+					"component.name": "main",
+				})
+			os.Exit(1)
+		}
+		insecureSkipVerify = skip
+	}
+
+	c, err := controller.New(l, &controller.Config{
+		Transport: transport,
+		ServerUrl: serverUrl,
+
+		TlsCaFile:   os.Getenv("CONTROLLER_TLS_CA_FILE"),
+		TlsCertFile: os.Getenv("CONTROLLER_TLS_CERT_FILE"),
+		TlsKeyFile:  os.Getenv("CONTROLLER_TLS_KEY_FILE"),
+
+		SigningPublicKeyFile: os.Getenv("CONTROLLER_SIGNING_PUBLIC_KEY_FILE"),
+		InsecureSkipVerify:   insecureSkipVerify,
+
+		MinRestartInterval: minRestartInterval,
+
+		EnrollmentToken: os.Getenv("CONTROLLER_ENROLLMENT_TOKEN"),
+
+		Health: h,
+	})
+	if err != nil {
+		l.LogWithFields(
+			logrus.ErrorLevel,
+			"Controller could not be created.",
+			map[string]string{
+				"component.name": "main",
+				"error.message":  err.Error(),
+			})
+		os.Exit(1)
+	}
 	go c.Run()
 
 	// Run the application
-	a := app.New(l)
-	a.Run()
+	a := app.New(l, h, c)
+	a.Run(ctx)
+
+	shutdown(l, a, c, mp)
+}
+
+// Stops accepting commands first, then flushes the metrics into the
+// collector while it still runs, stops the collector and closes the
+// connection to the server last.
+func shutdown(
+	l *logger.Logger,
+	a *app.App,
+	c *controller.Controller,
+	mp *sdkmetric.MeterProvider,
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	c.StopCommands()
+	err := a.Shutdown(ctx)
+	if err != nil {
+		logShutdownError(l, "HTTP server could not be shut down gracefully.", err)
+	}
+
+	err = otel.ShutdownMetricProvider(ctx, mp)
+	if err != nil {
+		logShutdownError(l, "Metrics could not be flushed.", err)
+	}
+
+	err = c.Shutdown(ctx)
+	if err != nil {
+		logShutdownError(l, "Controller could not be shut down gracefully.", err)
+	}
+
+	l.LogWithFields(
+		logrus.InfoLevel,
+		"Client is shut down.",
+		map[string]string{
+			"component.name": "main",
+		})
+}
+
+func logShutdownError(
+	l *logger.Logger,
+	msg string,
+	err error,
+) {
+	l.LogWithFields(
+		logrus.ErrorLevel,
+		msg,
+		map[string]string{
+			"component.name": "main",
+			"error.message":  err.Error(),
+		})
 }
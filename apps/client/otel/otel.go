@@ -31,15 +31,11 @@ func NewMetricProvider(
 	return mp
 }
 
-// Shuts down meter provider
+// Shuts down meter provider. The metrics which are not exported yet are
+// flushed first.
 func ShutdownMetricProvider(
 	ctx context.Context,
 	mp *sdkmetric.MeterProvider,
-) {
-	// Do not make the application hang when it is shutdown.
-	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
-	defer cancel()
-	if err := mp.Shutdown(ctx); err != nil {
-		panic(err)
-	}
+) error {
+	return mp.Shutdown(ctx)
 }
@@ -1,10 +1,13 @@
 package otelcollector
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -12,16 +15,23 @@ import (
 	"github.com/utr1903/remotely-controlled-telemetry/apps/client/logger"
 )
 
+const OTEL_COLLECTOR_BINARY_PATH = "/bin/otelcol-contrib"
+const OTEL_COLLECTOR_CONFIG_PATH = "./bin/otel-config.yaml"
+
 type runnerSynchronizer struct {
 	isRunning bool
+	isDebug   bool
 	pid       *int
-	mutex     *sync.Mutex
+	// Closed once the last started process exits
+	exited chan struct{}
+	mutex  *sync.Mutex
 }
 
 type Collector struct {
 	logger                       *logger.Logger
 	runnerSynchronizer           *runnerSynchronizer
 	otelCollectorConfigGenerator *otelCollectorConfigGenerator
+	crashes                      chan error
 }
 
 func New(
@@ -31,12 +41,14 @@ func New(
 		logger: logger,
 		runnerSynchronizer: &runnerSynchronizer{
 			isRunning: false,
+			isDebug:   false,
 			pid:       nil,
 			mutex:     &sync.Mutex{},
 		},
 		otelCollectorConfigGenerator: newOtelCollectorConfigGenerator(
 			logger,
 		),
+		crashes: make(chan error, 1),
 	}
 }
 
@@ -57,7 +69,7 @@ func (c *Collector) Start(
 		map[string]string{
 			"component.name": "collector",
 		})
-	err = c.start()
+	err = c.start(isDebug)
 	if err != nil {
 		c.logger.LogWithFields(
 			logrus.ErrorLevel,
@@ -78,7 +90,9 @@ func (c *Collector) Start(
 	return nil
 }
 
-func (c *Collector) start() error {
+func (c *Collector) start(
+	isDebug bool,
+) error {
 	currentDir, err := os.Getwd()
 	if err != nil {
 		c.logger.LogWithFields(
@@ -92,10 +106,10 @@ func (c *Collector) start() error {
 	}
 
 	// Build the full path to the "app" executable in the current directory
-	appPath := filepath.Join(currentDir, "/bin/otelcol-contrib")
+	appPath := filepath.Join(currentDir, OTEL_COLLECTOR_BINARY_PATH)
 
 	// Create a new Cmd struct for the "app" executable with the argument
-	cmd := exec.Command(appPath, "--config=./bin/otel-config.yaml")
+	cmd := exec.Command(appPath, "--config="+OTEL_COLLECTOR_CONFIG_PATH)
 
 	// Start the process
 	c.logger.LogWithFields(
@@ -124,14 +138,70 @@ func (c *Collector) start() error {
 			"component.name":     "collector",
 			"otelcol.process.id": strconv.FormatInt(int64(pid), 10),
 		})
-	c.sync(true, &pid)
+	exited := make(chan struct{})
+	c.sync(true, isDebug, &pid)
+	c.runnerSynchronizer.mutex.Lock()
+	c.runnerSynchronizer.exited = exited
+	c.runnerSynchronizer.mutex.Unlock()
+	go c.wait(cmd, pid, exited)
 
 	return nil
 }
 
+// Waits for the collector process to exit. If it is still the running
+// collector, it is not stopped on purpose and the crash is reported.
+func (c *Collector) wait(
+	cmd *exec.Cmd,
+	pid int,
+	exited chan struct{},
+) {
+	err := cmd.Wait()
+	close(exited)
+	if err == nil {
+		err = errors.New("collector exited")
+	}
+
+	c.runnerSynchronizer.mutex.Lock()
+	current := c.runnerSynchronizer.pid
+	isCrash := current != nil && *current == pid
+	if isCrash {
+		c.runnerSynchronizer.isRunning = false
+		c.runnerSynchronizer.pid = nil
+	}
+	c.runnerSynchronizer.mutex.Unlock()
+	if !isCrash {
+		return
+	}
+
+	c.logger.LogWithFields(
+		logrus.ErrorLevel,
+		"OTel collector crashed.",
+		map[string]string{
+			"component.name":     "collector",
+			"error.message":      err.Error(),
+			"otelcol.process.id": strconv.FormatInt(int64(pid), 10),
+		})
+
+	// Only the last crash is kept if nobody is listening
+	select {
+	case c.crashes <- err:
+	default:
+	}
+}
+
 func (c *Collector) Stop() error {
 	// Get process ID
-	pid := c.getPid()
+	pidRef := c.getPid()
+	if pidRef == nil {
+		c.logger.LogWithFields(
+			logrus.InfoLevel,
+			"OTel collector is not running.",
+			map[string]string{
+				"component.name": "collector",
+			})
+		return nil
+	}
+	pid := *pidRef
 	c.logger.LogWithFields(
 		logrus.InfoLevel,
 		"Stopping OTel collector...",
@@ -148,7 +218,7 @@ func (c *Collector) Stop() error {
 			"component.name":     "collector",
 			"otelcol.process.id": strconv.FormatInt(int64(pid), 10),
 		})
-	process, err := os.FindProcess(*c.runnerSynchronizer.pid)
+	process, err := os.FindProcess(pid)
 	if err != nil {
 		c.logger.LogWithFields(
 			logrus.ErrorLevel,
@@ -161,6 +231,11 @@ func (c *Collector) Stop() error {
 		return err
 	}
 
+	// Mark the collector as stopped first so that its exit is not taken
+	// for a crash
+	isDebug := c.IsDebug()
+	c.sync(false, isDebug, nil)
+
 	// Send SIGTERM signal to the process
 	c.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -179,6 +254,7 @@ func (c *Collector) Stop() error {
 				"error.message":      err.Error(),
 				"otelcol.process.id": strconv.FormatInt(int64(pid), 10),
 			})
+		c.sync(true, isDebug, &pid)
 		return err
 	}
 	c.logger.LogWithFields(
@@ -189,24 +265,114 @@ func (c *Collector) Stop() error {
 			"otelcol.process.id": strconv.FormatInt(int64(pid), 10),
 		})
 
-	c.sync(false, nil)
-
 	return nil
 }
 
+// Stops the collector and waits for it to exit so that it can flush
+// what it has received. It is killed if it does not exit before the
+// context is done.
+func (c *Collector) Shutdown(
+	ctx context.Context,
+) error {
+	c.runnerSynchronizer.mutex.Lock()
+	pidRef := c.runnerSynchronizer.pid
+	exited := c.runnerSynchronizer.exited
+	c.runnerSynchronizer.mutex.Unlock()
+
+	err := c.Stop()
+	if err != nil || pidRef == nil {
+		return err
+	}
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		c.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"OTel collector did not exit in time, killing...",
+			map[string]string{
+				"component.name":     "collector",
+				"otelcol.process.id": strconv.FormatInt(int64(*pidRef), 10),
+			})
+		process, err := os.FindProcess(*pidRef)
+		if err == nil {
+			process.Kill()
+		}
+		return ctx.Err()
+	}
+}
+
+// Returns the errors of the collector processes which exited without
+// being stopped.
+func (c *Collector) Crashes() <-chan error {
+	return c.crashes
+}
+
+// Returns the version which the OTel collector binary reports.
+func (c *Collector) Version() string {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return "unknown"
+	}
+
+	appPath := filepath.Join(currentDir, OTEL_COLLECTOR_BINARY_PATH)
+	output, err := exec.Command(appPath, "--version").Output()
+	if err != nil {
+		c.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"OTel collector version is not retrieved.",
+			map[string]string{
+				"component.name": "collector",
+				"error.message":  err.Error(),
+			})
+		return "unknown"
+	}
+
+	// The output looks like "otelcol-contrib version 0.92.0"
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return fields[len(fields)-1]
+}
+
+// Returns the config file which the collector is last started with.
+func (c *Collector) Config() (
+	[]byte,
+	error,
+) {
+	return os.ReadFile(OTEL_COLLECTOR_CONFIG_PATH)
+}
+
+// Returns whether the collector process is running.
+func (c *Collector) IsRunning() bool {
+	c.runnerSynchronizer.mutex.Lock()
+	defer c.runnerSynchronizer.mutex.Unlock()
+	return c.runnerSynchronizer.isRunning
+}
+
+// Returns whether the collector is last started in debug mode.
+func (c *Collector) IsDebug() bool {
+	c.runnerSynchronizer.mutex.Lock()
+	defer c.runnerSynchronizer.mutex.Unlock()
+	return c.runnerSynchronizer.isDebug
+}
+
 func (c *Collector) sync(
 	isRunning bool,
+	isDebug bool,
 	pid *int,
 ) {
 	c.runnerSynchronizer.mutex.Lock()
 	defer c.runnerSynchronizer.mutex.Unlock()
 	c.runnerSynchronizer.isRunning = isRunning
+	c.runnerSynchronizer.isDebug = isDebug
 	c.runnerSynchronizer.pid = pid
 }
 
-func (c *Collector) getPid() int {
+func (c *Collector) getPid() *int {
 	c.runnerSynchronizer.mutex.Lock()
 	defer c.runnerSynchronizer.mutex.Unlock()
-	pid := c.runnerSynchronizer.pid
-	return *pid
+	return c.runnerSynchronizer.pid
 }
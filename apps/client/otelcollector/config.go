@@ -435,7 +435,7 @@ func (o *otelCollectorConfigGenerator) generate(
 		})
 
 	// Create the YAML file
-	file, err := os.Create("./bin/otel-config.yaml")
+	file, err := os.Create(OTEL_COLLECTOR_CONFIG_PATH)
 	if err != nil {
 		o.logger.LogWithFields(
 			logrus.InfoLevel,
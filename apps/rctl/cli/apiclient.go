@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const API_REQUEST_TIMEOUT = 30 * time.Second
+
+// Error which the server responded with.
+type apiError struct {
+	statusCode int
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("server responded with %d: %s", e.statusCode, e.message)
+}
+
+// Calls the HTTP API of the server with the token of the context.
+type apiClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func newApiClient(
+	server string,
+	token string,
+) *apiClient {
+	return &apiClient{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		client: &http.Client{Timeout: API_REQUEST_TIMEOUT},
+	}
+}
+
+// Sends the request with the given body, if any, and decodes the
+// response into out, if it is given.
+func (ac *apiClient) do(
+	method string,
+	path string,
+	body interface{},
+	out interface{},
+) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ac.server+path, reader)
+	if err != nil {
+		return err
+	}
+	if ac.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return &apiError{
+			statusCode: resp.StatusCode,
+			message:    strings.TrimSpace(string(data)),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Subscribes to the Server-Sent Events of the given path. Calls
+// subscribed once the server accepted the subscription and handle with
+// the data of each event until the stream ends or handle returns an
+// error.
+func (ac *apiClient) stream(
+	path string,
+	subscribed func() error,
+	handle func(data []byte) error,
+) error {
+	req, err := http.NewRequest(http.MethodGet, ac.server+path, nil)
+	if err != nil {
+		return err
+	}
+	if ac.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.token)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream is open as long as it is followed
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		data, _ := io.ReadAll(resp.Body)
+		return &apiError{
+			statusCode: resp.StatusCode,
+			message:    strings.TrimSpace(string(data)),
+		}
+	}
+	err = subscribed()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		// Comments, event names and blank lines carry nothing to handle
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		err := handle([]byte(data))
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream is closed by the server")
+}
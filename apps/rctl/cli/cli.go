@@ -0,0 +1,226 @@
+// Package cli implements rctl, the command line interface of the
+// operators for the HTTP API of the server.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const USAGE = `rctl controls the telemetry of the clients through the server.
+
+Usage:
+  rctl <command> [arguments] [flags]
+
+Commands:
+  clients list                      List the connected clients
+  clients describe <id>             Show a client together with its history
+  mode set <id>|--all [--ttl 30m] [--profile <name>]
+                                    Switch the collector to debug mode
+  mode clear <id>|--all             Switch the collector back to default mode
+  profiles list|get|create|delete   Manage the presets of the mode changes
+  commands get <id>                 Show the status of a command
+  events [--client <id>] [--type <types>] [-f]
+                                    Show the events of the fleet, -f streams them
+  tokens list|create|delete         Manage the API tokens
+  enrollment-tokens list|create|delete
+                                    Manage the enrollment tokens of the clients
+  config view|get-contexts|use-context|set-context|delete-context
+                                    Manage the context file
+
+Flags of every command:
+  --context <name>   Context of the context file to use
+  --server <url>     URL of the HTTP API, overrides the context
+  --token <token>    Bearer token, overrides the context
+  -o, --output       Output format, either table or json
+`
+
+// Options which every command accepts.
+type globalOptions struct {
+	context string
+	server  string
+	token   string
+	output  string
+}
+
+// Environment of a single run of a command.
+type runner struct {
+	stdout io.Writer
+	stderr io.Writer
+	opts   *globalOptions
+}
+
+type commandFunc func(r *runner, args []string) error
+
+var commands = map[string]commandFunc{
+	"clients":           runClients,
+	"mode":              runMode,
+	"commands":          runCommands,
+	"profiles":          runProfiles,
+	"events":            runEvents,
+	"tokens":            runTokens,
+	"enrollment-tokens": runEnrollmentTokens,
+	"config":            runConfig,
+}
+
+// Runs the command which is given by the arguments and returns the
+// exit code.
+func Run(
+	args []string,
+	stdout io.Writer,
+	stderr io.Writer,
+) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stdout, USAGE)
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q, see rctl help.\n", args[0])
+		return 2
+	}
+
+	r := &runner{
+		stdout: stdout,
+		stderr: stderr,
+		opts: &globalOptions{
+			output: OUTPUT_TABLE,
+		},
+	}
+	err := cmd(r, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error: "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+// Creates the flag set of the command together with the flags which
+// every command accepts.
+func (r *runner) flags(
+	name string,
+) *flag.FlagSet {
+	fs := flag.NewFlagSet("rctl "+name, flag.ContinueOnError)
+	fs.SetOutput(r.stderr)
+	fs.StringVar(&r.opts.context, "context", "", "context of the context file to use")
+	fs.StringVar(&r.opts.server, "server", "", "URL of the HTTP API")
+	fs.StringVar(&r.opts.token, "token", "", "bearer token")
+	fs.StringVar(&r.opts.output, "output", OUTPUT_TABLE, "output format, either table or json")
+	fs.StringVar(&r.opts.output, "o", OUTPUT_TABLE, "output format, either table or json")
+	return fs
+}
+
+// Parses the flags which can be given before, between or after the
+// positional arguments and returns the positional ones.
+func parseFlags(
+	fs *flag.FlagSet,
+	args []string,
+) (
+	[]string,
+	error,
+) {
+	positional := []string{}
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Returns the client of the API. The server and the token are taken
+// from the flags, the RCTL_SERVER and RCTL_TOKEN environment variables
+// and the context, in this order.
+func (r *runner) client() (
+	*apiClient,
+	error,
+) {
+	server := firstOf(r.opts.server, os.Getenv("RCTL_SERVER"))
+	token := firstOf(r.opts.token, os.Getenv("RCTL_TOKEN"))
+
+	if server == "" || token == "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		name := firstOf(r.opts.context, cfg.CurrentContext)
+		if name != "" {
+			ctx, ok := cfg.context(name)
+			if !ok {
+				return nil, errors.New("context " + name + " is not found in " + cfg.path)
+			}
+			server = firstOf(server, ctx.Server)
+			token = firstOf(token, ctx.Token)
+		}
+	}
+	return newApiClient(firstOf(server, DEFAULT_SERVER_URL), token), nil
+}
+
+func (r *runner) printer() (
+	*printer,
+	error,
+) {
+	return newPrinter(r.stdout, r.opts.output)
+}
+
+// Returns the subcommand and its arguments, or an error listing the
+// valid subcommands.
+func subcommand(
+	name string,
+	args []string,
+	valid ...string,
+) (
+	string,
+	[]string,
+	error,
+) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", nil, errors.New(name + " requires one of the subcommands " + strings.Join(valid, ", "))
+	}
+	for _, v := range valid {
+		if args[0] == v {
+			return v, args[1:], nil
+		}
+	}
+	sort.Strings(valid)
+	return "", nil, fmt.Errorf("unknown subcommand %q of %s, valid ones are %s", args[0], name, strings.Join(valid, ", "))
+}
+
+func firstOf(
+	values ...string,
+) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func exactlyOne(
+	name string,
+	positional []string,
+) (
+	string,
+	error,
+) {
+	if len(positional) != 1 {
+		return "", errors.New(name + " should be given as the only argument")
+	}
+	return positional[0], nil
+}
@@ -0,0 +1,304 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type clientMetadata struct {
+	InstanceId       string `json:"instanceId"`
+	Hostname         string `json:"hostname"`
+	Os               string `json:"os"`
+	Arch             string `json:"arch"`
+	ClientVersion    string `json:"clientVersion"`
+	ServiceName      string `json:"serviceName"`
+	CollectorVersion string `json:"collectorVersion"`
+	Group            string `json:"group,omitempty"`
+}
+
+type healthSummary struct {
+	Window       string  `json:"window"`
+	Count        int     `json:"count"`
+	LatencyP50Ms float64 `json:"latencyP50Ms"`
+	LatencyP95Ms float64 `json:"latencyP95Ms"`
+	LatencyP99Ms float64 `json:"latencyP99Ms"`
+}
+
+type clientInfo struct {
+	Id            string          `json:"id"`
+	Transport     string          `json:"transport"`
+	Metadata      *clientMetadata `json:"metadata"`
+	HealthSummary *healthSummary  `json:"healthSummary,omitempty"`
+	Mode          string          `json:"mode"`
+	DesiredMode   string          `json:"desiredMode,omitempty"`
+	ConnectedAt   time.Time       `json:"connectedAt"`
+	LastSeenAt    time.Time       `json:"lastSeenAt"`
+}
+
+type clientRecord struct {
+	Id             string          `json:"id"`
+	Transport      string          `json:"transport"`
+	Metadata       *clientMetadata `json:"metadata"`
+	Mode           string          `json:"mode"`
+	FirstSeenAt    time.Time       `json:"firstSeenAt"`
+	ConnectedAt    time.Time       `json:"connectedAt"`
+	DisconnectedAt *time.Time      `json:"disconnectedAt,omitempty"`
+}
+
+type clientEvent struct {
+	ClientId  string    `json:"clientId"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Transport string    `json:"transport,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	CommandId string    `json:"commandId,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+type clientHistory struct {
+	Client *clientRecord  `json:"client"`
+	Events []*clientEvent `json:"events"`
+}
+
+// Client as it is described: the stored record, the live info if it
+// is connected and the history.
+type clientDescription struct {
+	Client    *clientRecord  `json:"client"`
+	Connected *clientInfo    `json:"connected,omitempty"`
+	Events    []*clientEvent `json:"events"`
+}
+
+func runClients(
+	r *runner,
+	args []string,
+) error {
+	sub, args, err := subcommand("clients", args, "list", "describe")
+	if err != nil {
+		return err
+	}
+
+	fs := r.flags("clients " + sub)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		clients := []*clientInfo{}
+		err := ac.do(http.MethodGet, "/clients", nil, &clients)
+		if err != nil {
+			return err
+		}
+		if p.isJson() {
+			return p.printJson(clients)
+		}
+
+		rows := [][]string{}
+		for _, c := range clients {
+			hostname, service, group := "-", "-", "-"
+			if c.Metadata != nil {
+				hostname = orDash(c.Metadata.Hostname)
+				service = orDash(c.Metadata.ServiceName)
+				group = orDash(c.Metadata.Group)
+			}
+			latency := "-"
+			if c.HealthSummary != nil && c.HealthSummary.Count > 0 {
+				latency = strconv.FormatFloat(c.HealthSummary.LatencyP95Ms, 'f', 0, 64)
+			}
+			rows = append(rows, []string{
+				c.Id, c.Transport, hostname, service, group, c.Mode, orDash(c.DesiredMode), latency, formatAge(c.ConnectedAt),
+			})
+		}
+		return p.printTable(
+			[]string{"ID", "TRANSPORT", "HOSTNAME", "SERVICE", "GROUP", "MODE", "DESIRED", "P95 (MS)", "AGE"},
+			rows,
+		)
+
+	default:
+		id, err := exactlyOne("client ID", positional)
+		if err != nil {
+			return err
+		}
+
+		history := &clientHistory{}
+		err = ac.do(http.MethodGet, "/clients/"+url.PathEscape(id)+"/history", nil, history)
+		if err != nil {
+			return err
+		}
+		description := &clientDescription{
+			Client: history.Client,
+			Events: history.Events,
+		}
+
+		clients := []*clientInfo{}
+		err = ac.do(http.MethodGet, "/clients", nil, &clients)
+		if err != nil {
+			return err
+		}
+		for _, c := range clients {
+			if c.Id == id {
+				description.Connected = c
+			}
+		}
+
+		if p.isJson() {
+			return p.printJson(description)
+		}
+		return printClientDescription(p, description)
+	}
+}
+
+func printClientDescription(
+	p *printer,
+	d *clientDescription,
+) error {
+	c := d.Client
+	fields := [][2]string{
+		{"ID", c.Id},
+		{"Transport", c.Transport},
+	}
+	if c.Metadata != nil {
+		fields = append(fields,
+			[2]string{"Hostname", orDash(c.Metadata.Hostname)},
+			[2]string{"OS/Arch", c.Metadata.Os + "/" + c.Metadata.Arch},
+			[2]string{"Service", orDash(c.Metadata.ServiceName)},
+			[2]string{"Group", orDash(c.Metadata.Group)},
+			[2]string{"Client version", orDash(c.Metadata.ClientVersion)},
+			[2]string{"Collector version", orDash(c.Metadata.CollectorVersion)},
+		)
+	}
+	fields = append(fields,
+		[2]string{"First seen", formatTime(&c.FirstSeenAt)},
+		[2]string{"Connected", formatTime(&c.ConnectedAt)},
+	)
+
+	if d.Connected == nil {
+		fields = append(fields,
+			[2]string{"Status", "disconnected"},
+			[2]string{"Disconnected", formatTime(c.DisconnectedAt)},
+			[2]string{"Mode", c.Mode},
+		)
+	} else {
+		fields = append(fields,
+			[2]string{"Status", "connected"},
+			[2]string{"Mode", d.Connected.Mode},
+			[2]string{"Desired mode", orDash(d.Connected.DesiredMode)},
+		)
+		if s := d.Connected.HealthSummary; s != nil {
+			fields = append(fields, [2]string{"Health", "p50 " + formatMs(s.LatencyP50Ms) + ", p95 " + formatMs(s.LatencyP95Ms) +
+				", p99 " + formatMs(s.LatencyP99Ms) + ", " + strconv.Itoa(s.Count) + " handlings in " + s.Window})
+		}
+	}
+
+	err := p.printFields(fields)
+	if err != nil {
+		return err
+	}
+	p.out.Write([]byte("\nEvents:\n"))
+	return printEvents(p, d.Events)
+}
+
+func printEvents(
+	p *printer,
+	events []*clientEvent,
+) error {
+	rows := [][]string{}
+	for _, e := range events {
+		rows = append(rows, []string{formatTime(&e.Time), e.Type, orDash(e.Mode), orDash(e.CommandId), orDash(e.Status), orDash(e.Reason)})
+	}
+	return p.printTable([]string{"TIME", "TYPE", "MODE", "COMMAND", "STATUS", "REASON"}, rows)
+}
+
+type controlRequest struct {
+	Ttl     string `json:"ttl,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Ticket  string `json:"ticket,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// Switches the collector of a single client or of all the clients.
+func runMode(
+	r *runner,
+	args []string,
+) error {
+	sub, args, err := subcommand("mode", args, "set", "clear")
+	if err != nil {
+		return err
+	}
+
+	fs := r.flags("mode " + sub)
+	all := fs.Bool("all", false, "switch all the connected clients")
+	request := &controlRequest{}
+	fs.StringVar(&request.Reason, "reason", "", "reason of the change for the audit trail")
+	fs.StringVar(&request.Ticket, "ticket", "", "ticket of the change for the audit trail")
+	fs.StringVar(&request.Profile, "profile", "", "profile which fills in the values which are not given")
+	if sub == "set" {
+		fs.StringVar(&request.Ttl, "ttl", "", "duration of the debug mode, e.g. 30m")
+	}
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	path := "/control"
+	if !*all {
+		id, err := exactlyOne("client ID or --all", positional)
+		if err != nil {
+			return err
+		}
+		path = "/clients/" + url.PathEscape(id) + "/control"
+	} else if len(positional) != 0 {
+		return errors.New("client ID should not be given together with --all")
+	}
+	if request.Ttl != "" {
+		if _, err := time.ParseDuration(request.Ttl); err != nil {
+			return errors.New("ttl should be a duration, e.g. 30m")
+		}
+	}
+
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodPost
+	if sub == "clear" {
+		method = http.MethodDelete
+	}
+
+	commands := []*command{}
+	if *all {
+		err = ac.do(method, path, request, &commands)
+	} else {
+		c := &command{}
+		err = ac.do(method, path, request, c)
+		commands = append(commands, c)
+	}
+	if err != nil {
+		return err
+	}
+	return printCommands(p, commands)
+}
+
+func formatMs(
+	value float64,
+) string {
+	return strconv.FormatFloat(value, 'f', 0, 64) + "ms"
+}
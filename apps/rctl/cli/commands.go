@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type command struct {
+	Id        string     `json:"id"`
+	ClientId  string     `json:"clientId"`
+	Type      string     `json:"type"`
+	Mode      string     `json:"mode"`
+	Ttl       string     `json:"ttl,omitempty"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ExpiredAt *time.Time `json:"expiredAt,omitempty"`
+}
+
+func runCommands(
+	r *runner,
+	args []string,
+) error {
+	_, args, err := subcommand("commands", args, "get")
+	if err != nil {
+		return err
+	}
+
+	fs := r.flags("commands get")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := exactlyOne("command ID", positional)
+	if err != nil {
+		return err
+	}
+
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	c := &command{}
+	err = ac.do(http.MethodGet, "/commands/"+url.PathEscape(id), nil, c)
+	if err != nil {
+		return err
+	}
+	if p.isJson() {
+		return p.printJson(c)
+	}
+	return p.printFields([][2]string{
+		{"ID", c.Id},
+		{"Client", c.ClientId},
+		{"Mode", c.Mode},
+		{"TTL", orDash(c.Ttl)},
+		{"Status", c.Status},
+		{"Error", orDash(c.Error)},
+		{"Created", formatTime(&c.CreatedAt)},
+		{"Updated", formatTime(&c.UpdatedAt)},
+		{"Expires", formatTime(c.ExpiresAt)},
+		{"Expired", formatTime(c.ExpiredAt)},
+	})
+}
+
+func printCommands(
+	p *printer,
+	commands []*command,
+) error {
+	if p.isJson() {
+		return p.printJson(commands)
+	}
+
+	rows := [][]string{}
+	for _, c := range commands {
+		rows = append(rows, []string{c.Id, c.ClientId, c.Mode, orDash(c.Ttl), c.Status, orDash(c.Error)})
+	}
+	return p.printTable([]string{"COMMAND", "CLIENT", "MODE", "TTL", "STATUS", "ERROR"}, rows)
+}
@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const DEFAULT_SERVER_URL = "http://localhost:8080"
+
+// Context which the commands are run against, like a kubectl context.
+type serverContext struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	Token  string `json:"token,omitempty"`
+}
+
+// Context file which keeps the servers and the tokens of the operator.
+type config struct {
+	CurrentContext string           `json:"currentContext"`
+	Contexts       []*serverContext `json:"contexts"`
+	path           string
+}
+
+// Returns the path of the context file. It is given with RCTL_CONFIG
+// and defaults to ~/.rctl/config.json.
+func configPath() (
+	string,
+	error,
+) {
+	if path := os.Getenv("RCTL_CONFIG"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".rctl", "config.json"), nil
+}
+
+// Loads the context file. A missing file is an empty config.
+func loadConfig() (
+	*config,
+	error,
+) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		Contexts: []*serverContext{},
+		path:     path,
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, errors.New("context file " + path + " is not valid: " + err.Error())
+	}
+	return cfg, nil
+}
+
+// Writes the context file. It is only readable by the operator since
+// it contains the tokens.
+func (c *config) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(data, '\n'), 0600)
+}
+
+func (c *config) context(
+	name string,
+) (
+	*serverContext,
+	bool,
+) {
+	for _, ctx := range c.Contexts {
+		if ctx.Name == name {
+			return ctx, true
+		}
+	}
+	return nil, false
+}
+
+// Adds the context or updates the given fields of the existing one.
+func (c *config) setContext(
+	name string,
+	server string,
+	token string,
+) *serverContext {
+	ctx, ok := c.context(name)
+	if !ok {
+		ctx = &serverContext{Name: name}
+		c.Contexts = append(c.Contexts, ctx)
+	}
+	if server != "" {
+		ctx.Server = server
+	}
+	if token != "" {
+		ctx.Token = token
+	}
+	if c.CurrentContext == "" {
+		c.CurrentContext = name
+	}
+	return ctx
+}
+
+func (c *config) deleteContext(
+	name string,
+) bool {
+	for i, ctx := range c.Contexts {
+		if ctx.Name != name {
+			continue
+		}
+		c.Contexts = append(c.Contexts[:i], c.Contexts[i+1:]...)
+		if c.CurrentContext == name {
+			c.CurrentContext = ""
+		}
+		return true
+	}
+	return false
+}
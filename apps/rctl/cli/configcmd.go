@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Manages the contexts of the context file.
+func runConfig(
+	r *runner,
+	args []string,
+) error {
+	sub, args, err := subcommand("config", args, "view", "get-contexts", "use-context", "set-context", "delete-context")
+	if err != nil {
+		return err
+	}
+
+	// The --server and --token flags are the fields of set-context
+	fs := r.flags("config " + sub)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	server, token := r.opts.server, r.opts.token
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "view":
+		if p.isJson() {
+			return p.printJson(cfg.redacted())
+		}
+		fmt.Fprintf(p.out, "File: %s\n\n", cfg.path)
+		return printContexts(p, cfg)
+
+	case "get-contexts":
+		if p.isJson() {
+			return p.printJson(cfg.redacted().Contexts)
+		}
+		return printContexts(p, cfg)
+
+	case "use-context":
+		name, err := exactlyOne("context name", positional)
+		if err != nil {
+			return err
+		}
+		if _, ok := cfg.context(name); !ok {
+			return errors.New("context " + name + " is not found")
+		}
+		cfg.CurrentContext = name
+		err = cfg.save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Switched to context %s.\n", name)
+		return nil
+
+	case "set-context":
+		name, err := exactlyOne("context name", positional)
+		if err != nil {
+			return err
+		}
+		if _, ok := cfg.context(name); !ok && server == "" {
+			return errors.New("--server should be given for a new context")
+		}
+		cfg.setContext(name, server, token)
+		err = cfg.save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Context %s is saved to %s.\n", name, cfg.path)
+		return nil
+
+	default:
+		name, err := exactlyOne("context name", positional)
+		if err != nil {
+			return err
+		}
+		if !cfg.deleteContext(name) {
+			return errors.New("context " + name + " is not found")
+		}
+		err = cfg.save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Context %s is deleted.\n", name)
+		return nil
+	}
+}
+
+func printContexts(
+	p *printer,
+	cfg *config,
+) error {
+	rows := [][]string{}
+	for _, ctx := range cfg.Contexts {
+		current := ""
+		if ctx.Name == cfg.CurrentContext {
+			current = "*"
+		}
+		hasToken := "no"
+		if ctx.Token != "" {
+			hasToken = "yes"
+		}
+		rows = append(rows, []string{current, ctx.Name, ctx.Server, hasToken})
+	}
+	return p.printTable([]string{"CURRENT", "NAME", "SERVER", "TOKEN"}, rows)
+}
+
+// Returns a copy of the config without the tokens so that they do not
+// end up on the screen.
+func (c *config) redacted() *config {
+	copied := &config{
+		CurrentContext: c.CurrentContext,
+		Contexts:       []*serverContext{},
+		path:           c.path,
+	}
+	for _, ctx := range c.Contexts {
+		redacted := *ctx
+		if redacted.Token != "" {
+			redacted.Token = "REDACTED"
+		}
+		copied.Contexts = append(copied.Contexts, &redacted)
+	}
+	return copied
+}
@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Columns of the event rows. The widths fit the IDs of the clients and
+// the commands.
+const EVENT_ROW_FORMAT = "%-32s   %-25s   %-17s   %-7s   %-16s   %-10s   %s\n"
+
+// Shows the events of the connected clients or of the given one. The
+// past events are taken from the histories, the new ones are streamed
+// from the server while they are followed.
+func runEvents(
+	r *runner,
+	args []string,
+) error {
+	fs := r.flags("events")
+	clientId := fs.String("client", "", "show only the events of the given client")
+	types := fs.String("type", "", "show only the events of the given comma separated types, e.g. command_status,collector_crashed")
+	since := fs.Duration("since", time.Hour, "show the events which are not older than this")
+	follow := fs.Bool("follow", false, "keep printing the new events")
+	fs.BoolVar(follow, "f", false, "keep printing the new events")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return errors.New("events takes no arguments, use --client to filter")
+	}
+
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	typeSet := map[string]bool{}
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			typeSet[t] = true
+		}
+	}
+
+	// The events of the histories which are printed, so that they are not
+	// printed again if they are streamed as well
+	printed := map[string]bool{}
+	printPast := func() error {
+		events, err := fetchEvents(ac, *clientId)
+		if err != nil {
+			return err
+		}
+
+		from := time.Now().Add(-*since)
+		past := []*clientEvent{}
+		for _, e := range events {
+			if e.Time.After(from) && (len(typeSet) == 0 || typeSet[e.Type]) {
+				past = append(past, e)
+				printed[eventKey(e)] = true
+			}
+		}
+		sort.SliceStable(past, func(i, j int) bool {
+			return past[i].Time.Before(past[j].Time)
+		})
+		return printEventRows(p, past, true)
+	}
+	if !*follow {
+		return printPast()
+	}
+
+	query := url.Values{}
+	if *clientId != "" {
+		query.Set("client", *clientId)
+	}
+	if *types != "" {
+		query.Set("type", *types)
+	}
+	return ac.stream("/events?"+query.Encode(), printPast, func(data []byte) error {
+		e := &clientEvent{}
+		err := json.Unmarshal(data, e)
+		if err != nil {
+			return err
+		}
+		if printed[eventKey(e)] {
+			return nil
+		}
+		return printEventRows(p, []*clientEvent{e}, false)
+	})
+}
+
+// Returns the history of the given client or of all the connected ones.
+func fetchEvents(
+	ac *apiClient,
+	clientId string,
+) (
+	[]*clientEvent,
+	error,
+) {
+	ids := []string{clientId}
+	if clientId == "" {
+		clients := []*clientInfo{}
+		err := ac.do(http.MethodGet, "/clients", nil, &clients)
+		if err != nil {
+			return nil, err
+		}
+		ids = ids[:0]
+		for _, c := range clients {
+			ids = append(ids, c.Id)
+		}
+	}
+
+	events := []*clientEvent{}
+	for _, id := range ids {
+		history := &clientHistory{}
+		err := ac.do(http.MethodGet, "/clients/"+url.PathEscape(id)+"/history", nil, history)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound && clientId == "" {
+			// The client disconnected in the meantime and left no record
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, history.Events...)
+	}
+	return events, nil
+}
+
+func eventKey(
+	e *clientEvent,
+) string {
+	return e.ClientId + "/" + e.Type + "/" + e.Time.Format(time.RFC3339Nano) + "/" + e.CommandId + "/" + e.Status
+}
+
+// Prints the events as rows of fixed width, so that the streamed ones
+// line up with the header, or as JSON lines so that they can be piped.
+func printEventRows(
+	p *printer,
+	events []*clientEvent,
+	withHeader bool,
+) error {
+	if p.isJson() {
+		for _, e := range events {
+			err := p.printJsonLine(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if withHeader {
+		fmt.Fprintf(p.out, EVENT_ROW_FORMAT, "CLIENT", "TIME", "TYPE", "MODE", "COMMAND", "STATUS", "REASON")
+	}
+	for _, e := range events {
+		_, err := fmt.Fprintf(p.out, EVENT_ROW_FORMAT, e.ClientId, formatTime(&e.Time), e.Type, orDash(e.Mode), orDash(e.CommandId), orDash(e.Status), orDash(e.Reason))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
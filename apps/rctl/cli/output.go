@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+)
+
+// Prints the results either as a table or as JSON.
+type printer struct {
+	out    io.Writer
+	format string
+}
+
+func newPrinter(
+	out io.Writer,
+	format string,
+) (
+	*printer,
+	error,
+) {
+	if format != OUTPUT_TABLE && format != OUTPUT_JSON {
+		return nil, errors.New("output should be either table or json")
+	}
+	return &printer{
+		out:    out,
+		format: format,
+	}, nil
+}
+
+func (p *printer) isJson() bool {
+	return p.format == OUTPUT_JSON
+}
+
+func (p *printer) printJson(
+	value interface{},
+) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(p.out, string(data))
+	return err
+}
+
+// Prints the value as a single line of JSON, used for the streams.
+func (p *printer) printJsonLine(
+	value interface{},
+) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(p.out, string(data))
+	return err
+}
+
+// Prints the rows as a table with the given header.
+func (p *printer) printTable(
+	header []string,
+	rows [][]string,
+) error {
+	w := tabwriter.NewWriter(p.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// Prints the fields as aligned key value lines.
+func (p *printer) printFields(
+	fields [][2]string,
+) error {
+	w := tabwriter.NewWriter(p.out, 0, 0, 1, ' ', 0)
+	for _, f := range fields {
+		fmt.Fprintln(w, f[0]+":\t"+f[1])
+	}
+	return w.Flush()
+}
+
+// Formats the time as the age relative to now, e.g. 5m or 2h.
+func formatAge(
+	t time.Time,
+) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func formatTime(
+	t *time.Time,
+) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func orDash(
+	value string,
+) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Preset of the control requests which is stored on the server.
+type profile struct {
+	Name      string    `json:"name"`
+	Ttl       string    `json:"ttl,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Ticket    string    `json:"ticket,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Manages the profiles which the mode changes can be based on.
+func runProfiles(
+	r *runner,
+	args []string,
+) error {
+	sub, args, err := subcommand("profiles", args, "list", "get", "create", "delete")
+	if err != nil {
+		return err
+	}
+
+	fs := r.flags("profiles " + sub)
+	request := &profile{}
+	if sub == "create" {
+		fs.StringVar(&request.Ttl, "ttl", "", "duration of the debug mode, e.g. 30m")
+		fs.StringVar(&request.Reason, "reason", "", "reason of the change for the audit trail")
+		fs.StringVar(&request.Ticket, "ticket", "", "ticket of the change for the audit trail")
+	}
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if request.Ttl != "" {
+		if _, err := time.ParseDuration(request.Ttl); err != nil {
+			return errors.New("ttl should be a duration, e.g. 30m")
+		}
+	}
+
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	if sub == "list" {
+		profiles := []*profile{}
+		err := ac.do(http.MethodGet, "/profiles", nil, &profiles)
+		if err != nil {
+			return err
+		}
+		return printProfiles(p, profiles)
+	}
+
+	name, err := exactlyOne("profile name", positional)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "get":
+		pr := &profile{}
+		err := ac.do(http.MethodGet, "/profiles/"+url.PathEscape(name), nil, pr)
+		if err != nil {
+			return err
+		}
+		return printProfiles(p, []*profile{pr})
+
+	case "create":
+		request.Name = name
+		pr := &profile{}
+		err := ac.do(http.MethodPost, "/profiles", request, pr)
+		if err != nil {
+			return err
+		}
+		return printProfiles(p, []*profile{pr})
+
+	default:
+		err := ac.do(http.MethodDelete, "/profiles/"+url.PathEscape(name), nil, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Profile %s is deleted.\n", name)
+		return nil
+	}
+}
+
+func printProfiles(
+	p *printer,
+	profiles []*profile,
+) error {
+	if p.isJson() {
+		return p.printJson(profiles)
+	}
+
+	rows := [][]string{}
+	for _, pr := range profiles {
+		rows = append(rows, []string{pr.Name, orDash(pr.Ttl), orDash(pr.Reason), orDash(pr.Ticket), formatTime(&pr.CreatedAt)})
+	}
+	return p.printTable([]string{"NAME", "TTL", "REASON", "TICKET", "CREATED"}, rows)
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type token struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Only returned once when the token is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type tokenRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role,omitempty"`
+	Ttl  string `json:"ttl,omitempty"`
+}
+
+// Manages the bearer tokens of the HTTP API.
+func runTokens(
+	r *runner,
+	args []string,
+) error {
+	return manageTokens(r, "tokens", "/tokens", true, args)
+}
+
+// Manages the tokens which the clients enroll with.
+func runEnrollmentTokens(
+	r *runner,
+	args []string,
+) error {
+	return manageTokens(r, "enrollment-tokens", "/enrollment-tokens", false, args)
+}
+
+func manageTokens(
+	r *runner,
+	name string,
+	path string,
+	hasRole bool,
+	args []string,
+) error {
+	sub, args, err := subcommand(name, args, "list", "create", "delete")
+	if err != nil {
+		return err
+	}
+
+	fs := r.flags(name + " " + sub)
+	request := &tokenRequest{}
+	if sub == "create" {
+		fs.StringVar(&request.Name, "name", "", "name of the token")
+		fs.StringVar(&request.Ttl, "ttl", "", "validity of the token, e.g. 720h, unlimited if not given")
+		if hasRole {
+			fs.StringVar(&request.Role, "role", "", "role of the token, either viewer, operator or admin")
+		}
+	}
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ac, err := r.client()
+	if err != nil {
+		return err
+	}
+	p, err := r.printer()
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		tokens := []*token{}
+		err := ac.do(http.MethodGet, path, nil, &tokens)
+		if err != nil {
+			return err
+		}
+		return printTokens(p, tokens, hasRole)
+
+	case "create":
+		if request.Name == "" {
+			return errors.New("--name should be given")
+		}
+		t := &token{}
+		err := ac.do(http.MethodPost, path, request, t)
+		if err != nil {
+			return err
+		}
+		if p.isJson() {
+			return p.printJson(t)
+		}
+		err = printTokens(p, []*token{t}, hasRole)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "\nSecret (it is shown only once): %s\n", t.Secret)
+		return nil
+
+	default:
+		id, err := exactlyOne("token ID", positional)
+		if err != nil {
+			return err
+		}
+		err = ac.do(http.MethodDelete, path+"/"+url.PathEscape(id), nil, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Token %s is deleted.\n", id)
+		return nil
+	}
+}
+
+func printTokens(
+	p *printer,
+	tokens []*token,
+	hasRole bool,
+) error {
+	if p.isJson() {
+		return p.printJson(tokens)
+	}
+
+	header := []string{"ID", "NAME", "CREATED", "EXPIRES"}
+	if hasRole {
+		header = []string{"ID", "NAME", "ROLE", "CREATED", "EXPIRES"}
+	}
+	rows := [][]string{}
+	for _, t := range tokens {
+		row := []string{t.Id, t.Name, formatTime(&t.CreatedAt), formatTime(t.ExpiresAt)}
+		if hasRole {
+			row = []string{t.Id, t.Name, t.Role, formatTime(&t.CreatedAt), formatTime(t.ExpiresAt)}
+		}
+		rows = append(rows, row)
+	}
+	return p.printTable(header, rows)
+}
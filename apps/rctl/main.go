@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/utr1903/remotely-controlled-telemetry/apps/rctl/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Default duration of the debug mode which an alert triggers.
+const ALERT_DEBUG_TTL = 30 * time.Minute
+
+const (
+	ALERT_STATUS_FIRING   = "firing"
+	ALERT_STATUS_RESOLVED = "resolved"
+)
+
+// Labels which the targeted clients of an alert are matched by. Label
+// names of Prometheus cannot contain dots, hence the underscore forms.
+var (
+	alertClientIdLabels    = []string{"client.id", "client_id"}
+	alertServiceNameLabels = []string{"service.name", "service_name"}
+	alertGroupLabels       = []string{"client.group", "client_group"}
+)
+
+// Alert which is received from a monitoring system. Alerts without a
+// status are considered to be firing.
+type alert struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status,omitempty"`
+	Labels map[string]string `json:"labels"`
+	Ttl    string            `json:"ttl,omitempty"`
+}
+
+// Outcome of an alert: the commands which are sent and the clients
+// which are already in debug mode for longer than the alert requires.
+type alertEscalation struct {
+	Alert            string     `json:"alert"`
+	Ttl              string     `json:"ttl"`
+	Commands         []*command `json:"commands"`
+	SkippedClientIds []string   `json:"skippedClientIds,omitempty"`
+}
+
+// Switches the clients which an alert points at to debug mode for a
+// limited time so that the data is there when the SREs start looking.
+type alertEscalator struct {
+	logger     *logger.Logger
+	registry   *clientRegistry
+	dispatcher *commandDispatcher
+	ttl        time.Duration
+}
+
+func newAlertEscalator(
+	logger *logger.Logger,
+	registry *clientRegistry,
+	dispatcher *commandDispatcher,
+	ttl time.Duration,
+) *alertEscalator {
+	if ttl <= 0 {
+		ttl = ALERT_DEBUG_TTL
+	}
+	return &alertEscalator{
+		logger:     logger,
+		registry:   registry,
+		dispatcher: dispatcher,
+		ttl:        ttl,
+	}
+}
+
+// Switches the connected clients which match the labels of the firing
+// alert to debug mode. Resolved alerts are ignored, the TTL takes care
+// of the revert. Clients which are in debug mode for longer already are
+// skipped so that an alert never shortens a session of an SRE. The
+// clients which are already escalated by another alert of the same
+// notification are given in handled and skipped as well.
+func (ae *alertEscalator) escalate(
+	a *alert,
+	handled map[string]bool,
+) (
+	*alertEscalation,
+	error,
+) {
+	ttl, err := a.validate(ae.ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	escalation := &alertEscalation{
+		Alert:    a.Name,
+		Ttl:      ttl.String(),
+		Commands: []*command{},
+	}
+	if a.Status == ALERT_STATUS_RESOLVED {
+		return escalation, nil
+	}
+
+	now := time.Now()
+	for _, client := range ae.registry.list() {
+		if !a.targets(client) || handled[client.Id] {
+			continue
+		}
+		handled[client.Id] = true
+
+		if ds, ok := ae.dispatcher.getDesiredState(client.Id); ok && ds.Mode == protocol.ModeDebug &&
+			(ds.ExpiresAt == nil || ds.ExpiresAt.After(now.Add(ttl))) {
+			escalation.SkippedClientIds = append(escalation.SkippedClientIds, client.Id)
+			continue
+		}
+
+		c, err := ae.dispatcher.setMode(client.Id, protocol.ModeDebug, ttl, "triggered by alert "+a.Name)
+		if err != nil {
+			ae.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Alert could not be escalated to the client.",
+				map[string]string{
+					"component.name": "alerter",
+					"alert.name":     a.Name,
+					"client.id":      client.Id,
+					"error.message":  err.Error(),
+				})
+		}
+		if c != nil {
+			escalation.Commands = append(escalation.Commands, c)
+		}
+	}
+
+	ae.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Alert is escalated to the matching clients.",
+		map[string]string{
+			"component.name":   "alerter",
+			"alert.name":       a.Name,
+			"otelcol.mode.ttl": ttl.String(),
+		})
+	return escalation, nil
+}
+
+// Validates the alert and returns the TTL of the debug mode which it
+// triggers.
+func (a *alert) validate(
+	defaultTtl time.Duration,
+) (
+	time.Duration,
+	error,
+) {
+	if a.Name == "" {
+		return 0, errors.New("name should be given")
+	}
+	if a.Status != "" && a.Status != ALERT_STATUS_FIRING && a.Status != ALERT_STATUS_RESOLVED {
+		return 0, errors.New("status should be either firing or resolved")
+	}
+	if len(a.Labels) == 0 {
+		return 0, errors.New("labels should be given")
+	}
+	if a.Ttl == "" {
+		return defaultTtl, nil
+	}
+
+	ttl, err := time.ParseDuration(a.Ttl)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("ttl should be a positive duration")
+	}
+	return ttl, nil
+}
+
+func (a *alert) targets(
+	client *clientInfo,
+) bool {
+	if matchesLabel(a.Labels, alertClientIdLabels, client.Id) {
+		return true
+	}
+	if client.Metadata == nil {
+		return false
+	}
+	return matchesLabel(a.Labels, alertServiceNameLabels, client.Metadata.ServiceName) ||
+		matchesLabel(a.Labels, alertGroupLabels, client.Metadata.Group)
+}
+
+func matchesLabel(
+	labels map[string]string,
+	names []string,
+	value string,
+) bool {
+	if value == "" {
+		return false
+	}
+	for _, name := range names {
+		if labels[name] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Webhook payload of Alertmanager. Only the fields which are used are
+// decoded.
+type alertmanagerPayload struct {
+	Alerts []*alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status string            `json:"status"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Receives a single alert in the generic format, e.g.
+// {"name":"HighLatency","labels":{"service.name":"checkout"},"ttl":"15m"}.
+func (hs *HttpServer) handleAlerts(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodPost {
+		hs.rejectAlertMethod(w, r)
+		return
+	}
+
+	requestBody := &alert{}
+	err := json.NewDecoder(r.Body).Decode(requestBody)
+	if err != nil {
+		hs.rejectAlertBody(w, err)
+		return
+	}
+	hs.escalateAlerts(w, r, []*alert{requestBody})
+}
+
+// Receives the notifications of Alertmanager. The name of an alert is
+// its alertname label. The TTL of the debug mode can be given with the
+// ttl query parameter of the webhook URL.
+func (hs *HttpServer) handleAlertmanagerAlerts(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodPost {
+		hs.rejectAlertMethod(w, r)
+		return
+	}
+
+	requestBody := &alertmanagerPayload{}
+	err := json.NewDecoder(r.Body).Decode(requestBody)
+	if err != nil {
+		hs.rejectAlertBody(w, err)
+		return
+	}
+
+	alerts := make([]*alert, 0, len(requestBody.Alerts))
+	for _, a := range requestBody.Alerts {
+		alerts = append(alerts, &alert{
+			Name:   a.Labels["alertname"],
+			Status: a.Status,
+			Labels: a.Labels,
+			Ttl:    r.URL.Query().Get("ttl"),
+		})
+	}
+	hs.escalateAlerts(w, r, alerts)
+}
+
+func (hs *HttpServer) escalateAlerts(
+	w http.ResponseWriter,
+	r *http.Request,
+	alerts []*alert,
+) {
+	entry := auditEntryOf(r)
+	entry.Mode = protocol.ModeDebug
+
+	// Nothing is sent unless all of the alerts are valid
+	for _, a := range alerts {
+		_, err := a.validate(hs.escalator.ttl)
+		if err != nil {
+			msg := "Alert is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"alert.name":     a.Name,
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+	}
+
+	names := []string{}
+	escalations := []*alertEscalation{}
+	handled := map[string]bool{}
+	for _, a := range alerts {
+		escalation, err := hs.escalator.escalate(a, handled)
+		if err != nil {
+			continue
+		}
+
+		names = append(names, a.Name)
+		entry.Ttl = escalation.Ttl
+		for _, c := range escalation.Commands {
+			entry.Targets = append(entry.Targets, c.ClientId)
+			entry.CommandIds = append(entry.CommandIds, c.Id)
+		}
+		escalations = append(escalations, escalation)
+	}
+	entry.Reason = "triggered by alert " + strings.Join(names, ", ")
+
+	hs.writeJson(w, http.StatusAccepted, escalations)
+}
+
+func (hs *HttpServer) rejectAlertMethod(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	msg := "HTTP request method is not allowed."
+	hs.logger.LogWithFields(
+		logrus.ErrorLevel,
+		msg,
+		map[string]string{
+			"component.name":      "httpserver",
+			"http.request.method": r.Method,
+		})
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Write([]byte(msg))
+}
+
+func (hs *HttpServer) rejectAlertBody(
+	w http.ResponseWriter,
+	err error,
+) {
+	msg := "HTTP request body parsing failed."
+	hs.logger.LogWithFields(
+		logrus.ErrorLevel,
+		msg,
+		map[string]string{
+			"component.name": "httpserver",
+			"error.message":  err.Error(),
+		})
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
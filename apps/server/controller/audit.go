@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Results of the audited requests, derived from the response status.
+const (
+	AUDIT_RESULT_SUCCEEDED = "succeeded"
+	AUDIT_RESULT_REJECTED  = "rejected"
+	AUDIT_RESULT_FAILED    = "failed"
+)
+
+// Entry of the audit trail which is written for every request that
+// changes the state of the clients.
+type auditEntry struct {
+	Id       string `json:"id"`
+	Actor    string `json:"actor"`
+	SourceIp string `json:"sourceIp"`
+	// Trusted proxy which forwarded the request, if the source IP is
+	// taken from X-Forwarded-For
+	PeerIp  string   `json:"peerIp,omitempty"`
+	Method  string   `json:"method"`
+	Path    string   `json:"path"`
+	Action  string   `json:"action"`
+	Targets []string `json:"targets,omitempty"`
+	// Targets which the change could not be sent to
+	FailedTargets []string      `json:"failedTargets,omitempty"`
+	Mode          protocol.Mode `json:"mode,omitempty"`
+	Ttl           string        `json:"ttl,omitempty"`
+	ScheduleId    string        `json:"scheduleId,omitempty"`
+	RuleId        string        `json:"ruleId,omitempty"`
+	Profile       string        `json:"profile,omitempty"`
+	Reason        string        `json:"reason,omitempty"`
+	Ticket        string        `json:"ticket,omitempty"`
+	CommandIds    []string      `json:"commandIds,omitempty"`
+	Result        string        `json:"result"`
+	StatusCode    int           `json:"statusCode"`
+	RequestedAt   time.Time     `json:"requestedAt"`
+	CompletedAt   time.Time     `json:"completedAt"`
+}
+
+type auditContextKey struct{}
+
+// Records the status code which the handler responds with.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(
+	statusCode int,
+) {
+	sr.statusCode = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Lets the response controller reach the flusher of the wrapped writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Wraps the handler so that every request which is not a read is
+// written to the audit trail once it is handled. The handler fills in
+// the details of the change through the entry in the request context.
+// The actor is set once the caller is authenticated.
+func (hs *HttpServer) audited(
+	action string,
+	handler http.HandlerFunc,
+) http.HandlerFunc {
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		if r.Method == http.MethodGet {
+			handler(w, r)
+			return
+		}
+
+		sourceIp, peerIp := hs.sourceIpOf(r)
+		entry := &auditEntry{
+			Id:          generateId(),
+			SourceIp:    sourceIp,
+			PeerIp:      peerIp,
+			Actor:       "anonymous",
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Action:      action,
+			RequestedAt: time.Now().UTC(),
+		}
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)))
+
+		entry.StatusCode = recorder.statusCode
+		entry.CompletedAt = time.Now().UTC()
+		switch {
+		case entry.StatusCode >= http.StatusInternalServerError:
+			entry.Result = AUDIT_RESULT_FAILED
+		case entry.StatusCode >= http.StatusBadRequest:
+			entry.Result = AUDIT_RESULT_REJECTED
+		default:
+			entry.Result = AUDIT_RESULT_SUCCEEDED
+		}
+
+		err := hs.store.appendAudit(entry)
+		if err != nil {
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Audit entry could not be stored.",
+				map[string]string{
+					"component.name": "httpserver",
+					"audit.id":       entry.Id,
+					"error.message":  err.Error(),
+				})
+		}
+	}
+}
+
+// Returns the audit entry of the request. Requests which are not
+// audited get a throwaway entry so that the handlers need no checks.
+func auditEntryOf(
+	r *http.Request,
+) *auditEntry {
+	if entry, ok := r.Context().Value(auditContextKey{}).(*auditEntry); ok {
+		return entry
+	}
+	return &auditEntry{}
+}
+
+// Returns the IP of the caller and the IP of the peer which the request
+// is received from. X-Forwarded-For is only read if the peer is a
+// trusted proxy. The caller is then the last address in it which is not
+// a trusted proxy itself, since the ones before could be forged. The
+// peer IP is empty unless the caller is taken from the header.
+func (hs *HttpServer) sourceIpOf(
+	r *http.Request,
+) (
+	string,
+	string,
+) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 || !isTrustedProxy(hs.trustedProxies, peer) {
+		return peer, ""
+	}
+
+	addresses := strings.Split(strings.Join(forwarded, ","), ",")
+	source := ""
+	for i := len(addresses) - 1; i >= 0; i-- {
+		source = strings.TrimSpace(addresses[i])
+		if !isTrustedProxy(hs.trustedProxies, source) {
+			break
+		}
+	}
+	if net.ParseIP(source) == nil {
+		return peer, ""
+	}
+	return source, peer
+}
+
+// Parses the addresses of the trusted proxies, each either an IP or a
+// CIDR range.
+func parseTrustedProxies(
+	values []string,
+) (
+	[]*net.IPNet,
+	error,
+) {
+	proxies := []*net.IPNet{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.New("trusted proxy is not a valid IP: " + value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(
+	proxies []*net.IPNet,
+	address string,
+) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the audit trail, filtered by the query parameters actor,
+// clientId, action, result, since and until (RFC 3339).
+func (hs *HttpServer) handleAudit(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	entries, ok := hs.queryAudit(w, r)
+	if !ok {
+		return
+	}
+	hs.writeJson(w, http.StatusOK, entries)
+}
+
+// Exports the audit trail as JSON lines with the same filters.
+func (hs *HttpServer) handleAuditExport(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	entries, ok := hs.queryAudit(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=audit.jsonl")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+}
+
+func (hs *HttpServer) queryAudit(
+	w http.ResponseWriter,
+	r *http.Request,
+) (
+	[]*auditEntry,
+	bool,
+) {
+	if r.Method != http.MethodGet {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return nil, false
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	for param, value := range map[string]*time.Time{"since": &since, "until": &until} {
+		if query.Get(param) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			msg := "Query parameter " + param + " is not a valid RFC 3339 time!"
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return nil, false
+		}
+		*value = t
+	}
+
+	all, err := hs.store.listAudit()
+	if err != nil {
+		msg := "Audit trail could not be loaded."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"error.message":  err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return nil, false
+	}
+
+	entries := []*auditEntry{}
+	for _, entry := range all {
+		if !since.IsZero() && entry.RequestedAt.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !entry.RequestedAt.Before(until) {
+			continue
+		}
+		if actor := query.Get("actor"); actor != "" && entry.Actor != actor {
+			continue
+		}
+		if action := query.Get("action"); action != "" && entry.Action != action {
+			continue
+		}
+		if result := query.Get("result"); result != "" && entry.Result != result {
+			continue
+		}
+		if clientId := query.Get("clientId"); clientId != "" && !slices.Contains(entry.Targets, clientId) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit >= 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, true
+}
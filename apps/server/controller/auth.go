@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+)
+
+type role string
+
+// Roles of the tokens. Each role includes the permissions of the ones
+// before it.
+const (
+	ROLE_VIEWER   role = "viewer"
+	ROLE_OPERATOR role = "operator"
+	ROLE_ADMIN    role = "admin"
+)
+
+const TOKEN_PREFIX = "rct_"
+
+// File which the generated bootstrap admin token is written to. The
+// secret itself is never logged.
+const BOOTSTRAP_ADMIN_TOKEN_FILE = "./bootstrap-admin-token"
+
+var errRoleIsUnknown = errors.New("role should be one of viewer, operator and admin")
+
+// Token which authenticates the callers of the HTTP API. Only the hash
+// of the secret is stored.
+type token struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      role       `json:"role"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Issues and verifies the bearer tokens. The bootstrap admin token is
+// given by the operator of the server and is never stored.
+type authenticator struct {
+	logger        *logger.Logger
+	store         store
+	bootstrapHash string
+}
+
+func newAuthenticator(
+	logger *logger.Logger,
+	store store,
+	adminToken string,
+) (
+	*authenticator,
+	error,
+) {
+	if adminToken == "" {
+		adminToken = generateSecret(TOKEN_PREFIX)
+		err := writeSecretFile(BOOTSTRAP_ADMIN_TOKEN_FILE, adminToken)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap admin token could not be written to %s: %w", BOOTSTRAP_ADMIN_TOKEN_FILE, err)
+		}
+		logger.LogWithFields(
+			logrus.InfoLevel,
+			"No admin token is given, a bootstrap admin token is generated and written to "+BOOTSTRAP_ADMIN_TOKEN_FILE,
+			map[string]string{
+				"component.name": "authenticator",
+			})
+	}
+
+	return &authenticator{
+		logger:        logger,
+		store:         store,
+		bootstrapHash: hashSecret(adminToken),
+	}, nil
+}
+
+// Returns the token of the secret if it is valid and not expired.
+func (a *authenticator) authenticate(
+	secret string,
+) (
+	*token,
+	bool,
+) {
+	hash := hashSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(a.bootstrapHash)) == 1 {
+		return &token{
+			Id:   "bootstrap",
+			Name: "bootstrap-admin",
+			Role: ROLE_ADMIN,
+		}, true
+	}
+
+	t, ok, err := a.store.getToken(hash)
+	if err != nil {
+		a.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Token could not be loaded.",
+			map[string]string{
+				"component.name": "authenticator",
+				"error.message":  err.Error(),
+			})
+		return nil, false
+	}
+	if !ok || (t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)) {
+		return nil, false
+	}
+	return t, true
+}
+
+// Creates a token and returns it together with its secret. The secret
+// cannot be retrieved afterwards.
+func (a *authenticator) create(
+	name string,
+	r role,
+	ttl time.Duration,
+) (
+	*token,
+	string,
+	error,
+) {
+	if name == "" {
+		return nil, "", errors.New("name should be given")
+	}
+	if r.rank() == 0 {
+		return nil, "", errRoleIsUnknown
+	}
+	if ttl < 0 {
+		return nil, "", errors.New("ttl should not be negative")
+	}
+
+	secret := generateSecret(TOKEN_PREFIX)
+	t := &token{
+		Id:        generateId(),
+		Name:      name,
+		Role:      r,
+		Hash:      hashSecret(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expiresAt := t.CreatedAt.Add(ttl)
+		t.ExpiresAt = &expiresAt
+	}
+
+	err := a.store.saveToken(t)
+	if err != nil {
+		return nil, "", err
+	}
+	return t.redacted(), secret, nil
+}
+
+func (a *authenticator) list() (
+	[]*token,
+	error,
+) {
+	tokens, err := a.store.listTokens()
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		tokens[i] = t.redacted()
+	}
+	return tokens, nil
+}
+
+func (a *authenticator) delete(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return a.store.deleteToken(id)
+}
+
+// Wraps the handler so that it is only served to the callers with a
+// valid bearer token. Reads require the given read role, everything
+// else the write role. The name of the token is the actor of the audit
+// trail.
+func (hs *HttpServer) authorized(
+	readRole role,
+	writeRole role,
+	handler http.HandlerFunc,
+) http.HandlerFunc {
+	return func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var t *token
+		if ok {
+			t, ok = hs.authenticator.authenticate(strings.TrimSpace(secret))
+		}
+		if !ok {
+			msg := "Authentication is required!"
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name":      "httpserver",
+					"http.request.method": r.Method,
+					"http.request.path":   r.URL.Path,
+				})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="remotely-controlled-telemetry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(msg))
+			return
+		}
+		auditEntryOf(r).Actor = t.Name
+
+		required := writeRole
+		if r.Method == http.MethodGet {
+			required = readRole
+		}
+		if t.Role.rank() < required.rank() {
+			msg := "Role " + string(t.Role) + " is not allowed to access this resource!"
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name":      "httpserver",
+					"http.request.method": r.Method,
+					"http.request.path":   r.URL.Path,
+					"token.id":            t.Id,
+				})
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(msg))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (r role) rank() int {
+	switch r {
+	case ROLE_VIEWER:
+		return 1
+	case ROLE_OPERATOR:
+		return 2
+	case ROLE_ADMIN:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func (t *token) redacted() *token {
+	copied := *t
+	copied.Hash = ""
+	return &copied
+}
+
+// Generates a random secret. The prefix tells the kinds of secrets
+// apart.
+func generateSecret(
+	prefix string,
+) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+// Writes the secret to the file which only the owner can read. A
+// previous file is replaced so that its permissions do not carry over.
+func writeSecretFile(
+	path string,
+	secret string,
+) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(path, []byte(secret+"\n"), 0600)
+}
+
+func hashSecret(
+	secret string,
+) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+)
+
+func TestAuthorized(t *testing.T) {
+	log := logger.New()
+	st := newMemoryStore()
+	auth, err := newAuthenticator(log, st, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &HttpServer{
+		logger:        log,
+		authenticator: auth,
+	}
+
+	secrets := map[role]string{}
+	for _, r := range []role{ROLE_VIEWER, ROLE_OPERATOR, ROLE_ADMIN} {
+		_, secret, err := hs.authenticator.create(string(r), r, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[r] = secret
+	}
+
+	expiredSecret := generateSecret(TOKEN_PREFIX)
+	expiresAt := time.Now().Add(-time.Minute)
+	err = st.saveToken(&token{
+		Id:        generateId(),
+		Name:      "expired",
+		Role:      ROLE_ADMIN,
+		Hash:      hashSecret(expiredSecret),
+		CreatedAt: expiresAt.Add(-time.Hour),
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		readRole      role
+		writeRole     role
+		method        string
+		authorization string
+		expected      int
+	}{
+		{name: "missing token", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodGet, authorization: "", expected: http.StatusUnauthorized},
+		{name: "not a bearer token", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodGet, authorization: "Basic " + secrets[ROLE_ADMIN], expected: http.StatusUnauthorized},
+		{name: "unknown token", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodGet, authorization: "Bearer rct_unknown", expected: http.StatusUnauthorized},
+		{name: "expired token", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodGet, authorization: "Bearer " + expiredSecret, expected: http.StatusUnauthorized},
+		{name: "viewer reads", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodGet, authorization: "Bearer " + secrets[ROLE_VIEWER], expected: http.StatusOK},
+		{name: "viewer writes", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodPost, authorization: "Bearer " + secrets[ROLE_VIEWER], expected: http.StatusForbidden},
+		{name: "viewer deletes", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodDelete, authorization: "Bearer " + secrets[ROLE_VIEWER], expected: http.StatusForbidden},
+		{name: "operator writes", readRole: ROLE_VIEWER, writeRole: ROLE_OPERATOR, method: http.MethodPost, authorization: "Bearer " + secrets[ROLE_OPERATOR], expected: http.StatusOK},
+		{name: "operator reads admin resource", readRole: ROLE_ADMIN, writeRole: ROLE_ADMIN, method: http.MethodGet, authorization: "Bearer " + secrets[ROLE_OPERATOR], expected: http.StatusForbidden},
+		{name: "admin writes admin resource", readRole: ROLE_ADMIN, writeRole: ROLE_ADMIN, method: http.MethodPost, authorization: "Bearer " + secrets[ROLE_ADMIN], expected: http.StatusOK},
+		{name: "bootstrap admin writes admin resource", readRole: ROLE_ADMIN, writeRole: ROLE_ADMIN, method: http.MethodPost, authorization: "Bearer admin", expected: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := hs.authorized(test.readRole, test.writeRole, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest(test.method, "/resource", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, w.Code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,634 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	BOLT_BUCKET_CLIENTS        = []byte("clients")
+	BOLT_BUCKET_DESIRED_STATES = []byte("desiredStates")
+	BOLT_BUCKET_COMMANDS       = []byte("commands")
+	BOLT_BUCKET_EVENTS         = []byte("events")
+	BOLT_BUCKET_AUDIT          = []byte("audit")
+	BOLT_BUCKET_TOKENS         = []byte("tokens")
+	BOLT_BUCKET_ENROLLMENTS    = []byte("enrollmentTokens")
+	BOLT_BUCKET_CREDENTIALS    = []byte("credentials")
+	BOLT_BUCKET_SCHEDULES      = []byte("schedules")
+	BOLT_BUCKET_RULES          = []byte("rules")
+	BOLT_BUCKET_PROFILES       = []byte("profiles")
+)
+
+// Store which is backed by an embedded bbolt file. The records are kept
+// as JSON. The events are keyed by client ID and a sequence so that the
+// history of a client can be read with a prefix scan in order.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(
+	path string,
+) (
+	*boltStore,
+	error,
+) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{
+			BOLT_BUCKET_CLIENTS,
+			BOLT_BUCKET_DESIRED_STATES,
+			BOLT_BUCKET_COMMANDS,
+			BOLT_BUCKET_EVENTS,
+			BOLT_BUCKET_AUDIT,
+			BOLT_BUCKET_TOKENS,
+			BOLT_BUCKET_ENROLLMENTS,
+			BOLT_BUCKET_CREDENTIALS,
+			BOLT_BUCKET_SCHEDULES,
+			BOLT_BUCKET_RULES,
+			BOLT_BUCKET_PROFILES,
+		} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (bs *boltStore) saveClient(
+	record *clientRecord,
+) error {
+	return bs.put(BOLT_BUCKET_CLIENTS, record.Id, record)
+}
+
+func (bs *boltStore) getClient(
+	id string,
+) (
+	*clientRecord,
+	bool,
+	error,
+) {
+	record := &clientRecord{}
+	ok, err := bs.get(BOLT_BUCKET_CLIENTS, id, record)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return record, true, nil
+}
+
+func (bs *boltStore) saveDesiredState(
+	clientId string,
+	ds *desiredState,
+) error {
+	return bs.put(BOLT_BUCKET_DESIRED_STATES, clientId, ds)
+}
+
+func (bs *boltStore) getDesiredState(
+	clientId string,
+) (
+	*desiredState,
+	bool,
+	error,
+) {
+	ds := &desiredState{}
+	ok, err := bs.get(BOLT_BUCKET_DESIRED_STATES, clientId, ds)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return ds, true, nil
+}
+
+func (bs *boltStore) saveCommand(
+	c *command,
+) error {
+	return bs.put(BOLT_BUCKET_COMMANDS, c.Id, c)
+}
+
+func (bs *boltStore) getCommand(
+	id string,
+) (
+	*command,
+	bool,
+	error,
+) {
+	c := &command{}
+	ok, err := bs.get(BOLT_BUCKET_COMMANDS, id, c)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+func (bs *boltStore) appendEvent(
+	event *clientEvent,
+) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_BUCKET_EVENTS)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, len(event.ClientId)+1+8)
+		copy(key, event.ClientId+"/")
+		binary.BigEndian.PutUint64(key[len(event.ClientId)+1:], seq)
+		return bucket.Put(key, data)
+	})
+}
+
+func (bs *boltStore) listEvents(
+	clientId string,
+) (
+	[]*clientEvent,
+	error,
+) {
+	prefix := []byte(clientId + "/")
+	events := []*clientEvent{}
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(BOLT_BUCKET_EVENTS).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			// Skip the events of the clients whose ID starts with this one
+			if len(k) != len(prefix)+8 {
+				continue
+			}
+
+			event := &clientEvent{}
+			err := json.Unmarshal(v, event)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	// Sorted the same way as in memory, the events are not necessarily
+	// appended in the order of their time
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, err
+}
+
+// Appends the entry to the audit trail. The entries are keyed by a
+// sequence and never updated.
+func (bs *boltStore) appendAudit(
+	entry *auditEntry,
+) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_BUCKET_AUDIT)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+}
+
+func (bs *boltStore) listAudit() (
+	[]*auditEntry,
+	error,
+) {
+	entries := []*auditEntry{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_AUDIT).ForEach(func(k, v []byte) error {
+			entry := &auditEntry{}
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Stores the token keyed by the hash of its secret so that it can be
+// looked up on every request.
+func (bs *boltStore) saveToken(
+	t *token,
+) error {
+	return bs.put(BOLT_BUCKET_TOKENS, t.Hash, t)
+}
+
+func (bs *boltStore) getToken(
+	hash string,
+) (
+	*token,
+	bool,
+	error,
+) {
+	t := &token{}
+	ok, err := bs.get(BOLT_BUCKET_TOKENS, hash, t)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return t, true, nil
+}
+
+func (bs *boltStore) listTokens() (
+	[]*token,
+	error,
+) {
+	tokens := []*token{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_TOKENS).ForEach(func(k, v []byte) error {
+			t := &token{}
+			err := json.Unmarshal(v, t)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, err
+}
+
+func (bs *boltStore) deleteToken(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return bs.deleteMatching(BOLT_BUCKET_TOKENS, func(v []byte) bool {
+		t := &token{}
+		return json.Unmarshal(v, t) == nil && t.Id == id
+	})
+}
+
+func (bs *boltStore) saveEnrollmentToken(
+	t *enrollmentToken,
+) error {
+	return bs.put(BOLT_BUCKET_ENROLLMENTS, t.Hash, t)
+}
+
+func (bs *boltStore) getEnrollmentToken(
+	hash string,
+) (
+	*enrollmentToken,
+	bool,
+	error,
+) {
+	t := &enrollmentToken{}
+	ok, err := bs.get(BOLT_BUCKET_ENROLLMENTS, hash, t)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return t, true, nil
+}
+
+func (bs *boltStore) listEnrollmentTokens() (
+	[]*enrollmentToken,
+	error,
+) {
+	tokens := []*enrollmentToken{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_ENROLLMENTS).ForEach(func(k, v []byte) error {
+			t := &enrollmentToken{}
+			err := json.Unmarshal(v, t)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, err
+}
+
+func (bs *boltStore) deleteEnrollmentToken(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return bs.deleteMatching(BOLT_BUCKET_ENROLLMENTS, func(v []byte) bool {
+		t := &enrollmentToken{}
+		return json.Unmarshal(v, t) == nil && t.Id == id
+	})
+}
+
+// Stores the credential keyed by the hash of its secret so that it can
+// be looked up on every connection.
+func (bs *boltStore) saveCredential(
+	c *clientCredential,
+) error {
+	return bs.put(BOLT_BUCKET_CREDENTIALS, c.Hash, c)
+}
+
+func (bs *boltStore) getCredential(
+	hash string,
+) (
+	*clientCredential,
+	bool,
+	error,
+) {
+	c := &clientCredential{}
+	ok, err := bs.get(BOLT_BUCKET_CREDENTIALS, hash, c)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return c, true, nil
+}
+
+func (bs *boltStore) listCredentials() (
+	[]*clientCredential,
+	error,
+) {
+	credentials := []*clientCredential{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_CREDENTIALS).ForEach(func(k, v []byte) error {
+			c := &clientCredential{}
+			err := json.Unmarshal(v, c)
+			if err != nil {
+				return err
+			}
+			credentials = append(credentials, c)
+			return nil
+		})
+	})
+	return credentials, err
+}
+
+func (bs *boltStore) saveSchedule(
+	sch *schedule,
+) error {
+	return bs.put(BOLT_BUCKET_SCHEDULES, sch.Id, sch)
+}
+
+func (bs *boltStore) listSchedules() (
+	[]*schedule,
+	error,
+) {
+	schedules := []*schedule{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_SCHEDULES).ForEach(func(k, v []byte) error {
+			sch := &schedule{}
+			err := json.Unmarshal(v, sch)
+			if err != nil {
+				return err
+			}
+			schedules = append(schedules, sch)
+			return nil
+		})
+	})
+	return schedules, err
+}
+
+func (bs *boltStore) deleteSchedule(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return bs.delete(BOLT_BUCKET_SCHEDULES, id)
+}
+
+func (bs *boltStore) saveRule(
+	r *rule,
+) error {
+	return bs.put(BOLT_BUCKET_RULES, r.Id, r)
+}
+
+func (bs *boltStore) listRules() (
+	[]*rule,
+	error,
+) {
+	rules := []*rule{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_RULES).ForEach(func(k, v []byte) error {
+			r := &rule{}
+			err := json.Unmarshal(v, r)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, r)
+			return nil
+		})
+	})
+	return rules, err
+}
+
+func (bs *boltStore) deleteRule(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return bs.delete(BOLT_BUCKET_RULES, id)
+}
+
+// Stores the profile keyed by its name unless the name is taken.
+func (bs *boltStore) createProfile(
+	p *profile,
+) (
+	bool,
+	error,
+) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+
+	isCreated := false
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_BUCKET_PROFILES)
+		if bucket.Get([]byte(p.Name)) != nil {
+			return nil
+		}
+		isCreated = true
+		return bucket.Put([]byte(p.Name), data)
+	})
+	return isCreated, err
+}
+
+func (bs *boltStore) getProfile(
+	name string,
+) (
+	*profile,
+	bool,
+	error,
+) {
+	p := &profile{}
+	ok, err := bs.get(BOLT_BUCKET_PROFILES, name, p)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return p, true, nil
+}
+
+// Returns the profiles ordered by name, which is the order of the keys.
+func (bs *boltStore) listProfiles() (
+	[]*profile,
+	error,
+) {
+	profiles := []*profile{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_BUCKET_PROFILES).ForEach(func(k, v []byte) error {
+			p := &profile{}
+			err := json.Unmarshal(v, p)
+			if err != nil {
+				return err
+			}
+			profiles = append(profiles, p)
+			return nil
+		})
+	})
+	return profiles, err
+}
+
+func (bs *boltStore) deleteProfile(
+	name string,
+) (
+	bool,
+	error,
+) {
+	return bs.delete(BOLT_BUCKET_PROFILES, name)
+}
+
+func (bs *boltStore) ping() error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(BOLT_BUCKET_CLIENTS) == nil {
+			return errors.New("bucket of the clients is missing")
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) close() error {
+	return bs.db.Close()
+}
+
+func (bs *boltStore) put(
+	bucket []byte,
+	key string,
+	value interface{},
+) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// Deletes the key. Returns false if the key does not exist.
+func (bs *boltStore) delete(
+	bucket []byte,
+	key string,
+) (
+	bool,
+	error,
+) {
+	isDeleted := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b.Get([]byte(key)) == nil {
+			return nil
+		}
+		isDeleted = true
+		return b.Delete([]byte(key))
+	})
+	return isDeleted, err
+}
+
+// Deletes the values of the bucket which match. The keys are collected
+// first since the bucket must not be modified while it is iterated.
+// Returns whether any value is deleted.
+func (bs *boltStore) deleteMatching(
+	bucket []byte,
+	match func(v []byte) bool,
+) (
+	bool,
+	error,
+) {
+	isDeleted := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		keys := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if match(v) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		isDeleted = len(keys) > 0
+		return nil
+	})
+	return isDeleted, err
+}
+
+// Reads the value of the key into the given value. Returns false if the
+// key does not exist.
+func (bs *boltStore) get(
+	bucket []byte,
+	key string,
+	value interface{},
+) (
+	bool,
+	error,
+) {
+	var data []byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucket).Get([]byte(key)); v != nil {
+			data = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, value)
+}
@@ -0,0 +1,435 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+const CLIENT_SEND_QUEUE_SIZE = 16
+
+const (
+	TRANSPORT_WEBSOCKET = "websocket"
+	TRANSPORT_OPAMP     = "opamp"
+)
+
+var (
+	errClientNotFound  = errors.New("client is not found")
+	errSendQueueIsFull = errors.New("send queue of the client is full")
+)
+
+// Health which is reported by the OpAMP agents.
+type agentHealth struct {
+	Healthy   bool   `json:"healthy"`
+	Status    string `json:"status,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type registeredClient struct {
+	id        string
+	transport string
+	metadata  *protocol.HelloPayload
+	health    *agentHealth
+	summary   *protocol.HealthPayload
+	mode      protocol.Mode
+	sendQueue chan *protocol.Envelope
+	done      chan struct{}
+	// Set before done is closed if the client is disconnected since its
+	// credential is revoked
+	isRevoked   bool
+	connectedAt time.Time
+	lastSeenAt  time.Time
+}
+
+type clientInfo struct {
+	Id          string                  `json:"id"`
+	Transport   string                  `json:"transport"`
+	Metadata    *protocol.HelloPayload  `json:"metadata"`
+	Health      *agentHealth            `json:"health,omitempty"`
+	Summary     *protocol.HealthPayload `json:"healthSummary,omitempty"`
+	Mode        protocol.Mode           `json:"mode"`
+	DesiredMode protocol.Mode           `json:"desiredMode,omitempty"`
+	ConnectedAt time.Time               `json:"connectedAt"`
+	LastSeenAt  time.Time               `json:"lastSeenAt"`
+}
+
+// Keeps the connected clients. The record and the history of each
+// client are stored so that they outlive the connection.
+type clientRegistry struct {
+	logger  *logger.Logger
+	store   store
+	events  *eventBus
+	clients map[string]*registeredClient
+	mutex   *sync.Mutex
+}
+
+func newClientRegistry(
+	logger *logger.Logger,
+	store store,
+	events *eventBus,
+) *clientRegistry {
+	return &clientRegistry{
+		logger:  logger,
+		store:   store,
+		events:  events,
+		clients: map[string]*registeredClient{},
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Registers a new connection for the given client ID. If the client
+// is already registered, the previous connection is replaced.
+func (cr *clientRegistry) register(
+	id string,
+	transport string,
+	metadata *protocol.HelloPayload,
+) *registeredClient {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if previous, ok := cr.clients[id]; ok {
+		close(previous.done)
+	}
+
+	now := time.Now().UTC()
+	c := &registeredClient{
+		id:          id,
+		transport:   transport,
+		metadata:    metadata,
+		mode:        metadata.Mode,
+		sendQueue:   make(chan *protocol.Envelope, CLIENT_SEND_QUEUE_SIZE),
+		done:        make(chan struct{}),
+		connectedAt: now,
+		lastSeenAt:  now,
+	}
+	cr.clients[id] = c
+
+	cr.saveClient(c)
+	cr.appendEvent(&clientEvent{
+		ClientId:  id,
+		Type:      CLIENT_EVENT_CONNECTED,
+		Time:      now,
+		Transport: transport,
+		Mode:      c.mode,
+	})
+	return c
+}
+
+// Removes the given connection from the registry. It is a no-op if the
+// connection is already replaced by a newer one.
+func (cr *clientRegistry) unregister(
+	c *registeredClient,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	current, ok := cr.clients[c.id]
+	if !ok || current != c {
+		return
+	}
+	close(c.done)
+	delete(cr.clients, c.id)
+
+	cr.saveClient(c)
+	cr.appendEvent(&clientEvent{
+		ClientId:  c.id,
+		Type:      CLIENT_EVENT_DISCONNECTED,
+		Time:      time.Now().UTC(),
+		Transport: c.transport,
+	})
+}
+
+func (cr *clientRegistry) touch(
+	id string,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if c, ok := cr.clients[id]; ok {
+		c.lastSeenAt = time.Now().UTC()
+	}
+}
+
+// Records the revocation of the client and disconnects it, if it is
+// connected. Returns whether the client was connected.
+func (cr *clientRegistry) revoke(
+	id string,
+) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	now := time.Now().UTC()
+	cr.appendEvent(&clientEvent{
+		ClientId: id,
+		Type:     CLIENT_EVENT_REVOKED,
+		Time:     now,
+		Reason:   "credential of the client is revoked",
+	})
+
+	c, ok := cr.clients[id]
+	if !ok {
+		return false
+	}
+	c.isRevoked = true
+	close(c.done)
+	delete(cr.clients, id)
+
+	cr.saveClient(c)
+	cr.appendEvent(&clientEvent{
+		ClientId:  id,
+		Type:      CLIENT_EVENT_DISCONNECTED,
+		Time:      now,
+		Transport: c.transport,
+		Reason:    "credential of the client is revoked",
+	})
+	return true
+}
+
+// Updates the mode which is reported by the client.
+func (cr *clientRegistry) updateMode(
+	id string,
+	mode protocol.Mode,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	c, ok := cr.clients[id]
+	if !ok || c.mode == mode {
+		return
+	}
+	c.mode = mode
+
+	cr.saveClient(c)
+	cr.appendEvent(&clientEvent{
+		ClientId: id,
+		Type:     CLIENT_EVENT_MODE_REPORTED,
+		Time:     time.Now().UTC(),
+		Mode:     mode,
+		Reason:   "reported by the client",
+	})
+}
+
+// Records that the collector of the client exited without being
+// stopped.
+func (cr *clientRegistry) collectorCrashed(
+	id string,
+	payload *protocol.CollectorCrashedPayload,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cr.appendEvent(&clientEvent{
+		ClientId: id,
+		Type:     CLIENT_EVENT_COLLECTOR_CRASHED,
+		Time:     payload.CrashedAt,
+		Mode:     payload.Mode,
+		Reason:   payload.Error,
+	})
+}
+
+// Updates the metadata which is reported by the client after it is
+// registered.
+func (cr *clientRegistry) updateMetadata(
+	id string,
+	metadata *protocol.HelloPayload,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if c, ok := cr.clients[id]; ok {
+		c.metadata = metadata
+		cr.saveClient(c)
+	}
+}
+
+func (cr *clientRegistry) updateHealth(
+	id string,
+	health *agentHealth,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if c, ok := cr.clients[id]; ok {
+		c.health = health
+	}
+}
+
+// Updates the last health summary which is reported by the client.
+func (cr *clientRegistry) updateHealthSummary(
+	id string,
+	summary *protocol.HealthPayload,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if c, ok := cr.clients[id]; ok {
+		c.summary = summary
+	}
+}
+
+func (cr *clientRegistry) send(
+	id string,
+	message *protocol.Envelope,
+) error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	c, ok := cr.clients[id]
+	if !ok {
+		return errClientNotFound
+	}
+	return c.enqueue(message)
+}
+
+func (cr *clientRegistry) get(
+	id string,
+) (
+	*clientInfo,
+	bool,
+) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	c, ok := cr.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return c.info(), true
+}
+
+func (cr *clientRegistry) list() []*clientInfo {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	infos := make([]*clientInfo, 0, len(cr.clients))
+	for _, c := range cr.clients {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+// Returns the stored record and the history of the client, including
+// the clients which are not connected anymore.
+func (cr *clientRegistry) history(
+	id string,
+) (
+	*clientRecord,
+	[]*clientEvent,
+	error,
+) {
+	record, ok, err := cr.store.getClient(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, errClientNotFound
+	}
+
+	events, err := cr.store.listEvents(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, events, nil
+}
+
+func (cr *clientRegistry) count() int {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return len(cr.clients)
+}
+
+// Stores the record of the client. The time of the first connection is
+// kept from the previous record, if any. The disconnection time is set
+// if the client is not registered anymore.
+func (cr *clientRegistry) saveClient(
+	c *registeredClient,
+) {
+	record := &clientRecord{
+		Id:          c.id,
+		Transport:   c.transport,
+		Metadata:    c.metadata,
+		Mode:        c.mode,
+		FirstSeenAt: c.connectedAt,
+		ConnectedAt: c.connectedAt,
+	}
+	if previous, ok, _ := cr.store.getClient(c.id); ok {
+		record.FirstSeenAt = previous.FirstSeenAt
+	}
+	if current, ok := cr.clients[c.id]; !ok || current != c {
+		disconnectedAt := time.Now().UTC()
+		record.DisconnectedAt = &disconnectedAt
+	}
+
+	err := cr.store.saveClient(record)
+	if err != nil {
+		cr.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Client record could not be stored.",
+			map[string]string{
+				"component.name": "registry",
+				"client.id":      c.id,
+				"error.message":  err.Error(),
+			})
+	}
+}
+
+func (cr *clientRegistry) appendEvent(
+	event *clientEvent,
+) {
+	cr.events.publish(event)
+	err := cr.store.appendEvent(event)
+	if err != nil {
+		cr.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Client event could not be stored.",
+			map[string]string{
+				"component.name": "registry",
+				"client.id":      event.ClientId,
+				"error.message":  err.Error(),
+			})
+	}
+}
+
+func (c *registeredClient) enqueue(
+	message *protocol.Envelope,
+) error {
+	select {
+	case c.sendQueue <- message:
+		return nil
+	default:
+		return errSendQueueIsFull
+	}
+}
+
+func (c *registeredClient) info() *clientInfo {
+	return &clientInfo{
+		Id:          c.id,
+		Transport:   c.transport,
+		Metadata:    c.metadata,
+		Health:      c.health,
+		Summary:     c.summary,
+		Mode:        c.mode,
+		ConnectedAt: c.connectedAt,
+		LastSeenAt:  c.lastSeenAt,
+	}
+}
+
+// Generates a random ID for the clients which do not provide an
+// instance ID and for the commands.
+func generateId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
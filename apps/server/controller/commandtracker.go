@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Status of the commands which are not yet acknowledged by the client.
+const COMMAND_STATUS_PENDING protocol.CommandStatus = "pending"
+
+type command struct {
+	Id        string                 `json:"id"`
+	ClientId  string                 `json:"clientId"`
+	Type      protocol.MessageType   `json:"type"`
+	Mode      protocol.Mode          `json:"mode"`
+	Ttl       string                 `json:"ttl,omitempty"`
+	Status    protocol.CommandStatus `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	ExpiresAt *time.Time             `json:"expiresAt,omitempty"`
+	ExpiredAt *time.Time             `json:"expiredAt,omitempty"`
+}
+
+type commandTracker struct {
+	logger  *logger.Logger
+	store   store
+	events  *eventBus
+	metrics *serverMetrics
+	mutex   *sync.Mutex
+}
+
+func newCommandTracker(
+	logger *logger.Logger,
+	store store,
+	events *eventBus,
+	metrics *serverMetrics,
+) *commandTracker {
+	return &commandTracker{
+		logger:  logger,
+		store:   store,
+		events:  events,
+		metrics: metrics,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (ct *commandTracker) create(
+	clientId string,
+	mode protocol.Mode,
+	ttl time.Duration,
+) *command {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	now := time.Now().UTC()
+	c := &command{
+		Id:        generateId(),
+		ClientId:  clientId,
+		Type:      protocol.MessageTypeSetMode,
+		Mode:      mode,
+		Status:    COMMAND_STATUS_PENDING,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		c.Ttl = ttl.String()
+		c.ExpiresAt = &expiresAt
+	}
+	ct.save(c)
+	ct.metrics.commandIssued(c)
+	return c
+}
+
+// Updates the status of the command. Returns false if the command is
+// not known or it does not belong to the given client. A late
+// acceptance does not overwrite the final status of the command.
+func (ct *commandTracker) update(
+	id string,
+	clientId string,
+	status protocol.CommandStatus,
+	errorMessage string,
+) bool {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	c, ok := ct.load(id)
+	if !ok || c.ClientId != clientId {
+		return false
+	}
+	if status == protocol.CommandStatusAccepted && c.isFinal() {
+		return true
+	}
+	wasFinal := c.isFinal()
+	c.Status = status
+	c.Error = errorMessage
+	c.UpdatedAt = time.Now().UTC()
+	ct.save(c)
+	if !wasFinal && c.isFinal() {
+		ct.metrics.commandFinished(c)
+	}
+
+	ct.appendEvent(&clientEvent{
+		ClientId:  clientId,
+		Type:      CLIENT_EVENT_COMMAND_STATUS,
+		Time:      c.UpdatedAt,
+		Mode:      c.Mode,
+		CommandId: id,
+		Status:    status,
+		Reason:    errorMessage,
+	})
+	return true
+}
+
+// Records that the client reverted the command since its TTL elapsed.
+func (ct *commandTracker) expire(
+	id string,
+	clientId string,
+	expiredAt time.Time,
+) bool {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	c, ok := ct.load(id)
+	if !ok || c.ClientId != clientId {
+		return false
+	}
+	c.ExpiredAt = &expiredAt
+	c.UpdatedAt = time.Now().UTC()
+	ct.save(c)
+
+	ct.appendEvent(&clientEvent{
+		ClientId:  clientId,
+		Type:      CLIENT_EVENT_MODE_EXPIRED,
+		Time:      expiredAt,
+		Mode:      protocol.ModeDefault,
+		CommandId: id,
+		Reason:    "TTL of the command elapsed",
+	})
+	return true
+}
+
+func (ct *commandTracker) get(
+	id string,
+) (
+	*command,
+	bool,
+) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	return ct.load(id)
+}
+
+// Records the event in the history of the client which the command
+// belongs to.
+func (ct *commandTracker) appendEvent(
+	event *clientEvent,
+) {
+	ct.events.publish(event)
+	err := ct.store.appendEvent(event)
+	if err != nil {
+		ct.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Client event could not be stored.",
+			map[string]string{
+				"component.name":     "commandtracker",
+				"client.id":          event.ClientId,
+				"message.command.id": event.CommandId,
+				"error.message":      err.Error(),
+			})
+	}
+}
+
+func (ct *commandTracker) load(
+	id string,
+) (
+	*command,
+	bool,
+) {
+	c, ok, err := ct.store.getCommand(id)
+	if err != nil {
+		ct.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Command could not be loaded.",
+			map[string]string{
+				"component.name":     "commandtracker",
+				"message.command.id": id,
+				"error.message":      err.Error(),
+			})
+		return nil, false
+	}
+	return c, ok
+}
+
+func (ct *commandTracker) save(
+	c *command,
+) {
+	err := ct.store.saveCommand(c)
+	if err != nil {
+		ct.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Command could not be stored.",
+			map[string]string{
+				"component.name":     "commandtracker",
+				"message.command.id": c.Id,
+				"error.message":      err.Error(),
+			})
+	}
+}
+
+func (c *command) copy() *command {
+	copied := *c
+	return &copied
+}
+
+func (c *command) isFinal() bool {
+	return c.Status == protocol.CommandStatusApplied ||
+		c.Status == protocol.CommandStatusFailed ||
+		c.Status == protocol.CommandStatusSuperseded
+}
@@ -1,7 +1,12 @@
 package controller
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
@@ -10,41 +15,139 @@ import (
 const HTTP_SERVER_PORT = "8080"
 const WEB_SOCKET_PORT = "8081"
 
+// Deadline of the whole shutdown. The connections which are not closed
+// by then are dropped.
+const SHUTDOWN_TIMEOUT = 15 * time.Second
+
 type Controller struct {
-	logger                *logger.Logger
-	webSocketReadyChannel chan bool
-	controllerChannel     chan bool
-	wg                    *sync.WaitGroup
-	httpserver            *HttpServer
-	websocketserver       *webSocketServer
+	logger          *logger.Logger
+	store           store
+	registry        *clientRegistry
+	commands        *commandTracker
+	dispatcher      *commandDispatcher
+	scheduler       *scheduler
+	wg              *sync.WaitGroup
+	httpserver      *HttpServer
+	websocketserver *webSocketServer
+}
+
+// Configuration of the server.
+type Config struct {
+	// File to persist the state of the server to. The state is kept in
+	// memory if it is not given.
+	StorePath string
+	// Bootstrap admin token for the HTTP API. A random one is generated
+	// and written to BOOTSTRAP_ADMIN_TOKEN_FILE if it is not given.
+	AdminToken string
+	// Bootstrap enrollment token for the clients. A random one is
+	// generated and written to BOOTSTRAP_ENROLLMENT_TOKEN_FILE if it is
+	// not given.
+	EnrollmentToken string
+	// Certificate and key of the web socket server. The clients connect
+	// over wss if they are given.
+	TlsCertFile string
+	TlsKeyFile  string
+	// CA bundle to verify the client certificates with. The clients have
+	// to present a certificate if it is given.
+	TlsClientCaFile string
+	// Ed25519 private key to sign the commands with, PEM encoded PKCS #8.
+	// An ephemeral key is generated and logged if it is not given.
+	SigningKeyFile string
+	// IPs or CIDR ranges of the proxies in front of the HTTP API. The
+	// audit trail only reads X-Forwarded-For from them.
+	TrustedProxies []string
+	// Duration of the debug mode which the alerts trigger unless the alert
+	// gives its own. Defaults to ALERT_DEBUG_TTL.
+	AlertDebugTtl time.Duration
 }
 
+// Creates the controller. Returns an error if the configuration is not
+// valid or the state could not be loaded.
 func New(
 	logger *logger.Logger,
-) *Controller {
-	webSocketReadyChannel := make(chan bool)
-	controllerChannel := make(chan bool)
+	cfg *Config,
+) (
+	*Controller,
+	error,
+) {
+	tlsConfig, err := newTlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSigner(logger, cfg)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := newTrustedProxies(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := newStore(logger, cfg.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	// The store is locked by this process until it is closed
+	defer func() {
+		if err != nil {
+			st.close()
+		}
+	}()
+
+	auth, err := newAuthenticator(logger, st, cfg.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	enroller, err := newEnroller(logger, st, cfg.EnrollmentToken)
+	if err != nil {
+		return nil, err
+	}
+	events := newEventBus()
+	registry := newClientRegistry(logger, st, events)
+	metrics := newServerMetrics(registry)
+	health := newServerHealth(st)
+	commands := newCommandTracker(logger, st, events, metrics)
+	dispatcher := newCommandDispatcher(logger, registry, commands, signer, st)
 
 	wg := &sync.WaitGroup{}
 
-	wg.Add(2)
-	hs := newHttpServer(logger, wg, webSocketReadyChannel, controllerChannel, HTTP_SERVER_PORT)
-	ws := newWebSocketServer(logger, wg, webSocketReadyChannel, controllerChannel, WEB_SOCKET_PORT)
+	sc, err := newScheduler(logger, wg, registry, dispatcher, st)
+	if err != nil {
+		return nil, err
+	}
+	escalator := newAlertEscalator(logger, registry, dispatcher, cfg.AlertDebugTtl)
+	rules, err := newRuleEngine(logger, registry, commands, dispatcher, st)
+	if err != nil {
+		return nil, err
+	}
+
+	wg.Add(3)
+	hs := newHttpServer(logger, wg, registry, commands, dispatcher, sc, escalator, rules, events, metrics, health, st, auth, enroller, trustedProxies, HTTP_SERVER_PORT)
+	opamp := newOpampServer(logger, registry, commands, dispatcher, rules, enroller, metrics)
+	ws := newWebSocketServer(logger, wg, registry, commands, dispatcher, rules, opamp, enroller, metrics, health, tlsConfig, WEB_SOCKET_PORT)
 
 	return &Controller{
-		logger:                logger,
-		webSocketReadyChannel: webSocketReadyChannel,
-		controllerChannel:     controllerChannel,
-		wg:                    wg,
-		httpserver:            hs,
-		websocketserver:       ws,
-	}
+		logger:          logger,
+		store:           st,
+		registry:        registry,
+		commands:        commands,
+		dispatcher:      dispatcher,
+		scheduler:       sc,
+		wg:              wg,
+		httpserver:      hs,
+		websocketserver: ws,
+	}, nil
 }
 
-func (c *Controller) Run() {
+// Runs the controller until the context is canceled and shuts it down
+// afterwards.
+func (c *Controller) Run(
+	ctx context.Context,
+) {
 
 	go c.httpserver.run()
 	go c.websocketserver.run()
+	go c.scheduler.run(ctx)
 
 	c.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -53,8 +156,138 @@ func (c *Controller) Run() {
 			"component.name": "controller",
 		})
 
-	c.wg.Wait()
+	<-ctx.Done()
+	c.shutdown()
+}
 
-	close(c.webSocketReadyChannel)
-	close(c.controllerChannel)
+// Stops accepting commands first, then closes the connections of the
+// clients and the store. Every step is bounded by the shutdown timeout.
+func (c *Controller) shutdown() {
+	c.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Shutting down the controller...",
+		map[string]string{
+			"component.name": "controller",
+		})
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	err := c.httpserver.shutdown(ctx)
+	if err != nil {
+		c.logShutdownError("HTTP server could not be shut down gracefully.", err)
+	}
+	c.dispatcher.stop()
+
+	err = c.websocketserver.shutdown(ctx)
+	if err != nil {
+		c.logShutdownError("Web socket connections could not be closed gracefully.", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.logShutdownError("Controller could not be shut down in time.", ctx.Err())
+	}
+
+	err = c.store.close()
+	if err != nil {
+		c.logShutdownError("Store could not be closed.", err)
+	}
+
+	c.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Controller is shut down.",
+		map[string]string{
+			"component.name": "controller",
+		})
+}
+
+func (c *Controller) logShutdownError(
+	msg string,
+	err error,
+) {
+	c.logger.LogWithFields(
+		logrus.ErrorLevel,
+		msg,
+		map[string]string{
+			"component.name": "controller",
+			"error.message":  err.Error(),
+		})
+}
+
+// Returns the TLS config of the web socket server or nil if TLS is not
+// configured.
+func newTlsConfig(
+	cfg *Config,
+) (
+	*tls.Config,
+	error,
+) {
+	if cfg.TlsCertFile == "" && cfg.TlsKeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig, err := newServerTlsConfig(cfg.TlsCertFile, cfg.TlsKeyFile, cfg.TlsClientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS config could not be created: %w", err)
+	}
+	return tlsConfig, nil
+}
+
+func newSigner(
+	logger *logger.Logger,
+	cfg *Config,
+) (
+	*commandSigner,
+	error,
+) {
+	signer, err := newCommandSigner(logger, cfg.SigningKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing key could not be loaded: %w", err)
+	}
+	return signer, nil
+}
+
+func newTrustedProxies(
+	cfg *Config,
+) (
+	[]*net.IPNet,
+	error,
+) {
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies could not be parsed: %w", err)
+	}
+	return proxies, nil
+}
+
+func newStore(
+	logger *logger.Logger,
+	storePath string,
+) (
+	store,
+	error,
+) {
+	if storePath == "" {
+		return newMemoryStore(), nil
+	}
+
+	st, err := newBoltStore(storePath)
+	if err != nil {
+		return nil, fmt.Errorf("store %s could not be opened: %w", storePath, err)
+	}
+
+	logger.LogWithFields(
+		logrus.InfoLevel,
+		"State is persisted to "+storePath,
+		map[string]string{
+			"component.name": "controller",
+		})
+	return st, nil
 }
@@ -0,0 +1,23 @@
+package controller
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Static files of the dashboard. They are public, the dashboard calls
+// the API with the bearer token which the SRE enters.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Returns the handler which serves the dashboard under /dashboard/.
+func (hs *HttpServer) dashboard() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// The directory is embedded at compile time
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServerFS(files))
+}
@@ -0,0 +1,314 @@
+"use strict";
+
+// Dashboard of the control server. It only uses the HTTP API, so every
+// action is authorized and audited like a call with curl.
+
+const REFRESH_INTERVAL_MS = 3000;
+const EVENT_WINDOW_MS = 10 * 60 * 1000;
+const MAX_EVENTS = 200;
+const TOKEN_KEY = "rct.token";
+
+const state = {
+  token: sessionStorage.getItem(TOKEN_KEY) || "",
+  selected: "",
+  timer: null,
+  // Aborts the event stream
+  stream: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+async function api(method, path, body) {
+  const response = await fetch(path, {
+    method: method,
+    headers: { Authorization: "Bearer " + state.token },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (response.status === 401) {
+    disconnect();
+    throw new Error("Token is not valid, connect again.");
+  }
+  if (!response.ok) {
+    throw new Error(response.status + ": " + (await response.text()));
+  }
+  return response.json();
+}
+
+function showMessage(text) {
+  $("message").textContent = text;
+  $("message").hidden = !text;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === undefined || text === "" ? "-" : text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(td, label, onClick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  td.appendChild(b);
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleTimeString() : "";
+}
+
+function formatAge(value) {
+  const seconds = Math.floor((Date.now() - new Date(value)) / 1000);
+  if (seconds < 60) return seconds + "s";
+  if (seconds < 3600) return Math.floor(seconds / 60) + "m";
+  if (seconds < 172800) return Math.floor(seconds / 3600) + "h";
+  return Math.floor(seconds / 86400) + "d";
+}
+
+function controlBody() {
+  return {
+    ttl: $("ttl").value.trim(),
+    reason: $("reason").value.trim(),
+    ticket: $("ticket").value.trim(),
+  };
+}
+
+// Switches the given client, or all of them, to debug or default mode.
+async function setMode(clientId, debug) {
+  const path = clientId ? "/clients/" + encodeURIComponent(clientId) + "/control" : "/control";
+  const body = controlBody();
+  if (!debug) {
+    delete body.ttl;
+  }
+  let error = "";
+  try {
+    await api(debug ? "POST" : "DELETE", path, body);
+  } catch (err) {
+    error = "Mode could not be changed: " + err.message;
+  }
+  await refresh();
+  if (error) {
+    showMessage(error);
+  }
+}
+
+function renderClients(clients) {
+  const tbody = $("clients");
+  tbody.replaceChildren();
+  for (const c of clients) {
+    const m = c.metadata || {};
+    const h = c.healthSummary;
+    const row = tbody.insertRow();
+    if (c.id === state.selected) {
+      row.className = "selected";
+    }
+    cell(row, c.id, "mono");
+    cell(row, c.transport);
+    cell(row, m.hostname);
+    cell(row, m.serviceName);
+    cell(row, m.group);
+    cell(row, [m.clientVersion, m.collectorVersion].filter(Boolean).join(" / "));
+    cell(row, c.mode, c.mode === "debug" ? "mode-debug" : "");
+    cell(row, c.desiredMode);
+    cell(row, h && h.count > 0 ? Math.round(h.latencyP95Ms) + "ms" : "");
+    cell(row, formatAge(c.connectedAt));
+
+    const actions = cell(row, "");
+    actions.textContent = "";
+    button(actions, "Debug", () => setMode(c.id, true));
+    button(actions, "Default", () => setMode(c.id, false));
+    button(actions, "Commands", () => {
+      state.selected = state.selected === c.id ? "" : c.id;
+      refresh();
+    });
+  }
+}
+
+// Shows the commands of the selected client with their latest status,
+// which are both taken from its history.
+function renderCommands(clientId, events) {
+  $("details").hidden = !clientId;
+  $("details-client").textContent = clientId;
+  const commands = [];
+  const byId = {};
+  for (const e of events) {
+    if (e.type === "command_sent") {
+      byId[e.commandId] = { sent: e, status: "pending" };
+      commands.push(byId[e.commandId]);
+    } else if (e.type === "command_status" && byId[e.commandId]) {
+      byId[e.commandId].status = e.status;
+    }
+  }
+
+  const tbody = $("commands");
+  tbody.replaceChildren();
+  for (const c of commands.reverse()) {
+    const row = tbody.insertRow();
+    cell(row, formatTime(c.sent.time));
+    cell(row, c.sent.commandId, "mono");
+    cell(row, c.sent.mode, c.sent.mode === "debug" ? "mode-debug" : "");
+    cell(row, c.status);
+    cell(row, c.sent.reason);
+  }
+}
+
+function appendEvents(events) {
+  const tbody = $("events");
+  events.sort((a, b) => new Date(a.time) - new Date(b.time));
+  for (const e of events) {
+    const row = tbody.insertRow(0);
+    row.className = "fresh";
+    cell(row, formatTime(e.time));
+    cell(row, e.clientId, "mono");
+    cell(row, e.type);
+    cell(row, e.mode);
+    cell(row, e.commandId, "mono");
+    cell(row, e.status);
+    cell(row, e.reason);
+  }
+  while (tbody.rows.length > MAX_EVENTS) {
+    tbody.deleteRow(-1);
+  }
+}
+
+// Reloads the clients and the commands of the selected one.
+async function refresh() {
+  if (!state.token) {
+    return;
+  }
+  try {
+    renderClients(await api("GET", "/clients"));
+    if (state.selected) {
+      const history = await api("GET", "/clients/" + encodeURIComponent(state.selected) + "/history");
+      renderCommands(state.selected, history.events);
+    } else {
+      renderCommands("", []);
+    }
+    showMessage("");
+  } catch (err) {
+    showMessage(err.message);
+  }
+}
+
+function eventKey(e) {
+  return [e.clientId, e.type, e.time, e.commandId, e.status].join("/");
+}
+
+// Shows the events of the last minutes from the histories of the
+// connected clients. Returns their keys so that they are not shown
+// again if they are streamed as well.
+async function loadPastEvents() {
+  const keys = new Set();
+  const from = Date.now() - EVENT_WINDOW_MS;
+  const past = [];
+  for (const c of await api("GET", "/clients")) {
+    try {
+      const history = await api("GET", "/clients/" + encodeURIComponent(c.id) + "/history");
+      for (const e of history.events) {
+        if (new Date(e.time) > from) {
+          past.push(e);
+          keys.add(eventKey(e));
+        }
+      }
+    } catch (err) {
+      // The client may have disconnected without leaving a record
+    }
+  }
+  appendEvents(past);
+  return keys;
+}
+
+// Follows the event stream of the server. EventSource cannot send the
+// bearer token, so the stream is read with fetch.
+async function streamEvents() {
+  const controller = new AbortController();
+  state.stream = controller;
+  while (!controller.signal.aborted) {
+    try {
+      const response = await fetch("/events", {
+        headers: { Authorization: "Bearer " + state.token },
+        signal: controller.signal,
+      });
+      if (!response.ok) {
+        throw new Error("Event stream failed with " + response.status + ": " + (await response.text()));
+      }
+      $("events").replaceChildren();
+      const past = await loadPastEvents();
+
+      const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) {
+          break;
+        }
+        buffer += value;
+        const lines = buffer.split("\n");
+        buffer = lines.pop();
+        for (const line of lines) {
+          if (!line.startsWith("data: ")) {
+            continue;
+          }
+          const e = JSON.parse(line.slice(6));
+          if (past.has(eventKey(e))) {
+            continue;
+          }
+          appendEvents([e]);
+          // The event may change the mode or the commands which are shown
+          refresh();
+        }
+      }
+    } catch (err) {
+      if (controller.signal.aborted) {
+        return;
+      }
+      showMessage(err.message);
+    }
+    // The stream ended, subscribe again after a while
+    await new Promise((resolve) => setTimeout(resolve, REFRESH_INTERVAL_MS));
+  }
+}
+
+function connect(token) {
+  state.token = token;
+  sessionStorage.setItem(TOKEN_KEY, token);
+  $("token").hidden = true;
+  $("login").querySelector("button[type=submit]").hidden = true;
+  $("logout").hidden = false;
+  $("content").hidden = false;
+  refresh();
+  state.timer = setInterval(refresh, REFRESH_INTERVAL_MS);
+  streamEvents();
+}
+
+function disconnect() {
+  state.token = "";
+  sessionStorage.removeItem(TOKEN_KEY);
+  clearInterval(state.timer);
+  if (state.stream) {
+    state.stream.abort();
+  }
+  $("token").hidden = false;
+  $("token").value = "";
+  $("login").querySelector("button[type=submit]").hidden = false;
+  $("logout").hidden = true;
+  $("content").hidden = true;
+  $("events").replaceChildren();
+}
+
+$("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const token = $("token").value.trim();
+  if (token) {
+    connect(token);
+  }
+});
+$("logout").addEventListener("click", disconnect);
+document.querySelector("[data-action=debug-all]").addEventListener("click", () => setMode("", true));
+document.querySelector("[data-action=default-all]").addEventListener("click", () => setMode("", false));
+
+if (state.token) {
+  connect(state.token);
+}
@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+var errServerShuttingDown = errors.New("server is shutting down")
+
+type desiredState struct {
+	Mode protocol.Mode `json:"mode"`
+	// Command which requested the state. Unlike the last command, it is
+	// kept when the state is sent again to reconcile the client.
+	RequestedBy   string     `json:"requestedBy"`
+	LastCommandId string     `json:"lastCommandId"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Sends the commands to the clients and keeps track of the state which
+// is desired for each of them so that it can be restored whenever a
+// client drifts away from it, for example after a reconnect.
+type commandDispatcher struct {
+	logger   *logger.Logger
+	registry *clientRegistry
+	commands *commandTracker
+	signer   *commandSigner
+	store    store
+	// Whether the server shuts down and sends no more commands
+	isStopped bool
+	mutex     *sync.Mutex
+}
+
+func newCommandDispatcher(
+	logger *logger.Logger,
+	registry *clientRegistry,
+	commands *commandTracker,
+	signer *commandSigner,
+	store store,
+) *commandDispatcher {
+	return &commandDispatcher{
+		logger:   logger,
+		registry: registry,
+		commands: commands,
+		signer:   signer,
+		store:    store,
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Stops sending commands, both the requested ones and the ones which
+// restore the desired states.
+func (cd *commandDispatcher) stop() {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+	cd.isStopped = true
+}
+
+// Stores the mode as the desired state of the client and sends it. If
+// the TTL is set, the desired state reverts to the default mode after
+// it elapses. The reason is recorded in the history of the client.
+func (cd *commandDispatcher) setMode(
+	clientId string,
+	mode protocol.Mode,
+	ttl time.Duration,
+	reason string,
+) (
+	*command,
+	error,
+) {
+	if _, ok := cd.registry.get(clientId); !ok {
+		return nil, errClientNotFound
+	}
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	if cd.isStopped {
+		return nil, errServerShuttingDown
+	}
+
+	c, err := cd.send(clientId, mode, ttl, reason)
+	if c == nil {
+		return nil, err
+	}
+	cd.saveDesiredState(clientId, &desiredState{
+		Mode:          mode,
+		RequestedBy:   c.Id,
+		LastCommandId: c.Id,
+		UpdatedAt:     time.Now().UTC(),
+		ExpiresAt:     c.ExpiresAt,
+	})
+	return c, err
+}
+
+// Reverts the desired state of the client to the default mode after
+// the client reports that the TTL of the given command has elapsed.
+func (cd *commandDispatcher) expire(
+	clientId string,
+	commandId string,
+	expiredAt time.Time,
+) {
+	cd.commands.expire(commandId, clientId, expiredAt)
+
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	ds, ok := cd.loadDesiredState(clientId)
+	if !ok || ds.LastCommandId != commandId {
+		return
+	}
+	ds.Mode = protocol.ModeDefault
+	ds.ExpiresAt = nil
+	ds.UpdatedAt = time.Now().UTC()
+	cd.saveDesiredState(clientId, ds)
+}
+
+func (cd *commandDispatcher) getDesiredState(
+	clientId string,
+) (
+	*desiredState,
+	bool,
+) {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	ds, ok := cd.loadDesiredState(clientId)
+	if !ok {
+		return nil, false
+	}
+	ds.revertIfExpired()
+	return ds, true
+}
+
+// Compares the mode which is reported by the client with its desired
+// state and sends the desired mode again if they differ. Nothing is
+// sent while the last command for the client is still in progress.
+func (cd *commandDispatcher) reconcile(
+	clientId string,
+	actualMode protocol.Mode,
+) {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	if cd.isStopped {
+		return
+	}
+
+	ds, ok := cd.loadDesiredState(clientId)
+	if !ok {
+		return
+	}
+	if ds.revertIfExpired() {
+		cd.saveDesiredState(clientId, ds)
+	}
+	if ds.Mode == actualMode {
+		return
+	}
+
+	if last, ok := cd.commands.get(ds.LastCommandId); ok && !last.isFinal() {
+		return
+	}
+
+	cd.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Client drifted from its desired state. Reconciling...",
+		map[string]string{
+			"component.name":       "dispatcher",
+			"client.id":            clientId,
+			"otelcol.mode":         string(actualMode),
+			"otelcol.mode.desired": string(ds.Mode),
+		})
+
+	// Only the remaining TTL is sent so that the original expiry holds
+	var ttl time.Duration
+	if ds.ExpiresAt != nil {
+		ttl = time.Until(*ds.ExpiresAt).Round(time.Second)
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+	}
+
+	c, err := cd.send(clientId, ds.Mode, ttl, "client drifted from its desired state")
+	if err != nil {
+		cd.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Reconciling the client is failed.",
+			map[string]string{
+				"component.name": "dispatcher",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+	}
+	if c == nil {
+		return
+	}
+	ds.LastCommandId = c.Id
+	cd.saveDesiredState(clientId, ds)
+}
+
+// Creates a command for the client, signs it and queues it. The
+// command is marked as failed if it could not be queued. Returns no
+// command if the failed one could not be loaded back from the store.
+func (cd *commandDispatcher) send(
+	clientId string,
+	mode protocol.Mode,
+	ttl time.Duration,
+	reason string,
+) (
+	*command,
+	error,
+) {
+	c := cd.commands.create(clientId, mode, ttl)
+	cd.commands.appendEvent(&clientEvent{
+		ClientId:  clientId,
+		Type:      CLIENT_EVENT_COMMAND_SENT,
+		Time:      c.CreatedAt,
+		Mode:      mode,
+		CommandId: c.Id,
+		Reason:    reason,
+	})
+
+	signature, err := cd.signer.sign(clientId, c.Id, mode, c.Ttl)
+	var message *protocol.Envelope
+	if err == nil {
+		message, err = protocol.NewEnvelope(
+			protocol.MessageTypeSetMode,
+			c.Id,
+			&protocol.SetModePayload{
+				Mode:      mode,
+				Ttl:       c.Ttl,
+				Signature: signature,
+			},
+		)
+	}
+	if err == nil {
+		err = cd.registry.send(clientId, message)
+	}
+	if err != nil {
+		cd.commands.update(c.Id, clientId, protocol.CommandStatusFailed, err.Error())
+		c, _ = cd.commands.get(c.Id)
+		return c, err
+	}
+	return c, nil
+}
+
+func (cd *commandDispatcher) loadDesiredState(
+	clientId string,
+) (
+	*desiredState,
+	bool,
+) {
+	ds, ok, err := cd.store.getDesiredState(clientId)
+	if err != nil {
+		cd.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Desired state could not be loaded.",
+			map[string]string{
+				"component.name": "dispatcher",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+		return nil, false
+	}
+	return ds, ok
+}
+
+func (cd *commandDispatcher) saveDesiredState(
+	clientId string,
+	ds *desiredState,
+) {
+	err := cd.store.saveDesiredState(clientId, ds)
+	if err != nil {
+		cd.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Desired state could not be stored.",
+			map[string]string{
+				"component.name": "dispatcher",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+	}
+}
+
+// Reverts the desired state to the default mode if its TTL elapsed.
+// Returns whether it is reverted.
+func (ds *desiredState) revertIfExpired() bool {
+	if ds.ExpiresAt == nil || time.Now().Before(*ds.ExpiresAt) {
+		return false
+	}
+	ds.Mode = protocol.ModeDefault
+	ds.ExpiresAt = nil
+	ds.UpdatedAt = time.Now().UTC()
+	return true
+}
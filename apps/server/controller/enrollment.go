@@ -0,0 +1,306 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+)
+
+const (
+	ENROLLMENT_TOKEN_PREFIX  = "rce_"
+	CLIENT_CREDENTIAL_PREFIX = "rcc_"
+)
+
+// File which the generated bootstrap enrollment token is written to.
+const BOOTSTRAP_ENROLLMENT_TOKEN_FILE = "./bootstrap-enrollment-token"
+
+var (
+	errClientIsNotAuthenticated = errors.New("client credential or enrollment token is required")
+	errCredentialIsInvalid      = errors.New("client credential is invalid")
+	errCredentialIsRevoked      = errors.New("client credential is revoked")
+	errEnrollmentTokenIsInvalid = errors.New("enrollment token is invalid or expired")
+	errClientIsAlreadyEnrolled  = errors.New("client is already enrolled")
+	errIdentityMismatch         = errors.New("client certificate does not match the client credential")
+)
+
+// Token which the clients present on their first connection to receive
+// their own credential. Only the hash of the secret is stored.
+type enrollmentToken struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Credential which is issued to a single client when it enrolls. The
+// client ID is bound to it so that the client cannot claim another one.
+type clientCredential struct {
+	ClientId     string     `json:"clientId"`
+	Hash         string     `json:"hash"`
+	EnrolledWith string     `json:"enrolledWith"`
+	IssuedAt     time.Time  `json:"issuedAt"`
+	RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Outcome of the authentication of a connecting client.
+type admission struct {
+	// ID which the client is known by, either from its credential or
+	// from its certificate. Empty if the client is free to claim one.
+	clientId string
+	// Token which the client enrolls with, nil if it has a credential
+	enrollmentToken *enrollmentToken
+}
+
+// Enrolls the clients and authenticates their connections. The
+// bootstrap enrollment token is given by the operator of the server and
+// is never stored.
+type enroller struct {
+	logger        *logger.Logger
+	store         store
+	bootstrapHash string
+	mutex         *sync.Mutex
+}
+
+func newEnroller(
+	logger *logger.Logger,
+	store store,
+	enrollmentToken string,
+) (
+	*enroller,
+	error,
+) {
+	if enrollmentToken == "" {
+		enrollmentToken = generateSecret(ENROLLMENT_TOKEN_PREFIX)
+		err := writeSecretFile(BOOTSTRAP_ENROLLMENT_TOKEN_FILE, enrollmentToken)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap enrollment token could not be written to %s: %w", BOOTSTRAP_ENROLLMENT_TOKEN_FILE, err)
+		}
+		logger.LogWithFields(
+			logrus.InfoLevel,
+			"No enrollment token is given, a bootstrap enrollment token is generated and written to "+BOOTSTRAP_ENROLLMENT_TOKEN_FILE,
+			map[string]string{
+				"component.name": "enroller",
+			})
+	}
+
+	return &enroller{
+		logger:        logger,
+		store:         store,
+		bootstrapHash: hashSecret(enrollmentToken),
+		mutex:         &sync.Mutex{},
+	}, nil
+}
+
+// Authenticates the connection request of a client by its bearer
+// token, which is either its credential or an enrollment token.
+func (e *enroller) admit(
+	r *http.Request,
+) (
+	*admission,
+	error,
+) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	secret = strings.TrimSpace(secret)
+	if !ok || secret == "" {
+		return nil, errClientIsNotAuthenticated
+	}
+	identity := peerIdentity(r.TLS)
+	hash := hashSecret(secret)
+
+	if strings.HasPrefix(secret, CLIENT_CREDENTIAL_PREFIX) {
+		c, ok, err := e.store.getCredential(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errCredentialIsInvalid
+		}
+		if c.RevokedAt != nil {
+			return nil, errCredentialIsRevoked
+		}
+		if identity != "" && identity != c.ClientId {
+			return nil, errIdentityMismatch
+		}
+		return &admission{clientId: c.ClientId}, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(e.bootstrapHash)) == 1 {
+		return &admission{
+			clientId: identity,
+			enrollmentToken: &enrollmentToken{
+				Id:   "bootstrap",
+				Name: "bootstrap-enrollment",
+			},
+		}, nil
+	}
+
+	t, ok, err := e.store.getEnrollmentToken(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)) {
+		return nil, errEnrollmentTokenIsInvalid
+	}
+	return &admission{
+		clientId:        identity,
+		enrollmentToken: t,
+	}, nil
+}
+
+func (a *admission) isEnrolling() bool {
+	return a.enrollmentToken != nil
+}
+
+// Issues the credential of the client which is admitted with an
+// enrollment token. A client ID can only be enrolled once so that the
+// enrollment token cannot be used to take over another client.
+func (e *enroller) enroll(
+	clientId string,
+	a *admission,
+) (
+	string,
+	error,
+) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	credentials, err := e.store.listCredentials()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range credentials {
+		if c.ClientId == clientId {
+			return "", errClientIsAlreadyEnrolled
+		}
+	}
+
+	secret := generateSecret(CLIENT_CREDENTIAL_PREFIX)
+	err = e.store.saveCredential(&clientCredential{
+		ClientId:     clientId,
+		Hash:         hashSecret(secret),
+		EnrolledWith: a.enrollmentToken.Id,
+		IssuedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	e.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Client is enrolled.",
+		map[string]string{
+			"component.name":      "enroller",
+			"client.id":           clientId,
+			"enrollment.token.id": a.enrollmentToken.Id,
+		})
+	return secret, nil
+}
+
+// Revokes the credential of the client. Returns false if the client is
+// not enrolled.
+func (e *enroller) revoke(
+	clientId string,
+) (
+	bool,
+	error,
+) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	credentials, err := e.store.listCredentials()
+	if err != nil {
+		return false, err
+	}
+
+	isFound := false
+	now := time.Now().UTC()
+	for _, c := range credentials {
+		if c.ClientId != clientId {
+			continue
+		}
+		isFound = true
+		if c.RevokedAt != nil {
+			continue
+		}
+
+		c.RevokedAt = &now
+		err := e.store.saveCredential(c)
+		if err != nil {
+			return false, err
+		}
+	}
+	return isFound, nil
+}
+
+// Creates an enrollment token and returns it together with its secret.
+// The secret cannot be retrieved afterwards.
+func (e *enroller) create(
+	name string,
+	ttl time.Duration,
+) (
+	*enrollmentToken,
+	string,
+	error,
+) {
+	if name == "" {
+		return nil, "", errors.New("name should be given")
+	}
+	if ttl < 0 {
+		return nil, "", errors.New("ttl should not be negative")
+	}
+
+	secret := generateSecret(ENROLLMENT_TOKEN_PREFIX)
+	t := &enrollmentToken{
+		Id:        generateId(),
+		Name:      name,
+		Hash:      hashSecret(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expiresAt := t.CreatedAt.Add(ttl)
+		t.ExpiresAt = &expiresAt
+	}
+
+	err := e.store.saveEnrollmentToken(t)
+	if err != nil {
+		return nil, "", err
+	}
+	return t.redacted(), secret, nil
+}
+
+func (e *enroller) list() (
+	[]*enrollmentToken,
+	error,
+) {
+	tokens, err := e.store.listEnrollmentTokens()
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		tokens[i] = t.redacted()
+	}
+	return tokens, nil
+}
+
+func (e *enroller) delete(
+	id string,
+) (
+	bool,
+	error,
+) {
+	return e.store.deleteEnrollmentToken(id)
+}
+
+func (t *enrollmentToken) redacted() *enrollmentToken {
+	copied := *t
+	copied.Hash = ""
+	return &copied
+}
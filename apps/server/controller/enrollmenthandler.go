@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type enrollmentTokenRequest struct {
+	Name string `json:"name"`
+	Ttl  string `json:"ttl"`
+}
+
+type enrollmentTokenResponse struct {
+	*enrollmentToken
+	Secret string `json:"secret"`
+}
+
+func (hs *HttpServer) handleEnrollmentTokens(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := hs.enroller.list()
+		if err != nil {
+			msg := "Enrollment tokens could not be loaded."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, tokens)
+
+	case http.MethodPost:
+		requestBody := &enrollmentTokenRequest{}
+		err := json.NewDecoder(r.Body).Decode(requestBody)
+		if err != nil {
+			msg := "HTTP request body parsing failed."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		var ttl time.Duration
+		if requestBody.Ttl != "" {
+			ttl, err = time.ParseDuration(requestBody.Ttl)
+			if err != nil {
+				msg := "TTL is not valid!"
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(msg))
+				return
+			}
+		}
+
+		t, secret, err := hs.enroller.create(requestBody.Name, ttl)
+		if err != nil {
+			msg := "Enrollment token is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Enrollment token is created.",
+			map[string]string{
+				"component.name":      "httpserver",
+				"enrollment.token.id": t.Id,
+			})
+		hs.writeJson(w, http.StatusCreated, &enrollmentTokenResponse{
+			enrollmentToken: t,
+			Secret:          secret,
+		})
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
+
+func (hs *HttpServer) handleEnrollmentToken(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	tokenId := r.PathValue("id")
+
+	if r.Method != http.MethodDelete {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+
+	ok, err := hs.enroller.delete(tokenId)
+	if err != nil {
+		msg := "Enrollment token could not be deleted."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"enrollment.token.id": tokenId,
+				"error.message":       err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return
+	}
+	if !ok {
+		msg := "Enrollment token is not found!"
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+
+	msg := "Enrollment token is deleted."
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		msg,
+		map[string]string{
+			"component.name":      "httpserver",
+			"enrollment.token.id": tokenId,
+		})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(msg))
+}
+
+// Revokes the credential of the client and disconnects it. The client
+// cannot connect or enroll again with the same ID afterwards.
+func (hs *HttpServer) handleClientRevoke(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	clientId := r.PathValue("id")
+
+	if r.Method != http.MethodPost {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+	auditEntryOf(r).Targets = []string{clientId}
+
+	ok, err := hs.enroller.revoke(clientId)
+	if err != nil {
+		msg := "Client could not be revoked."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return
+	}
+	if !ok {
+		msg := "Client is not enrolled!"
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+
+	isDisconnected := hs.registry.revoke(clientId)
+
+	msg := "Client is revoked."
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		msg,
+		map[string]string{
+			"component.name":        "httpserver",
+			"client.id":             clientId,
+			"client.isDisconnected": strconv.FormatBool(isDisconnected),
+		})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"strings"
+	"sync"
+)
+
+// Number of events which are buffered for a subscriber. A subscriber
+// which falls further behind is dropped and has to subscribe again.
+const EVENT_SUBSCRIPTION_BUFFER_SIZE = 256
+
+// Types of the events which can be subscribed to.
+var eventTypes = []string{
+	CLIENT_EVENT_CONNECTED,
+	CLIENT_EVENT_DISCONNECTED,
+	CLIENT_EVENT_MODE_REPORTED,
+	CLIENT_EVENT_COMMAND_SENT,
+	CLIENT_EVENT_COMMAND_STATUS,
+	CLIENT_EVENT_MODE_EXPIRED,
+	CLIENT_EVENT_COLLECTOR_CRASHED,
+	CLIENT_EVENT_REVOKED,
+	CLIENT_EVENT_RULE_TRIPPED,
+	CLIENT_EVENT_RULE_CLEARED,
+}
+
+// Selects the events of a subscription. Empty sets match everything.
+type eventFilter struct {
+	clientIds map[string]bool
+	types     map[string]bool
+	statuses  map[string]bool
+}
+
+type eventSubscription struct {
+	filter *eventFilter
+	events chan *clientEvent
+	// Closed by the bus if the subscriber is dropped
+	dropped chan struct{}
+}
+
+// Publishes the events of the clients to the live subscribers. The
+// events are stored by the registry and the command tracker as well,
+// the bus only carries the ones which happen while subscribed.
+type eventBus struct {
+	subscriptions map[*eventSubscription]bool
+	mutex         *sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscriptions: map[*eventSubscription]bool{},
+		mutex:         &sync.Mutex{},
+	}
+}
+
+func (eb *eventBus) subscribe(
+	filter *eventFilter,
+) *eventSubscription {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	s := &eventSubscription{
+		filter:  filter,
+		events:  make(chan *clientEvent, EVENT_SUBSCRIPTION_BUFFER_SIZE),
+		dropped: make(chan struct{}),
+	}
+	eb.subscriptions[s] = true
+	return s
+}
+
+func (eb *eventBus) unsubscribe(
+	s *eventSubscription,
+) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	delete(eb.subscriptions, s)
+}
+
+// Hands the event to the matching subscribers without blocking. The
+// subscribers whose buffer is full are dropped.
+func (eb *eventBus) publish(
+	event *clientEvent,
+) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	for s := range eb.subscriptions {
+		if !s.filter.matches(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			delete(eb.subscriptions, s)
+			close(s.dropped)
+		}
+	}
+}
+
+// Parses the comma separated values of the query parameter into a set.
+// The parameter can be repeated.
+func parseFilterValues(
+	values []string,
+) map[string]bool {
+	set := map[string]bool{}
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				set[v] = true
+			}
+		}
+	}
+	return set
+}
+
+func (f *eventFilter) matches(
+	event *clientEvent,
+) bool {
+	if len(f.clientIds) != 0 && !f.clientIds[event.ClientId] {
+		return false
+	}
+	if len(f.types) != 0 && !f.types[event.Type] {
+		return false
+	}
+	if len(f.statuses) != 0 && !f.statuses[string(event.Status)] {
+		return false
+	}
+	return true
+}
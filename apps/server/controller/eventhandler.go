@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Interval of the comments which keep the idle event streams open
+// through proxies.
+const EVENT_STREAM_KEEPALIVE_INTERVAL = 15 * time.Second
+
+// Streams the events of the clients as Server-Sent Events while the
+// request is open. The events can be filtered with the client, type and
+// status query parameters, each of which takes comma separated values.
+func (hs *HttpServer) handleEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := &eventFilter{
+		clientIds: parseFilterValues(query["client"]),
+		types:     parseFilterValues(query["type"]),
+		statuses:  parseFilterValues(query["status"]),
+	}
+	for t := range filter.types {
+		if !slices.Contains(eventTypes, t) {
+			msg := "Event type " + t + " is not valid, valid ones are " + strings.Join(eventTypes, ", ") + "!"
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+	}
+
+	s := hs.events.subscribe(filter)
+	defer hs.events.unsubscribe(s)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Event stream is opened.",
+		map[string]string{
+			"component.name": "httpserver",
+		})
+
+	keepalive := time.NewTicker(EVENT_STREAM_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.dropped:
+			hs.logger.LogWithFields(
+				logrus.WarnLevel,
+				"Event stream is closed since the subscriber is too slow.",
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			return
+		case event := <-s.events:
+			err = writeServerSentEvent(w, event.Type, event)
+		case <-keepalive.C:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(
+	w http.ResponseWriter,
+	eventType string,
+	body interface{},
+) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("event: " + eventType + "\ndata: " + string(data) + "\n\n"))
+	return err
+}
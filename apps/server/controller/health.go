@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"net/http"
+	"sync"
+)
+
+const (
+	HEALTH_STATUS_OK       = "ok"
+	HEALTH_STATUS_STARTING = "starting"
+	HEALTH_STATUS_FAILED   = "failed"
+)
+
+// Names of the listeners whose state the probes report.
+const (
+	LISTENER_HTTP      = "http"
+	LISTENER_WEBSOCKET = "websocket"
+)
+
+// Outcome of a probe together with the checks it is based on.
+type healthResult struct {
+	Status string                  `json:"status"`
+	Checks map[string]*healthCheck `json:"checks"`
+}
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Tracks the state of the listeners and checks the store for the
+// probes of the server.
+type serverHealth struct {
+	store     store
+	listeners map[string]*healthCheck
+	mutex     *sync.Mutex
+}
+
+func newServerHealth(
+	st store,
+) *serverHealth {
+	return &serverHealth{
+		store: st,
+		listeners: map[string]*healthCheck{
+			LISTENER_HTTP:      {Status: HEALTH_STATUS_STARTING},
+			LISTENER_WEBSOCKET: {Status: HEALTH_STATUS_STARTING},
+		},
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (sh *serverHealth) listening(
+	name string,
+) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	sh.listeners[name] = &healthCheck{Status: HEALTH_STATUS_OK}
+}
+
+func (sh *serverHealth) listenerFailed(
+	name string,
+	err error,
+) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	sh.listeners[name] = &healthCheck{Status: HEALTH_STATUS_FAILED, Error: err.Error()}
+}
+
+// Returns the result of the checks. Listeners which are still starting
+// only fail the readiness.
+func (sh *serverHealth) check(
+	readiness bool,
+) *healthResult {
+	result := &healthResult{
+		Status: HEALTH_STATUS_OK,
+		Checks: map[string]*healthCheck{},
+	}
+
+	sh.mutex.Lock()
+	for name, listener := range sh.listeners {
+		result.Checks[name] = listener
+		if listener.Status == HEALTH_STATUS_FAILED ||
+			(readiness && listener.Status != HEALTH_STATUS_OK) {
+			result.Status = HEALTH_STATUS_FAILED
+		}
+	}
+	sh.mutex.Unlock()
+
+	err := sh.store.ping()
+	if err != nil {
+		result.Checks["store"] = &healthCheck{Status: HEALTH_STATUS_FAILED, Error: err.Error()}
+		result.Status = HEALTH_STATUS_FAILED
+	} else {
+		result.Checks["store"] = &healthCheck{Status: HEALTH_STATUS_OK}
+	}
+	return result
+}
+
+// Reports whether the listeners did not fail and the store is
+// reachable.
+func (hs *HttpServer) handleHealthz(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	hs.writeHealth(w, hs.health.check(false))
+}
+
+// Reports whether the listeners accept connections and the store is
+// reachable.
+func (hs *HttpServer) handleReadyz(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	hs.writeHealth(w, hs.health.check(true))
+}
+
+func (hs *HttpServer) writeHealth(
+	w http.ResponseWriter,
+	result *healthResult,
+) {
+	statusCode := http.StatusOK
+	if result.Status != HEALTH_STATUS_OK {
+		statusCode = http.StatusServiceUnavailable
+	}
+	hs.writeJson(w, statusCode, result)
+}
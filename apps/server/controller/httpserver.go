@@ -1,57 +1,111 @@
 package controller
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
 )
 
-type webSocketSynchronizer struct {
-	isReady bool
-	mutex   sync.Mutex
-}
-
 type HttpServer struct {
-	logger                *logger.Logger
-	webSocketReadyChannel chan bool
-	webSocketSynchronizer *webSocketSynchronizer
-	controllerChannel     chan bool
-	wg                    *sync.WaitGroup
-	port                  string
+	logger        *logger.Logger
+	registry      *clientRegistry
+	commands      *commandTracker
+	dispatcher    *commandDispatcher
+	scheduler     *scheduler
+	escalator     *alertEscalator
+	rules         *ruleEngine
+	events        *eventBus
+	metrics       *serverMetrics
+	health        *serverHealth
+	store         store
+	authenticator *authenticator
+	enroller      *enroller
+	// Proxies whose X-Forwarded-For is trusted for the audit trail
+	trustedProxies []*net.IPNet
+	wg             *sync.WaitGroup
+	port           string
+	server         *http.Server
 }
 
 func newHttpServer(
 	logger *logger.Logger,
 	wg *sync.WaitGroup,
-	webSocketReadyChannel chan bool,
-	controllerChannel chan bool,
+	registry *clientRegistry,
+	commands *commandTracker,
+	dispatcher *commandDispatcher,
+	scheduler *scheduler,
+	escalator *alertEscalator,
+	rules *ruleEngine,
+	events *eventBus,
+	metrics *serverMetrics,
+	health *serverHealth,
+	store store,
+	authenticator *authenticator,
+	enroller *enroller,
+	trustedProxies []*net.IPNet,
 	port string,
 ) *HttpServer {
-
-	webSocketSynchronizer := &webSocketSynchronizer{
-		isReady: false,
-		mutex:   sync.Mutex{},
-	}
-
 	return &HttpServer{
-		logger:                logger,
-		webSocketReadyChannel: webSocketReadyChannel,
-		webSocketSynchronizer: webSocketSynchronizer,
-		controllerChannel:     controllerChannel,
-		wg:                    wg,
-		port:                  port,
+		logger:         logger,
+		registry:       registry,
+		commands:       commands,
+		dispatcher:     dispatcher,
+		scheduler:      scheduler,
+		escalator:      escalator,
+		rules:          rules,
+		events:         events,
+		metrics:        metrics,
+		health:         health,
+		store:          store,
+		authenticator:  authenticator,
+		enroller:       enroller,
+		trustedProxies: trustedProxies,
+		wg:             wg,
+		port:           port,
+		server:         &http.Server{},
 	}
 }
 
 func (hs *HttpServer) run() {
 	defer hs.wg.Done()
 
-	go hs.synchronizeWebSocketConnection()
-
-	http.Handle("/control", http.HandlerFunc(hs.handleTelemetryCollection))
+	mux := http.NewServeMux()
+	mux.Handle("/control", hs.audited("set_mode", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleTelemetryCollection)))
+	mux.Handle("/clients", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleClients))
+	mux.Handle("/clients/{id}/control", hs.audited("set_mode", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleClientTelemetryCollection)))
+	mux.Handle("/clients/{id}/history", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleClientHistory))
+	mux.Handle("/events", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleEvents))
+	mux.Handle("/clients/{id}/revoke", hs.audited("revoke_client", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleClientRevoke)))
+	mux.Handle("/commands/{id}", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleCommand))
+	mux.Handle("/schedules", hs.audited("create_schedule", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleSchedules)))
+	mux.Handle("/schedules/{id}", hs.audited("delete_schedule", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleSchedule)))
+	mux.Handle("/rules", hs.audited("create_rule", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleRules)))
+	mux.Handle("/rules/{id}", hs.audited("delete_rule", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleRule)))
+	mux.Handle("/profiles", hs.audited("create_profile", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleProfiles)))
+	mux.Handle("/profiles/{name}", hs.audited("delete_profile", hs.authorized(ROLE_VIEWER, ROLE_OPERATOR, hs.handleProfile)))
+	mux.Handle("/alerts", hs.audited("escalate_alert", hs.authorized(ROLE_OPERATOR, ROLE_OPERATOR, hs.handleAlerts)))
+	mux.Handle("/alerts/alertmanager", hs.audited("escalate_alert", hs.authorized(ROLE_OPERATOR, ROLE_OPERATOR, hs.handleAlertmanagerAlerts)))
+	mux.Handle("/audit", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleAudit))
+	mux.Handle("/audit/export", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleAuditExport))
+	mux.Handle("/tokens", hs.audited("create_token", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleTokens)))
+	mux.Handle("/tokens/{id}", hs.audited("delete_token", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleToken)))
+	mux.Handle("/enrollment-tokens", hs.audited("create_enrollment_token", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleEnrollmentTokens)))
+	mux.Handle("/enrollment-tokens/{id}", hs.audited("delete_enrollment_token", hs.authorized(ROLE_ADMIN, ROLE_ADMIN, hs.handleEnrollmentToken)))
+	mux.Handle("GET /metrics", hs.authorized(ROLE_VIEWER, ROLE_VIEWER, hs.metrics.handler().ServeHTTP))
+	mux.HandleFunc("GET /healthz", hs.handleHealthz)
+	mux.HandleFunc("GET /readyz", hs.handleReadyz)
+	mux.Handle("GET /dashboard/", hs.dashboard())
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
 
 	hs.logger.LogWithFields(
 		logrus.InfoLevel,
@@ -59,19 +113,40 @@ func (hs *HttpServer) run() {
 		map[string]string{
 			"component.name": "httpserver",
 		})
-	err := http.ListenAndServe("localhost:"+hs.port, nil)
-	if err != nil {
+	// The event streams are ended once the server shuts down since it
+	// does not wait for them otherwise
+	streams, endStreams := context.WithCancel(context.Background())
+	hs.server.Handler = hs.metrics.instrument(mux)
+	hs.server.BaseContext = func(net.Listener) context.Context {
+		return streams
+	}
+	hs.server.RegisterOnShutdown(endStreams)
+
+	listener, err := net.Listen("tcp", "localhost:"+hs.port)
+	if err == nil {
+		hs.health.listening(LISTENER_HTTP)
+		err = hs.server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		hs.health.listenerFailed(LISTENER_HTTP, err)
 		fmt.Println(err)
 	}
 }
 
+// Stops accepting requests and waits for the ones in progress.
+func (hs *HttpServer) shutdown(
+	ctx context.Context,
+) error {
+	return hs.server.Shutdown(ctx)
+}
+
 func (hs *HttpServer) handleTelemetryCollection(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
 
-	if !hs.isWebSocketReady() {
-		msg := "Web socket connection is not yet established!"
+	if hs.registry.count() == 0 {
+		msg := "No client is connected!"
 		hs.logger.LogWithFields(
 			logrus.ErrorLevel,
 			msg,
@@ -83,75 +158,375 @@ func (hs *HttpServer) handleTelemetryCollection(
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPost:
-		hs.controllerChannel <- true
+	mode, ttl, ok := hs.parseControlRequest(w, r)
+	if !ok {
+		return
+	}
 
-		msg := "Signal is sent to the client to run the collector."
+	entry := auditEntryOf(r)
+	commands := []*command{}
+	for _, client := range hs.registry.list() {
+		entry.Targets = append(entry.Targets, client.Id)
+		c, err := hs.dispatcher.setMode(client.Id, mode, ttl, commandReason("requested for all clients via the control API", entry.Reason, entry.Ticket))
+		if err != nil {
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Signal could not be queued for the client.",
+				map[string]string{
+					"component.name": "httpserver",
+					"client.id":      client.Id,
+					"error.message":  err.Error(),
+				})
+			entry.FailedTargets = append(entry.FailedTargets, client.Id)
+		}
+		if c == nil {
+			// The client disconnected in the meantime or the server shuts
+			// down, no command is created for it
+			now := time.Now().UTC()
+			commands = append(commands, &command{
+				ClientId:  client.Id,
+				Type:      protocol.MessageTypeSetMode,
+				Mode:      mode,
+				Status:    protocol.CommandStatusFailed,
+				Error:     err.Error(),
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+			continue
+		}
+		commands = append(commands, c)
+		entry.CommandIds = append(entry.CommandIds, c.Id)
+	}
+
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Signal is sent to the clients.",
+		map[string]string{
+			"component.name": "httpserver",
+			"otelcol.mode":   string(mode),
+		})
+	hs.writeJson(w, http.StatusAccepted, commands)
+}
+
+func (hs *HttpServer) handleClientTelemetryCollection(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	clientId := r.PathValue("id")
+	entry := auditEntryOf(r)
+	entry.Targets = []string{clientId}
+
+	mode, ttl, ok := hs.parseControlRequest(w, r)
+	if !ok {
+		return
+	}
+
+	c, err := hs.dispatcher.setMode(clientId, mode, ttl, commandReason("requested via the control API", entry.Reason, entry.Ticket))
+	if c != nil {
+		entry.CommandIds = []string{c.Id}
+	}
+	if errors.Is(err, errClientNotFound) {
+		msg := "Client is not connected!"
 		hs.logger.LogWithFields(
-			logrus.InfoLevel,
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"client.id":      clientId,
+			})
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+	if err != nil {
+		msg := "Signal could not be queued for the client!"
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
 			msg,
 			map[string]string{
 				"component.name": "httpserver",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
 			})
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(msg))
+		return
+	}
 
-	case http.MethodDelete:
-		hs.controllerChannel <- false
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Signal is sent to the client.",
+		map[string]string{
+			"component.name":     "httpserver",
+			"client.id":          clientId,
+			"message.command.id": c.Id,
+			"otelcol.mode":       string(mode),
+			"otelcol.mode.ttl":   ttl.String(),
+		})
+	hs.writeJson(w, http.StatusAccepted, c)
+}
 
-		msg := "Signal is sent to the client to stop the collector."
+func (hs *HttpServer) handleCommand(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet {
+		msg := "HTTP request method is not allowed."
 		hs.logger.LogWithFields(
-			logrus.InfoLevel,
+			logrus.ErrorLevel,
 			msg,
 			map[string]string{
-				"component.name": "httpserver",
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+
+	c, ok := hs.commands.get(r.PathValue("id"))
+	if !ok {
+		msg := "Command is not found!"
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":     "httpserver",
+				"message.command.id": r.PathValue("id"),
 			})
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(msg))
+		return
+	}
+	hs.writeJson(w, http.StatusOK, c)
+}
 
+type controlRequest struct {
+	Ttl     string `json:"ttl"`
+	Reason  string `json:"reason"`
+	Ticket  string `json:"ticket"`
+	Profile string `json:"profile"`
+}
+
+// Parses the requested mode from the request method. POST switches
+// the collector to debug, DELETE back to default. The debug mode can
+// be time-boxed with a TTL in the request body, e.g. {"ttl":"30m"}.
+// The reason and the ticket of the change are written to the audit
+// trail. A profile fills in the values which are not given.
+func (hs *HttpServer) parseControlRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+) (
+	protocol.Mode,
+	time.Duration,
+	bool,
+) {
+	var mode protocol.Mode
+	switch r.Method {
+	case http.MethodPost:
+		mode = protocol.ModeDebug
+	case http.MethodDelete:
+		mode = protocol.ModeDefault
 	default:
 		msg := "Request is not valid!"
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(msg))
+		return "", 0, false
+	}
+
+	// The request body is optional
+	requestBody := &controlRequest{}
+	err := json.NewDecoder(r.Body).Decode(requestBody)
+	if err != nil && !errors.Is(err, io.EOF) {
+		msg := "HTTP request body parsing failed."
 		hs.logger.LogWithFields(
 			logrus.ErrorLevel,
 			msg,
 			map[string]string{
 				"component.name": "httpserver",
+				"error.message":  err.Error(),
 			})
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(msg))
-		return
+		return "", 0, false
 	}
-}
 
-func (hs *HttpServer) synchronizeWebSocketConnection() {
-	for isReady := range hs.webSocketReadyChannel {
-		if isReady {
+	entry := auditEntryOf(r)
+	entry.Profile = requestBody.Profile
+	if requestBody.Profile != "" {
+		p, ok, err := hs.store.getProfile(requestBody.Profile)
+		if err != nil || !ok {
+			msg := "Profile is not found!"
+			statusCode := http.StatusBadRequest
+			if err != nil {
+				msg = "Profile could not be loaded."
+				statusCode = http.StatusInternalServerError
+			}
 			hs.logger.LogWithFields(
-				logrus.InfoLevel,
-				"Web socket connection is established.",
+				logrus.ErrorLevel,
+				msg,
 				map[string]string{
 					"component.name": "httpserver",
+					"profile.name":   requestBody.Profile,
 				})
+			w.WriteHeader(statusCode)
+			w.Write([]byte(msg))
+			return "", 0, false
+		}
+		requestBody.applyProfile(p, mode == protocol.ModeDebug)
+	}
+
+	entry.Mode = mode
+	entry.Ttl = requestBody.Ttl
+	entry.Reason = requestBody.Reason
+	entry.Ticket = requestBody.Ticket
 
-		} else {
+	var ttl time.Duration
+	if requestBody.Ttl != "" {
+		ttl, err = time.ParseDuration(requestBody.Ttl)
+		if err != nil || ttl <= 0 || mode != protocol.ModeDebug {
+			msg := "TTL is not valid!"
 			hs.logger.LogWithFields(
 				logrus.ErrorLevel,
-				"Web socket connection is lost.",
+				msg,
 				map[string]string{
 					"component.name": "httpserver",
+					"otelcol.mode":   string(mode),
+					"ttl":            requestBody.Ttl,
 				})
-			return
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return "", 0, false
 		}
+	}
+	return mode, ttl, true
+}
+
+func (hs *HttpServer) handleClients(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+
+	clients := hs.registry.list()
+	for _, client := range clients {
+		if ds, ok := hs.dispatcher.getDesiredState(client.Id); ok {
+			client.DesiredMode = ds.Mode
+		}
+	}
+	hs.writeJson(w, http.StatusOK, clients)
+}
+
+// Appends the reason and the ticket which are given by the SRE to the
+// reason of the command so that they show up in the client history.
+func commandReason(
+	reason string,
+	detail string,
+	ticket string,
+) string {
+	if detail != "" {
+		reason += ": " + detail
+	}
+	if ticket != "" {
+		reason += " (" + ticket + ")"
+	}
+	return reason
+}
+
+type clientHistory struct {
+	Client *clientRecord  `json:"client"`
+	Events []*clientEvent `json:"events"`
+}
 
-		hs.webSocketSynchronizer.mutex.Lock()
-		hs.webSocketSynchronizer.isReady = isReady
-		hs.webSocketSynchronizer.mutex.Unlock()
+// Returns the timeline of the client: when it connected, which modes it
+// was in and why. The history is kept after the client disconnects.
+func (hs *HttpServer) handleClientHistory(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
 	}
+
+	clientId := r.PathValue("id")
+	record, events, err := hs.registry.history(clientId)
+	if errors.Is(err, errClientNotFound) {
+		msg := "Client is not found!"
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+	if err != nil {
+		msg := "Client history could not be loaded."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return
+	}
+
+	hs.writeJson(w, http.StatusOK, &clientHistory{
+		Client: record,
+		Events: events,
+	})
 }
 
-func (hs *HttpServer) isWebSocketReady() bool {
-	hs.webSocketSynchronizer.mutex.Lock()
-	defer hs.webSocketSynchronizer.mutex.Unlock()
-	return hs.webSocketSynchronizer.isReady
+func (hs *HttpServer) writeJson(
+	w http.ResponseWriter,
+	statusCode int,
+	body interface{},
+) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		msg := "HTTP response body creation failed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"error.message":  err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
 }
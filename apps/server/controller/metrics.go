@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+const METRICS_NAMESPACE = "rct"
+
+const (
+	MESSAGE_DIRECTION_RECEIVED = "received"
+	MESSAGE_DIRECTION_SENT     = "sent"
+)
+
+// Types of the OpAMP messages in the message metrics. The messages of
+// the custom protocol are labeled with their own type.
+const (
+	OPAMP_MESSAGE_TYPE_AGENT_TO_SERVER = "agent_to_server"
+	OPAMP_MESSAGE_TYPE_SERVER_TO_AGENT = "server_to_agent"
+)
+
+// Label of the message types and modes which the clients send but the
+// protocol does not know, so that they cannot create any number of
+// series.
+const METRICS_LABEL_UNKNOWN = "unknown"
+
+var knownMessageTypes = map[protocol.MessageType]bool{
+	protocol.MessageTypeHello:            true,
+	protocol.MessageTypeSetMode:          true,
+	protocol.MessageTypeAck:              true,
+	protocol.MessageTypeState:            true,
+	protocol.MessageTypeModeExpired:      true,
+	protocol.MessageTypeError:            true,
+	protocol.MessageTypeEnrolled:         true,
+	protocol.MessageTypeHealth:           true,
+	protocol.MessageTypeCollectorCrashed: true,
+}
+
+// Reasons why the connection of a client is not established.
+const (
+	HANDSHAKE_FAILURE_UNAUTHENTICATED = "unauthenticated"
+	HANDSHAKE_FAILURE_UPGRADE         = "upgrade"
+	HANDSHAKE_FAILURE_HELLO           = "hello"
+	HANDSHAKE_FAILURE_ENROLLMENT      = "enrollment"
+)
+
+// Metrics of the server itself, exposed in the Prometheus format so
+// that the control plane can be alerted on.
+type serverMetrics struct {
+	registry            *prometheus.Registry
+	commandsIssued      *prometheus.CounterVec
+	commandsFinished    *prometheus.CounterVec
+	messages            *prometheus.CounterVec
+	messageSize         *prometheus.HistogramVec
+	handshakeFailures   *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+}
+
+func newServerMetrics(
+	clients *clientRegistry,
+) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		commandsIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "commands_issued_total",
+			Help:      "Commands which are issued to the clients.",
+		}, []string{"type", "mode"}),
+		commandsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "commands_finished_total",
+			Help:      "Commands which reached a final status, either applied, failed or superseded.",
+		}, []string{"type", "status"}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "websocket_messages_total",
+			Help:      "Messages which are exchanged with the clients.",
+		}, []string{"transport", "direction", "type"}),
+		messageSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "websocket_message_size_bytes",
+			Help:      "Size of the messages which are exchanged with the clients.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 7),
+		}, []string{"transport", "direction"}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "websocket_handshake_failures_total",
+			Help:      "Connections of the clients which are not established.",
+		}, []string{"transport", "reason"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of the requests to the HTTP API. The event streams are not included.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newClientCollector(clients),
+		m.commandsIssued,
+		m.commandsFinished,
+		m.messages,
+		m.messageSize,
+		m.handshakeFailures,
+		m.httpRequestDuration,
+	)
+	return m
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *serverMetrics) commandIssued(
+	c *command,
+) {
+	m.commandsIssued.WithLabelValues(string(c.Type), string(c.Mode)).Inc()
+}
+
+func (m *serverMetrics) commandFinished(
+	c *command,
+) {
+	m.commandsFinished.WithLabelValues(string(c.Type), string(c.Status)).Inc()
+}
+
+func (m *serverMetrics) message(
+	transport string,
+	direction string,
+	messageType string,
+	size int,
+) {
+	m.messages.WithLabelValues(transport, direction, messageType).Inc()
+	m.messageSize.WithLabelValues(transport, direction).Observe(float64(size))
+}
+
+func (m *serverMetrics) handshakeFailed(
+	transport string,
+	reason string,
+) {
+	m.handshakeFailures.WithLabelValues(transport, reason).Inc()
+}
+
+// Wraps the mux so that the duration of every request is recorded per
+// route. The route is the pattern which the request matched.
+func (m *serverMetrics) instrument(
+	mux *http.ServeMux,
+) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+
+		// The event streams are open as long as they are followed
+		if recorder.Header().Get("Content-Type") == "text/event-stream" {
+			return
+		}
+
+		_, route := mux.Handler(r)
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		m.httpRequestDuration.WithLabelValues(r.Method, route, strconv.Itoa(recorder.statusCode)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Reports the connected clients from the registry when it is scraped.
+type clientCollector struct {
+	registry  *clientRegistry
+	connected *prometheus.Desc
+	byMode    *prometheus.Desc
+}
+
+func newClientCollector(
+	registry *clientRegistry,
+) *clientCollector {
+	return &clientCollector{
+		registry: registry,
+		connected: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "", "clients_connected"),
+			"Clients which are connected.",
+			nil, nil,
+		),
+		byMode: prometheus.NewDesc(
+			prometheus.BuildFQName(METRICS_NAMESPACE, "", "clients"),
+			"Clients which are connected per transport and mode.",
+			[]string{"transport", "mode"}, nil,
+		),
+	}
+}
+
+func (cc *clientCollector) Describe(
+	ch chan<- *prometheus.Desc,
+) {
+	ch <- cc.connected
+	ch <- cc.byMode
+}
+
+func (cc *clientCollector) Collect(
+	ch chan<- prometheus.Metric,
+) {
+	// Every combination is reported so that the series do not vanish
+	clients := cc.registry.list()
+	counts := map[[2]string]int{}
+	for _, transport := range []string{TRANSPORT_WEBSOCKET, TRANSPORT_OPAMP} {
+		for _, mode := range []protocol.Mode{protocol.ModeDefault, protocol.ModeDebug} {
+			counts[[2]string{transport, string(mode)}] = 0
+		}
+	}
+	for _, c := range clients {
+		counts[[2]string{c.Transport, modeLabel(c.Mode)}]++
+	}
+
+	ch <- prometheus.MustNewConstMetric(cc.connected, prometheus.GaugeValue, float64(len(clients)))
+	for labels, count := range counts {
+		ch <- prometheus.MustNewConstMetric(cc.byMode, prometheus.GaugeValue, float64(count), labels[0], labels[1])
+	}
+}
+
+func messageTypeLabel(
+	messageType protocol.MessageType,
+) string {
+	if !knownMessageTypes[messageType] {
+		return METRICS_LABEL_UNKNOWN
+	}
+	return string(messageType)
+}
+
+func modeLabel(
+	mode protocol.Mode,
+) string {
+	if mode != protocol.ModeDefault && mode != protocol.ModeDebug {
+		return METRICS_LABEL_UNKNOWN
+	}
+	return string(mode)
+}
@@ -0,0 +1,701 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+	"github.com/open-telemetry/opamp-go/server/types"
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+const OPAMP_PATH = "/v1/opamp"
+
+type opampAgent struct {
+	client      *registeredClient
+	conn        types.Connection
+	instanceUid []byte
+	mode        *protocol.Mode
+	// Commands which are sent as remote config, keyed by config hash
+	configHashes map[string]string
+	mutex        *sync.Mutex
+}
+
+// Serves the OpAMP agents next to the clients which use the custom web
+// socket protocol. The agents are kept in the same registry so that
+// they are controlled through the same HTTP API. The mode is sent to
+// them as a remote config file and their remote config status is
+// reported as the acknowledgement of the command.
+type opampServer struct {
+	logger      *logger.Logger
+	registry    *clientRegistry
+	commands    *commandTracker
+	dispatcher  *commandDispatcher
+	rules       *ruleEngine
+	enroller    *enroller
+	metrics     *serverMetrics
+	handler     server.HTTPHandlerFunc
+	connContext server.ConnContext
+	agents      map[types.Connection]*opampAgent
+	// Agents which are registered, the shutdown waits for them to be
+	// unregistered
+	connections *sync.WaitGroup
+	isClosing   bool
+	mutex       *sync.Mutex
+}
+
+func newOpampServer(
+	logger *logger.Logger,
+	registry *clientRegistry,
+	commands *commandTracker,
+	dispatcher *commandDispatcher,
+	rules *ruleEngine,
+	enroller *enroller,
+	metrics *serverMetrics,
+) *opampServer {
+	ops := &opampServer{
+		logger:      logger,
+		registry:    registry,
+		commands:    commands,
+		dispatcher:  dispatcher,
+		rules:       rules,
+		enroller:    enroller,
+		metrics:     metrics,
+		agents:      map[types.Connection]*opampAgent{},
+		connections: &sync.WaitGroup{},
+		mutex:       &sync.Mutex{},
+	}
+
+	handler, connContext, err := server.New(&opampLogger{logger: logger}).Attach(
+		server.Settings{
+			Callbacks: types.Callbacks{
+				OnConnecting: func(r *http.Request) types.ConnectionResponse {
+					// Only the enrolled agents and the ones which enroll
+					// are accepted
+					admission, err := ops.enroller.admit(r)
+					if err != nil {
+						ops.logger.LogWithFields(
+							logrus.ErrorLevel,
+							"Agent is not authenticated: "+err.Error(),
+							map[string]string{
+								"component.name":  "opampserver",
+								"client.address":  r.RemoteAddr,
+								"client.identity": peerIdentity(r.TLS),
+							})
+						ops.metrics.handshakeFailed(TRANSPORT_OPAMP, HANDSHAKE_FAILURE_UNAUTHENTICATED)
+						return types.ConnectionResponse{
+							Accept:         false,
+							HTTPStatusCode: http.StatusUnauthorized,
+							HTTPResponseHeader: map[string]string{
+								"WWW-Authenticate": `Bearer realm="remotely-controlled-telemetry"`,
+							},
+						}
+					}
+
+					return types.ConnectionResponse{
+						Accept: true,
+						ConnectionCallbacks: types.ConnectionCallbacks{
+							OnMessage: func(ctx context.Context, conn types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+								ops.metrics.message(TRANSPORT_OPAMP, MESSAGE_DIRECTION_RECEIVED, OPAMP_MESSAGE_TYPE_AGENT_TO_SERVER, proto.Size(message))
+								response := ops.onMessage(ctx, conn, message, admission)
+								ops.metrics.message(TRANSPORT_OPAMP, MESSAGE_DIRECTION_SENT, OPAMP_MESSAGE_TYPE_SERVER_TO_AGENT, proto.Size(response))
+								return response
+							},
+							OnConnectionClose: ops.onConnectionClose,
+						},
+					}
+				},
+			},
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	ops.handler = handler
+	ops.connContext = connContext
+	return ops
+}
+
+// Sends the message to the agent outside of a response and records it
+// in the metrics.
+func (ops *opampServer) send(
+	agent *opampAgent,
+	message *protobufs.ServerToAgent,
+) error {
+	ops.metrics.message(TRANSPORT_OPAMP, MESSAGE_DIRECTION_SENT, OPAMP_MESSAGE_TYPE_SERVER_TO_AGENT, proto.Size(message))
+	return agent.conn.Send(context.Background(), message)
+}
+
+// Handles the message of the agent. The ID which the credential or the
+// client certificate is bound to, if any, is used as the client ID.
+func (ops *opampServer) onMessage(
+	ctx context.Context,
+	conn types.Connection,
+	message *protobufs.AgentToServer,
+	admission *admission,
+) *protobufs.ServerToAgent {
+	response := &protobufs.ServerToAgent{
+		InstanceUid: message.InstanceUid,
+		Capabilities: uint64(protobufs.ServerCapabilities_ServerCapabilities_AcceptsStatus |
+			protobufs.ServerCapabilities_ServerCapabilities_OffersRemoteConfig |
+			protobufs.ServerCapabilities_ServerCapabilities_AcceptsEffectiveConfig |
+			protobufs.ServerCapabilities_ServerCapabilities_OffersConnectionSettings),
+	}
+
+	ops.mutex.Lock()
+	agent, ok := ops.agents[conn]
+	ops.mutex.Unlock()
+
+	if !ok {
+		var credential string
+		var err error
+		agent, credential, err = ops.register(conn, message, admission)
+		if err != nil {
+			ops.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Agent could not be enrolled.",
+				map[string]string{
+					"component.name": "opampserver",
+					"error.message":  err.Error(),
+				})
+			ops.metrics.handshakeFailed(TRANSPORT_OPAMP, HANDSHAKE_FAILURE_ENROLLMENT)
+			conn.Disconnect()
+			return &protobufs.ServerToAgent{
+				InstanceUid: message.InstanceUid,
+				ErrorResponse: &protobufs.ServerErrorResponse{
+					Type:         protobufs.ServerErrorResponseType_ServerErrorResponseType_BadRequest,
+					ErrorMessage: err.Error(),
+				},
+			}
+		}
+
+		// The credential is offered as the connection settings which
+		// the agent uses for its next connections
+		if credential != "" {
+			response.ConnectionSettings = newOpampCredentialOffer(credential)
+		}
+
+		// The description is needed for the registry
+		if message.AgentDescription == nil {
+			response.Flags = uint64(protobufs.ServerToAgentFlags_ServerToAgentFlags_ReportFullState)
+		}
+	} else {
+		ops.registry.touch(agent.client.id)
+		if message.AgentDescription != nil {
+			hello := newOpampHelloPayload(agent.client.id, message.AgentDescription)
+			hello.InstanceId = agent.client.id
+			ops.registry.updateMetadata(agent.client.id, hello)
+		}
+	}
+
+	if message.Health != nil {
+		ops.registry.updateHealth(agent.client.id, &agentHealth{
+			Healthy:   message.Health.Healthy,
+			Status:    message.Health.Status,
+			LastError: message.Health.LastError,
+		})
+	}
+
+	if message.RemoteConfigStatus != nil {
+		ops.acknowledge(agent, message.RemoteConfigStatus)
+	}
+
+	if message.CustomMessage != nil {
+		ops.receiveCustomMessage(agent, message.CustomMessage)
+	}
+
+	if message.EffectiveConfig != nil {
+		mode := parseOpampMode(message.EffectiveConfig)
+
+		agent.mutex.Lock()
+		isChanged := agent.mode == nil || *agent.mode != mode
+		agent.mode = &mode
+		agent.mutex.Unlock()
+
+		if isChanged {
+			ops.registry.updateMode(agent.client.id, mode)
+			ops.dispatcher.reconcile(agent.client.id, mode)
+		}
+	}
+
+	return response
+}
+
+func (ops *opampServer) onConnectionClose(
+	conn types.Connection,
+) {
+	ops.mutex.Lock()
+	agent, ok := ops.agents[conn]
+	delete(ops.agents, conn)
+	ops.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	ops.logger.LogWithFields(
+		logrus.ErrorLevel,
+		"OpAMP connection is lost.",
+		map[string]string{
+			"component.name": "opampserver",
+			"client.id":      agent.client.id,
+		})
+	ops.registry.unregister(agent.client)
+	ops.connections.Done()
+}
+
+// Disconnects the agents and waits for them to be unregistered. The
+// OpAMP server does not expose the web socket, so no close frame is
+// sent and the agents reconnect as after a lost connection.
+func (ops *opampServer) shutdown(
+	ctx context.Context,
+) error {
+	ops.mutex.Lock()
+	ops.isClosing = true
+	conns := make([]types.Connection, 0, len(ops.agents))
+	for conn := range ops.agents {
+		conns = append(conns, conn)
+	}
+	ops.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Disconnect()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ops.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Registers the agent on its first message. If the agent connected
+// with an enrollment token, it is enrolled and its credential returned.
+func (ops *opampServer) register(
+	conn types.Connection,
+	message *protobufs.AgentToServer,
+	admission *admission,
+) (
+	*opampAgent,
+	string,
+	error,
+) {
+	hello := newOpampHelloPayload(formatInstanceUid(message.InstanceUid), message.AgentDescription)
+	if admission.clientId != "" {
+		hello.InstanceId = admission.clientId
+	}
+	clientId := hello.InstanceId
+
+	credential := ""
+	if admission.isEnrolling() {
+		var err error
+		credential, err = ops.enroller.enroll(clientId, admission)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	agent := &opampAgent{
+		client:       ops.registry.register(clientId, TRANSPORT_OPAMP, hello),
+		conn:         conn,
+		instanceUid:  message.InstanceUid,
+		configHashes: map[string]string{},
+		mutex:        &sync.Mutex{},
+	}
+
+	ops.mutex.Lock()
+	if ops.isClosing {
+		ops.mutex.Unlock()
+		ops.registry.unregister(agent.client)
+		return nil, "", errServerShuttingDown
+	}
+	ops.agents[conn] = agent
+	ops.connections.Add(1)
+	ops.mutex.Unlock()
+
+	ops.logger.LogWithFields(
+		logrus.InfoLevel,
+		"OpAMP connection is established.",
+		map[string]string{
+			"component.name":      "opampserver",
+			"client.id":           clientId,
+			"client.hostname":     hello.Hostname,
+			"client.os":           hello.Os,
+			"client.arch":         hello.Arch,
+			"client.version":      hello.ClientVersion,
+			"client.service.name": hello.ServiceName,
+		})
+
+	go ops.push(agent)
+
+	// Restore the desired state of the agent, if it has drifted. The
+	// agents which do not report their effective config are considered
+	// to be in default mode.
+	if message.EffectiveConfig == nil {
+		ops.dispatcher.reconcile(clientId, protocol.ModeDefault)
+	}
+	return agent, credential, nil
+}
+
+// Sends the queued messages of the agent until it disconnects.
+func (ops *opampServer) push(
+	agent *opampAgent,
+) {
+	for {
+		select {
+		case <-agent.client.done:
+			if agent.client.isRevoked {
+				ops.logger.LogWithFields(
+					logrus.InfoLevel,
+					"OpAMP connection is closed since the client is revoked.",
+					map[string]string{
+						"component.name": "opampserver",
+						"client.id":      agent.client.id,
+					})
+				agent.conn.Disconnect()
+			}
+			return
+
+		case message := <-agent.client.sendQueue:
+			if message.Type != protocol.MessageTypeSetMode {
+				ops.logger.LogWithFields(
+					logrus.DebugLevel,
+					"Message type is not supported by OpAMP, skipping.",
+					map[string]string{
+						"component.name": "opampserver",
+						"client.id":      agent.client.id,
+						"message.type":   string(message.Type),
+					})
+				continue
+			}
+
+			err := ops.sendRemoteConfig(agent, message)
+			if err != nil {
+				ops.logger.LogWithFields(
+					logrus.ErrorLevel,
+					"Error occurred during sending remote config to the agent.",
+					map[string]string{
+						"component.name":     "opampserver",
+						"client.id":          agent.client.id,
+						"message.command.id": message.CommandId,
+						"error.message":      err.Error(),
+					})
+				ops.commands.update(message.CommandId, agent.client.id, protocol.CommandStatusFailed, err.Error())
+			}
+		}
+	}
+}
+
+func (ops *opampServer) sendRemoteConfig(
+	agent *opampAgent,
+	message *protocol.Envelope,
+) error {
+	payload := &protocol.SetModePayload{}
+	err := message.DecodePayload(payload)
+	if err != nil {
+		return err
+	}
+
+	body, err := yaml.Marshal(protocol.NewOpampModeConfig(message.CommandId, payload.Mode, payload.Ttl, payload.Signature))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+
+	agent.mutex.Lock()
+	agent.configHashes[hex.EncodeToString(hash[:])] = message.CommandId
+	agent.mutex.Unlock()
+
+	ops.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Sending remote config to the agent.",
+		map[string]string{
+			"component.name":     "opampserver",
+			"client.id":          agent.client.id,
+			"message.command.id": message.CommandId,
+			"otelcol.mode":       string(payload.Mode),
+		})
+
+	return ops.send(agent, &protobufs.ServerToAgent{
+		InstanceUid: agent.instanceUid,
+		RemoteConfig: &protobufs.AgentRemoteConfig{
+			Config: &protobufs.AgentConfigMap{
+				ConfigMap: map[string]*protobufs.AgentConfigFile{
+					protocol.OpampModeConfigName: {
+						Body:        body,
+						ContentType: protocol.OpampModeConfigContentType,
+					},
+				},
+			},
+			ConfigHash: hash[:],
+		},
+	})
+}
+
+// Maps the remote config status of the agent to the status of the
+// command which the config is sent for.
+func (ops *opampServer) acknowledge(
+	agent *opampAgent,
+	status *protobufs.RemoteConfigStatus,
+) {
+	agent.mutex.Lock()
+	commandId, ok := agent.configHashes[hex.EncodeToString(status.LastRemoteConfigHash)]
+	agent.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	var commandStatus protocol.CommandStatus
+	switch status.Status {
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING:
+		commandStatus = protocol.CommandStatusAccepted
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED:
+		commandStatus = protocol.CommandStatusApplied
+	case protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED:
+		commandStatus = protocol.CommandStatusFailed
+	default:
+		return
+	}
+
+	if c, ok := ops.commands.get(commandId); ok && c.Status == commandStatus {
+		return
+	}
+	ops.commands.update(commandId, agent.client.id, commandStatus, status.ErrorMessage)
+	ops.supersede(agent, commandId)
+
+	lvl := logrus.InfoLevel
+	if commandStatus == protocol.CommandStatusFailed {
+		lvl = logrus.ErrorLevel
+	}
+	ops.logger.LogWithFields(
+		lvl,
+		"Command is acknowledged by the agent.",
+		map[string]string{
+			"component.name":     "opampserver",
+			"client.id":          agent.client.id,
+			"message.command.id": commandId,
+			"command.status":     string(commandStatus),
+			"error.message":      status.ErrorMessage,
+		})
+}
+
+// Handles the custom messages of the agent. Only the health summary and
+// the crashes of the collector are supported, the others are ignored.
+func (ops *opampServer) receiveCustomMessage(
+	agent *opampAgent,
+	message *protobufs.CustomMessage,
+) {
+	if message.Capability != protocol.OpampHealthCapability {
+		return
+	}
+
+	if message.Type == protocol.OpampCollectorCrashedMessageType {
+		payload := &protocol.CollectorCrashedPayload{}
+		err := json.Unmarshal(message.Data, payload)
+		if err != nil {
+			ops.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Collector crash of the agent could not be decoded.",
+				map[string]string{
+					"component.name": "opampserver",
+					"client.id":      agent.client.id,
+					"error.message":  err.Error(),
+				})
+			return
+		}
+
+		ops.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Collector of the agent crashed.",
+			map[string]string{
+				"component.name": "opampserver",
+				"client.id":      agent.client.id,
+				"error.message":  payload.Error,
+			})
+		ops.registry.collectorCrashed(agent.client.id, payload)
+		return
+	}
+	if message.Type != protocol.OpampHealthMessageType {
+		return
+	}
+
+	summary := &protocol.HealthPayload{}
+	err := json.Unmarshal(message.Data, summary)
+	if err != nil {
+		ops.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Health summary of the agent could not be decoded.",
+			map[string]string{
+				"component.name": "opampserver",
+				"client.id":      agent.client.id,
+				"error.message":  err.Error(),
+			})
+		return
+	}
+	ops.rules.observe(agent.client.id, summary)
+}
+
+// Marks the commands which were sent to the agent before the given one
+// and are not acknowledged yet as superseded. The agent reports only the
+// status of its last remote config, so the status of the skipped ones
+// would never arrive.
+func (ops *opampServer) supersede(
+	agent *opampAgent,
+	commandId string,
+) {
+	current, ok := ops.commands.get(commandId)
+	if !ok {
+		return
+	}
+
+	agent.mutex.Lock()
+	superseded := []string{}
+	for hash, id := range agent.configHashes {
+		if id == commandId {
+			continue
+		}
+		c, ok := ops.commands.get(id)
+		if ok && (c.isFinal() || c.CreatedAt.After(current.CreatedAt)) {
+			continue
+		}
+		delete(agent.configHashes, hash)
+		superseded = append(superseded, id)
+	}
+	agent.mutex.Unlock()
+
+	for _, id := range superseded {
+		ops.commands.update(id, agent.client.id, protocol.CommandStatusSuperseded, "superseded by command "+commandId)
+	}
+}
+
+// Returns the mode from the log level of the collector in the effective
+// config of the agent. The supervisors report the merged collector
+// config, the clients of this repository the mode file next to their
+// own collector config. Agents which report neither with the debug log
+// level are considered to be in default mode.
+func parseOpampMode(
+	effectiveConfig *protobufs.EffectiveConfig,
+) protocol.Mode {
+	for _, file := range effectiveConfig.GetConfigMap().GetConfigMap() {
+		config := &protocol.OpampModeConfig{}
+		err := yaml.Unmarshal(file.Body, config)
+		if err == nil && config.Mode() == protocol.ModeDebug {
+			return protocol.ModeDebug
+		}
+	}
+	return protocol.ModeDefault
+}
+
+// Creates the connection settings which carry the credential of the
+// agent as its authorization header.
+func newOpampCredentialOffer(
+	credential string,
+) *protobufs.ConnectionSettingsOffers {
+	hash := sha256.Sum256([]byte(credential))
+	return &protobufs.ConnectionSettingsOffers{
+		Hash: hash[:],
+		Opamp: &protobufs.OpAMPConnectionSettings{
+			Headers: &protobufs.Headers{
+				Headers: []*protobufs.Header{
+					{
+						Key:   "Authorization",
+						Value: "Bearer " + credential,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Maps the agent description to the metadata of the hello message. The
+// service instance ID of the agent takes precedence over the given
+// instance ID so that a client keeps its ID across the transports.
+func newOpampHelloPayload(
+	instanceId string,
+	description *protobufs.AgentDescription,
+) *protocol.HelloPayload {
+	hello := &protocol.HelloPayload{
+		InstanceId: instanceId,
+		Mode:       protocol.ModeDefault,
+	}
+	if description == nil {
+		return hello
+	}
+
+	attributes := map[string]string{}
+	for _, kv := range append(description.IdentifyingAttributes, description.NonIdentifyingAttributes...) {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+
+	if attributes["service.instance.id"] != "" {
+		hello.InstanceId = attributes["service.instance.id"]
+	}
+	hello.Hostname = attributes["host.name"]
+	hello.Os = attributes["os.type"]
+	hello.Arch = attributes["host.arch"]
+	hello.ClientVersion = attributes["service.version"]
+	hello.ServiceName = attributes["service.name"]
+	hello.CollectorVersion = attributes[protocol.OpampAttributeCollectorVersion]
+	hello.Group = attributes[protocol.OpampAttributeGroup]
+	hello.TimeZoneOffset, _ = strconv.Atoi(attributes[protocol.OpampAttributeTimeZoneOffset])
+	return hello
+}
+
+func formatInstanceUid(
+	instanceUid []byte,
+) string {
+	if id, err := uuid.FromBytes(instanceUid); err == nil {
+		return id.String()
+	}
+	return hex.EncodeToString(instanceUid)
+}
+
+// Adapts the logger to the one which the OpAMP server expects.
+type opampLogger struct {
+	logger *logger.Logger
+}
+
+func (ol *opampLogger) Debugf(
+	ctx context.Context,
+	format string,
+	v ...interface{},
+) {
+	ol.logger.LogWithFields(
+		logrus.DebugLevel,
+		fmt.Sprintf(format, v...),
+		map[string]string{
+			"component.name": "opampserver",
+		})
+}
+
+func (ol *opampLogger) Errorf(
+	ctx context.Context,
+	format string,
+	v ...interface{},
+) {
+	ol.logger.LogWithFields(
+		logrus.ErrorLevel,
+		fmt.Sprintf(format, v...),
+		map[string]string{
+			"component.name": "opampserver",
+		})
+}
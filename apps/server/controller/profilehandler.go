@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (hs *HttpServer) handleProfiles(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		profiles, err := hs.store.listProfiles()
+		if err != nil {
+			msg := "Profiles could not be loaded."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, profiles)
+
+	case http.MethodPost:
+		requestBody := &profile{}
+		err := json.NewDecoder(r.Body).Decode(requestBody)
+		entry := auditEntryOf(r)
+		entry.Profile = requestBody.Name
+		entry.Ttl = requestBody.Ttl
+		entry.Reason = requestBody.Reason
+		entry.Ticket = requestBody.Ticket
+		if err != nil {
+			msg := "HTTP request body parsing failed."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		err = requestBody.validate()
+		if err != nil {
+			msg := "Profile is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		requestBody.CreatedAt = time.Now().UTC()
+		ok, err := hs.store.createProfile(requestBody)
+		if err != nil {
+			msg := "Profile could not be stored."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"profile.name":   requestBody.Name,
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if !ok {
+			msg := "Profile already exists!"
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(msg))
+			return
+		}
+
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Profile is created.",
+			map[string]string{
+				"component.name": "httpserver",
+				"profile.name":   requestBody.Name,
+			})
+		hs.writeJson(w, http.StatusCreated, requestBody)
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
+
+func (hs *HttpServer) handleProfile(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	name := r.PathValue("name")
+	auditEntryOf(r).Profile = name
+
+	switch r.Method {
+	case http.MethodGet:
+		p, ok, err := hs.store.getProfile(name)
+		if err != nil {
+			msg := "Profile could not be loaded."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"profile.name":   name,
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if !ok {
+			msg := "Profile is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, p)
+
+	case http.MethodDelete:
+		ok, err := hs.store.deleteProfile(name)
+		if err != nil {
+			msg := "Profile could not be deleted."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"profile.name":   name,
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if !ok {
+			msg := "Profile is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+
+		msg := "Profile is deleted."
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"profile.name":   name,
+			})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg))
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
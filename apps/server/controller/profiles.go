@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Named preset of the control requests, e.g. the TTL, the reason and
+// the ticket of the debug sessions of an incident, so that the
+// operators do not have to repeat them. The values which are given in
+// the request itself take precedence.
+type profile struct {
+	Name      string    `json:"name"`
+	Ttl       string    `json:"ttl,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Ticket    string    `json:"ticket,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (p *profile) validate() error {
+	if !profileNamePattern.MatchString(p.Name) {
+		return errors.New("name should only contain letters, digits, dots, dashes and underscores")
+	}
+	if p.Ttl != "" {
+		ttl, err := time.ParseDuration(p.Ttl)
+		if err != nil || ttl <= 0 {
+			return errors.New("ttl should be a positive duration")
+		}
+	}
+	return nil
+}
+
+// Fills in the values which are not given in the request. The TTL only
+// applies to the debug mode.
+func (cr *controlRequest) applyProfile(
+	p *profile,
+	isDebug bool,
+) {
+	if cr.Ttl == "" && isDebug {
+		cr.Ttl = p.Ttl
+	}
+	if cr.Reason == "" {
+		cr.Reason = p.Reason
+	}
+	if cr.Ticket == "" {
+		cr.Ticket = p.Ticket
+	}
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+func (hs *HttpServer) handleRules(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		hs.writeJson(w, http.StatusOK, hs.rules.list())
+
+	case http.MethodPost:
+		requestBody := &rule{}
+		err := json.NewDecoder(r.Body).Decode(requestBody)
+		entry := auditEntryOf(r)
+		entry.Targets = requestBody.ClientIds
+		if requestBody.Group != "" {
+			entry.Targets = append(entry.Targets, "group:"+requestBody.Group)
+		}
+		entry.Mode = protocol.ModeDebug
+		entry.Ttl = requestBody.Ttl
+		entry.Reason = requestBody.Name
+		if err != nil {
+			msg := "HTTP request body parsing failed."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		rl, err := hs.rules.create(requestBody)
+		if rl != nil {
+			entry.RuleId = rl.Id
+		}
+		if errors.Is(err, errStateIsNotStored) {
+			msg := "Rule could not be stored."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if err != nil {
+			msg := "Rule is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Rule is created.",
+			map[string]string{
+				"component.name": "httpserver",
+				"rule.id":        rl.Id,
+			})
+		hs.writeJson(w, http.StatusCreated, rl)
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
+
+func (hs *HttpServer) handleRule(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	ruleId := r.PathValue("id")
+	auditEntryOf(r).RuleId = ruleId
+
+	switch r.Method {
+	case http.MethodGet:
+		rl, ok := hs.rules.get(ruleId)
+		if !ok {
+			msg := "Rule is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, rl)
+
+	case http.MethodDelete:
+		ok, err := hs.rules.delete(ruleId)
+		if err != nil {
+			msg := "Rule could not be deleted."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"rule.id":        ruleId,
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if !ok {
+			msg := "Rule is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+
+		msg := "Rule is deleted."
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"rule.id":        ruleId,
+			})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg))
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
@@ -0,0 +1,495 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Safety net for the debug mode which a rule triggers. The rule
+// escalates again if the problem outlives it.
+const RULE_DEBUG_TTL = time.Hour
+
+// Metrics of the health summary which the rules can be defined on.
+const (
+	RULE_METRIC_LATENCY_P50 = "latencyP50Ms"
+	RULE_METRIC_LATENCY_P95 = "latencyP95Ms"
+	RULE_METRIC_LATENCY_P99 = "latencyP99Ms"
+)
+
+var ruleMetrics = []string{
+	RULE_METRIC_LATENCY_P50,
+	RULE_METRIC_LATENCY_P95,
+	RULE_METRIC_LATENCY_P99,
+}
+
+// Threshold rule on the health summaries of the targeted clients. The
+// rule trips once the metric is above the threshold for the given
+// number of consecutive summaries and clears once it is below the
+// clear threshold for the given number of consecutive summaries. The
+// gap between the two keeps a metric which hovers around the threshold
+// from flapping the clients.
+type rule struct {
+	Id             string    `json:"id"`
+	Name           string    `json:"name"`
+	ClientIds      []string  `json:"clientIds,omitempty"`
+	Group          string    `json:"group,omitempty"`
+	Metric         string    `json:"metric"`
+	Threshold      float64   `json:"threshold"`
+	ClearThreshold *float64  `json:"clearThreshold,omitempty"`
+	TripAfter      int       `json:"tripAfter,omitempty"`
+	ClearAfter     int       `json:"clearAfter,omitempty"`
+	Ttl            string    `json:"ttl,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// Parsed TTL, RULE_DEBUG_TTL if it is not given
+	ttl time.Duration
+}
+
+// State of a rule for a single client.
+type ruleState struct {
+	isTripped bool
+	breaches  int
+	clears    int
+	// Command which the rule escalated the client with. Empty if the
+	// client was already in debug mode for longer.
+	commandId string
+}
+
+// Evaluates the rules against the health summaries of the clients and
+// escalates the clients to debug mode when a rule trips. Once the rule
+// clears, the clients are de-escalated unless someone else changed
+// their mode in the meantime.
+type ruleEngine struct {
+	logger     *logger.Logger
+	registry   *clientRegistry
+	commands   *commandTracker
+	dispatcher *commandDispatcher
+	store      store
+	rules      map[string]*rule
+	// States of the rules keyed by rule and client
+	states map[string]*ruleState
+	mutex  *sync.Mutex
+}
+
+func newRuleEngine(
+	logger *logger.Logger,
+	registry *clientRegistry,
+	commands *commandTracker,
+	dispatcher *commandDispatcher,
+	store store,
+) (
+	*ruleEngine,
+	error,
+) {
+	re := &ruleEngine{
+		logger:     logger,
+		registry:   registry,
+		commands:   commands,
+		dispatcher: dispatcher,
+		store:      store,
+		rules:      map[string]*rule{},
+		states:     map[string]*ruleState{},
+		mutex:      &sync.Mutex{},
+	}
+	err := re.load()
+	if err != nil {
+		return nil, err
+	}
+	return re, nil
+}
+
+// Loads the rules which are created before the server restarted. Their
+// states start over with the next health summaries.
+func (re *ruleEngine) load() error {
+	rules, err := re.store.listRules()
+	if err != nil {
+		return fmt.Errorf("rules could not be loaded: %w", err)
+	}
+	for _, r := range rules {
+		// Parses the TTL which is not stored
+		err := r.validate()
+		if err != nil {
+			re.logger.LogWithFields(
+				logrus.ErrorLevel,
+				"Stored rule is not valid, skipping it.",
+				map[string]string{
+					"component.name": "rules",
+					"rule.id":        r.Id,
+					"error.message":  err.Error(),
+				})
+			continue
+		}
+		re.rules[r.Id] = r
+	}
+	return nil
+}
+
+func (re *ruleEngine) create(
+	r *rule,
+) (
+	*rule,
+	error,
+) {
+	err := r.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Id = generateId()
+	r.CreatedAt = time.Now().UTC()
+
+	err = re.store.saveRule(r)
+	if err != nil {
+		return nil, errors.Join(errStateIsNotStored, err)
+	}
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	re.rules[r.Id] = r
+	return r, nil
+}
+
+func (re *ruleEngine) get(
+	id string,
+) (
+	*rule,
+	bool,
+) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	r, ok := re.rules[id]
+	return r, ok
+}
+
+func (re *ruleEngine) list() []*rule {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	rules := make([]*rule, 0, len(re.rules))
+	for _, r := range re.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules
+}
+
+// Deletes the rule. The clients which are escalated by it revert once
+// their TTL elapses.
+func (re *ruleEngine) delete(
+	id string,
+) (
+	bool,
+	error,
+) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	if _, ok := re.rules[id]; !ok {
+		return false, nil
+	}
+	_, err := re.store.deleteRule(id)
+	if err != nil {
+		return false, err
+	}
+	delete(re.rules, id)
+	for key := range re.states {
+		if ruleIdOf(key) == id {
+			delete(re.states, key)
+		}
+	}
+	return true, nil
+}
+
+// Records the health summary of the client and evaluates the rules
+// which target it.
+func (re *ruleEngine) observe(
+	clientId string,
+	summary *protocol.HealthPayload,
+) {
+	re.registry.updateHealthSummary(clientId, summary)
+
+	client, ok := re.registry.get(clientId)
+	if !ok {
+		return
+	}
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+
+	for _, r := range re.rules {
+		if !r.targets(client) {
+			continue
+		}
+		value, ok := r.valueOf(summary)
+		if !ok {
+			continue
+		}
+
+		key := r.Id + "/" + clientId
+		state, ok := re.states[key]
+		if !ok {
+			state = &ruleState{}
+			re.states[key] = state
+		}
+		re.evaluate(r, clientId, state, value)
+	}
+}
+
+func (re *ruleEngine) evaluate(
+	r *rule,
+	clientId string,
+	state *ruleState,
+	value float64,
+) {
+	// The escalation of the rule is over if the client is reverted by
+	// its TTL or switched by someone else in the meantime
+	if state.isTripped && state.commandId != "" && !re.isEscalatedBy(clientId, state.commandId) {
+		*state = ruleState{}
+	}
+
+	if !state.isTripped {
+		if value > r.Threshold {
+			state.breaches++
+		} else {
+			state.breaches = 0
+		}
+		if state.breaches < r.tripAfter() {
+			return
+		}
+		state.isTripped = true
+		state.clears = 0
+		state.commandId = re.escalate(r, clientId, value)
+		return
+	}
+
+	if value < r.clearThreshold() {
+		state.clears++
+	} else {
+		state.clears = 0
+	}
+	if state.clears < r.clearAfter() {
+		return
+	}
+	re.deescalate(r, clientId, state, value)
+	*state = ruleState{}
+}
+
+// Switches the client to debug mode. Returns the ID of the command or
+// empty if the client is already in debug mode for longer or no command
+// could be created.
+func (re *ruleEngine) escalate(
+	r *rule,
+	clientId string,
+	value float64,
+) string {
+	reason := "rule " + r.Name + " tripped: " + r.Metric + " " + formatRuleValue(value) + " > " + formatRuleValue(r.Threshold)
+	re.commands.appendEvent(&clientEvent{
+		ClientId: clientId,
+		Type:     CLIENT_EVENT_RULE_TRIPPED,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+	})
+
+	if ds, ok := re.dispatcher.getDesiredState(clientId); ok && ds.Mode == protocol.ModeDebug &&
+		(ds.ExpiresAt == nil || ds.ExpiresAt.After(time.Now().Add(r.ttl))) {
+		return ""
+	}
+
+	// The desired state is debug even if the command could not be sent,
+	// so the command is kept to revert the client once it is reconciled
+	c, err := re.dispatcher.setMode(clientId, protocol.ModeDebug, r.ttl, reason)
+	if err != nil {
+		re.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Rule could not escalate the client.",
+			map[string]string{
+				"component.name": "rules",
+				"rule.id":        r.Id,
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+	}
+	if c == nil {
+		return ""
+	}
+
+	re.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Rule is tripped, client is escalated.",
+		map[string]string{
+			"component.name":     "rules",
+			"rule.id":            r.Id,
+			"client.id":          clientId,
+			"message.command.id": c.Id,
+		})
+	return c.Id
+}
+
+// Switches the client back to default mode if it is still in the debug
+// mode which the rule escalated it to.
+func (re *ruleEngine) deescalate(
+	r *rule,
+	clientId string,
+	state *ruleState,
+	value float64,
+) {
+	reason := "rule " + r.Name + " cleared: " + r.Metric + " " + formatRuleValue(value) + " < " + formatRuleValue(r.clearThreshold())
+	re.commands.appendEvent(&clientEvent{
+		ClientId: clientId,
+		Type:     CLIENT_EVENT_RULE_CLEARED,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+	})
+
+	if state.commandId == "" {
+		return
+	}
+
+	c, err := re.dispatcher.setMode(clientId, protocol.ModeDefault, 0, reason)
+	if err != nil {
+		re.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Rule could not de-escalate the client.",
+			map[string]string{
+				"component.name": "rules",
+				"rule.id":        r.Id,
+				"client.id":      clientId,
+				"error.message":  err.Error(),
+			})
+		return
+	}
+
+	re.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Rule is cleared, client is de-escalated.",
+		map[string]string{
+			"component.name":     "rules",
+			"rule.id":            r.Id,
+			"client.id":          clientId,
+			"message.command.id": c.Id,
+		})
+}
+
+// Returns whether the desired state of the client is still the debug
+// mode of the given command.
+func (re *ruleEngine) isEscalatedBy(
+	clientId string,
+	commandId string,
+) bool {
+	ds, ok := re.dispatcher.getDesiredState(clientId)
+	return ok && ds.Mode == protocol.ModeDebug && ds.RequestedBy == commandId
+}
+
+func (r *rule) validate() error {
+	if r.Name == "" {
+		return errors.New("name should be given")
+	}
+	if len(r.ClientIds) == 0 && r.Group == "" {
+		return errors.New("either client IDs or group should be given")
+	}
+	if !slices.Contains(ruleMetrics, r.Metric) {
+		return errors.New("metric should be one of " + strings.Join(ruleMetrics, ", "))
+	}
+	if r.ClearThreshold != nil && *r.ClearThreshold > r.Threshold {
+		return errors.New("clearThreshold should not be above threshold")
+	}
+	if r.TripAfter < 0 || r.ClearAfter < 0 {
+		return errors.New("tripAfter and clearAfter should not be negative")
+	}
+
+	r.ttl = RULE_DEBUG_TTL
+	if r.Ttl != "" {
+		ttl, err := time.ParseDuration(r.Ttl)
+		if err != nil || ttl <= 0 {
+			return errors.New("ttl should be a positive duration")
+		}
+		r.ttl = ttl
+	}
+	return nil
+}
+
+func (r *rule) targets(
+	client *clientInfo,
+) bool {
+	if r.Group != "" && client.Metadata != nil && client.Metadata.Group == r.Group {
+		return true
+	}
+	return slices.Contains(r.ClientIds, client.Id)
+}
+
+// Returns the value of the metric of the rule in the summary. Summaries
+// without any handling carry no value.
+func (r *rule) valueOf(
+	summary *protocol.HealthPayload,
+) (
+	float64,
+	bool,
+) {
+	if summary.Count == 0 {
+		return 0, false
+	}
+
+	switch r.Metric {
+	case RULE_METRIC_LATENCY_P50:
+		return summary.LatencyP50Ms, true
+	case RULE_METRIC_LATENCY_P95:
+		return summary.LatencyP95Ms, true
+	case RULE_METRIC_LATENCY_P99:
+		return summary.LatencyP99Ms, true
+	}
+	return 0, false
+}
+
+// Returns the threshold which the metric has to fall below for the rule
+// to clear. Defaults to the threshold itself.
+func (r *rule) clearThreshold() float64 {
+	if r.ClearThreshold == nil {
+		return r.Threshold
+	}
+	return *r.ClearThreshold
+}
+
+// Returns the number of consecutive breaching summaries which trip the
+// rule. Defaults to 1.
+func (r *rule) tripAfter() int {
+	if r.TripAfter == 0 {
+		return 1
+	}
+	return r.TripAfter
+}
+
+// Returns the number of consecutive healthy summaries which clear the
+// rule. Defaults to 3.
+func (r *rule) clearAfter() int {
+	if r.ClearAfter == 0 {
+		return 3
+	}
+	return r.ClearAfter
+}
+
+func ruleIdOf(
+	stateKey string,
+) string {
+	ruleId, _, _ := strings.Cut(stateKey, "/")
+	return ruleId
+}
+
+func formatRuleValue(
+	value float64,
+) string {
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+func (hs *HttpServer) handleSchedules(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		hs.writeJson(w, http.StatusOK, hs.scheduler.list())
+
+	case http.MethodPost:
+		requestBody := &schedule{}
+		err := json.NewDecoder(r.Body).Decode(requestBody)
+		entry := auditEntryOf(r)
+		entry.Targets = requestBody.ClientIds
+		if requestBody.Group != "" {
+			entry.Targets = append(entry.Targets, "group:"+requestBody.Group)
+		}
+		entry.Mode = protocol.ModeDebug
+		entry.Reason = requestBody.Reason
+		entry.Ticket = requestBody.Ticket
+		if err != nil {
+			msg := "HTTP request body parsing failed."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		sch, err := hs.scheduler.create(requestBody)
+		if sch != nil {
+			entry.ScheduleId = sch.Id
+		}
+		if errors.Is(err, errStateIsNotStored) {
+			msg := "Schedule could not be stored."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if err != nil {
+			msg := "Schedule is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Schedule is created.",
+			map[string]string{
+				"component.name": "httpserver",
+				"schedule.id":    sch.Id,
+			})
+		hs.writeJson(w, http.StatusCreated, sch)
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
+
+func (hs *HttpServer) handleSchedule(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	scheduleId := r.PathValue("id")
+	auditEntryOf(r).ScheduleId = scheduleId
+
+	switch r.Method {
+	case http.MethodGet:
+		sch, ok := hs.scheduler.get(scheduleId)
+		if !ok {
+			msg := "Schedule is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, sch)
+
+	case http.MethodDelete:
+		ok, err := hs.scheduler.delete(scheduleId)
+		if err != nil {
+			msg := "Schedule could not be deleted."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"schedule.id":    scheduleId,
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		if !ok {
+			msg := "Schedule is not found!"
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(msg))
+			return
+		}
+
+		msg := "Schedule is deleted."
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"schedule.id":    scheduleId,
+			})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg))
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
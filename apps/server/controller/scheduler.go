@@ -0,0 +1,361 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+const SCHEDULER_INTERVAL = 30 * time.Second
+
+// Daily window in the local time of the client, e.g. 19:00 - 21:00.
+// If the end is before the start, the window ends on the next day. The
+// window recurs for the given number of days or forever if it is 0.
+type dailyWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Days  int    `json:"days,omitempty"`
+}
+
+// Schedule which switches the targeted clients to debug mode either
+// once between the given times or recurring daily.
+type schedule struct {
+	Id        string       `json:"id"`
+	ClientIds []string     `json:"clientIds,omitempty"`
+	Group     string       `json:"group,omitempty"`
+	StartsAt  *time.Time   `json:"startsAt,omitempty"`
+	EndsAt    *time.Time   `json:"endsAt,omitempty"`
+	Daily     *dailyWindow `json:"daily,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	Ticket    string       `json:"ticket,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+type scheduler struct {
+	logger     *logger.Logger
+	wg         *sync.WaitGroup
+	registry   *clientRegistry
+	dispatcher *commandDispatcher
+	store      store
+	schedules  map[string]*schedule
+	// End of the windows which are already triggered, keyed by
+	// schedule, client and window start
+	triggered map[string]time.Time
+	mutex     *sync.Mutex
+}
+
+func newScheduler(
+	logger *logger.Logger,
+	wg *sync.WaitGroup,
+	registry *clientRegistry,
+	dispatcher *commandDispatcher,
+	store store,
+) (
+	*scheduler,
+	error,
+) {
+	s := &scheduler{
+		logger:     logger,
+		wg:         wg,
+		registry:   registry,
+		dispatcher: dispatcher,
+		store:      store,
+		schedules:  map[string]*schedule{},
+		triggered:  map[string]time.Time{},
+		mutex:      &sync.Mutex{},
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Loads the schedules which are created before the server restarted.
+// The windows which are active are triggered again on the first tick.
+func (s *scheduler) load() error {
+	schedules, err := s.store.listSchedules()
+	if err != nil {
+		return fmt.Errorf("schedules could not be loaded: %w", err)
+	}
+	for _, sch := range schedules {
+		s.schedules[sch.Id] = sch
+	}
+	return nil
+}
+
+func (s *scheduler) run(
+	ctx context.Context,
+) {
+	defer s.wg.Done()
+
+	s.logger.LogWithFields(
+		logrus.InfoLevel,
+		"Scheduler is started.",
+		map[string]string{
+			"component.name": "scheduler",
+		})
+
+	ticker := time.NewTicker(SCHEDULER_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.evaluate(now)
+		}
+	}
+}
+
+func (s *scheduler) create(
+	sch *schedule,
+) (
+	*schedule,
+	error,
+) {
+	err := sch.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sch.Id = generateId()
+	sch.CreatedAt = time.Now().UTC()
+
+	err = s.store.saveSchedule(sch)
+	if err != nil {
+		return nil, errors.Join(errStateIsNotStored, err)
+	}
+
+	s.mutex.Lock()
+	s.schedules[sch.Id] = sch
+	s.mutex.Unlock()
+
+	// Do not wait for the next tick if the window is already active
+	s.evaluate(time.Now())
+	return sch, nil
+}
+
+func (s *scheduler) get(
+	id string,
+) (
+	*schedule,
+	bool,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sch, ok := s.schedules[id]
+	return sch, ok
+}
+
+func (s *scheduler) list() []*schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schedules := make([]*schedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		schedules = append(schedules, sch)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules
+}
+
+// Deletes the schedule. The clients which are already switched by it
+// revert once their TTL elapses.
+func (s *scheduler) delete(
+	id string,
+) (
+	bool,
+	error,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return false, nil
+	}
+	_, err := s.store.deleteSchedule(id)
+	if err != nil {
+		return false, err
+	}
+	delete(s.schedules, id)
+	return true, nil
+}
+
+// Switches the targeted clients to debug mode for the rest of the
+// window which is active at the given time. Each window is triggered
+// only once per client, the TTL takes care of the revert.
+func (s *scheduler) evaluate(
+	now time.Time,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, end := range s.triggered {
+		if !now.Before(end) {
+			delete(s.triggered, key)
+		}
+	}
+
+	clients := s.registry.list()
+	for _, sch := range s.schedules {
+		for _, client := range clients {
+			if !sch.targets(client) {
+				continue
+			}
+
+			// Clients without metadata are scheduled in UTC
+			offset := 0
+			if client.Metadata != nil {
+				offset = client.Metadata.TimeZoneOffset
+			}
+			location := time.FixedZone("client", offset)
+			start, end, ok := sch.activeWindow(now, location)
+			if !ok {
+				continue
+			}
+
+			key := sch.Id + "/" + client.Id + "/" + strconv.FormatInt(start.Unix(), 10)
+			if _, ok := s.triggered[key]; ok {
+				continue
+			}
+			s.triggered[key] = end
+
+			// A TTL of zero would keep the client in debug mode for good
+			ttl := end.Sub(now).Round(time.Second)
+			if ttl < time.Second {
+				ttl = time.Second
+			}
+			c, err := s.dispatcher.setMode(client.Id, protocol.ModeDebug, ttl, commandReason("scheduled by "+sch.Id, sch.Reason, sch.Ticket))
+			if err != nil {
+				s.logger.LogWithFields(
+					logrus.ErrorLevel,
+					"Scheduled mode change could not be sent.",
+					map[string]string{
+						"component.name": "scheduler",
+						"schedule.id":    sch.Id,
+						"client.id":      client.Id,
+						"error.message":  err.Error(),
+					})
+				continue
+			}
+
+			s.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Scheduled mode change is sent.",
+				map[string]string{
+					"component.name":     "scheduler",
+					"schedule.id":        sch.Id,
+					"client.id":          client.Id,
+					"message.command.id": c.Id,
+					"otelcol.mode.ttl":   ttl.String(),
+				})
+		}
+	}
+}
+
+func (sch *schedule) validate() error {
+	if len(sch.ClientIds) == 0 && sch.Group == "" {
+		return errors.New("either client IDs or group should be given")
+	}
+
+	isOneOff := sch.StartsAt != nil || sch.EndsAt != nil
+	if isOneOff == (sch.Daily != nil) {
+		return errors.New("either startsAt and endsAt or daily should be given")
+	}
+
+	if isOneOff {
+		if sch.StartsAt == nil || sch.EndsAt == nil || !sch.StartsAt.Before(*sch.EndsAt) {
+			return errors.New("startsAt should be before endsAt")
+		}
+		return nil
+	}
+
+	start, err := time.Parse("15:04", sch.Daily.Start)
+	if err != nil {
+		return errors.New("daily start should be given as HH:MM")
+	}
+	end, err := time.Parse("15:04", sch.Daily.End)
+	if err != nil {
+		return errors.New("daily end should be given as HH:MM")
+	}
+	if start.Equal(end) {
+		return errors.New("daily start and end should differ")
+	}
+	if sch.Daily.Days < 0 {
+		return errors.New("daily days should not be negative")
+	}
+	return nil
+}
+
+func (sch *schedule) targets(
+	client *clientInfo,
+) bool {
+	if sch.Group != "" && client.Metadata != nil && client.Metadata.Group == sch.Group {
+		return true
+	}
+	for _, id := range sch.ClientIds {
+		if id == client.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the window of the schedule which is active at the given
+// time. Daily windows are evaluated in the given location.
+func (sch *schedule) activeWindow(
+	now time.Time,
+	location *time.Location,
+) (
+	time.Time,
+	time.Time,
+	bool,
+) {
+	if sch.Daily == nil {
+		if now.Before(*sch.StartsAt) || !now.Before(*sch.EndsAt) {
+			return time.Time{}, time.Time{}, false
+		}
+		return *sch.StartsAt, *sch.EndsAt, true
+	}
+
+	// The validation guarantees that the times can be parsed
+	startOfWindow, _ := time.Parse("15:04", sch.Daily.Start)
+	endOfWindow, _ := time.Parse("15:04", sch.Daily.End)
+
+	localNow := now.In(location)
+	created := sch.CreatedAt.In(location)
+	firstDay := time.Date(created.Year(), created.Month(), created.Day(), 0, 0, 0, 0, location)
+	today := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, location)
+
+	// A window which crosses midnight might have started yesterday
+	for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+		dayIndex := int(day.Sub(firstDay).Hours() / 24)
+		if dayIndex < 0 || (sch.Daily.Days > 0 && dayIndex >= sch.Daily.Days) {
+			continue
+		}
+
+		start := day.Add(time.Duration(startOfWindow.Hour())*time.Hour + time.Duration(startOfWindow.Minute())*time.Minute)
+		end := day.Add(time.Duration(endOfWindow.Hour())*time.Hour + time.Duration(endOfWindow.Minute())*time.Minute)
+		if !end.After(start) {
+			end = end.AddDate(0, 0, 1)
+		}
+
+		if !now.Before(start) && now.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
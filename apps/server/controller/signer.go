@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Duration after which the clients reject a signed command. It only
+// has to cover the delivery of the command.
+const SIGNED_COMMAND_VALIDITY = 5 * time.Minute
+
+// Signs the commands so that the clients can verify that they are
+// issued by this server.
+type commandSigner struct {
+	key ed25519.PrivateKey
+}
+
+// Loads the Ed25519 private key from the PEM encoded PKCS #8 file. If
+// no file is given, an ephemeral key is generated and its public key is
+// logged so that the clients can pin it.
+func newCommandSigner(
+	logger *logger.Logger,
+	keyFile string,
+) (
+	*commandSigner,
+	error,
+) {
+	if keyFile == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		cs := &commandSigner{key: key}
+		logger.LogWithFields(
+			logrus.InfoLevel,
+			"No signing key is given, an ephemeral signing key is generated. The clients have to pin its public key again after every restart:\n"+cs.publicKeyPem(),
+			map[string]string{
+				"component.name": "signer",
+			})
+		return cs, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key file does not contain a PEM block")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+	return &commandSigner{key: key}, nil
+}
+
+func (cs *commandSigner) sign(
+	clientId string,
+	commandId string,
+	mode protocol.Mode,
+	ttl string,
+) (
+	*protocol.CommandSignature,
+	error,
+) {
+	return protocol.SignCommand(cs.key, clientId, commandId, mode, ttl, SIGNED_COMMAND_VALIDITY)
+}
+
+// Returns the PEM encoded public key which the clients pin.
+func (cs *commandSigner) publicKeyPem() string {
+	// Marshalling an Ed25519 public key cannot fail
+	der, _ := x509.MarshalPKIXPublicKey(cs.key.Public())
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}))
+}
@@ -0,0 +1,601 @@
+package controller
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
+)
+
+// Types of the events in the history of a client.
+const (
+	CLIENT_EVENT_CONNECTED         = "connected"
+	CLIENT_EVENT_DISCONNECTED      = "disconnected"
+	CLIENT_EVENT_MODE_REPORTED     = "mode_reported"
+	CLIENT_EVENT_COMMAND_SENT      = "command_sent"
+	CLIENT_EVENT_COMMAND_STATUS    = "command_status"
+	CLIENT_EVENT_MODE_EXPIRED      = "mode_expired"
+	CLIENT_EVENT_COLLECTOR_CRASHED = "collector_crashed"
+	CLIENT_EVENT_REVOKED           = "revoked"
+	CLIENT_EVENT_RULE_TRIPPED      = "rule_tripped"
+	CLIENT_EVENT_RULE_CLEARED      = "rule_cleared"
+)
+
+// Returned together with the error of the store if a change could not
+// be persisted, unlike the errors of invalid requests.
+var errStateIsNotStored = errors.New("state could not be stored")
+
+// Record of a client which outlives its connection.
+type clientRecord struct {
+	Id             string                 `json:"id"`
+	Transport      string                 `json:"transport"`
+	Metadata       *protocol.HelloPayload `json:"metadata"`
+	Mode           protocol.Mode          `json:"mode"`
+	FirstSeenAt    time.Time              `json:"firstSeenAt"`
+	ConnectedAt    time.Time              `json:"connectedAt"`
+	DisconnectedAt *time.Time             `json:"disconnectedAt,omitempty"`
+}
+
+// Entry in the history of a client, e.g. a connect or a mode change
+// together with the reason of it.
+type clientEvent struct {
+	ClientId  string                 `json:"clientId"`
+	Type      string                 `json:"type"`
+	Time      time.Time              `json:"time"`
+	Transport string                 `json:"transport,omitempty"`
+	Mode      protocol.Mode          `json:"mode,omitempty"`
+	CommandId string                 `json:"commandId,omitempty"`
+	Status    protocol.CommandStatus `json:"status,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+}
+
+// Storage of everything which the server should remember across
+// restarts. The in-memory store is used unless a file is configured.
+type store interface {
+	saveClient(record *clientRecord) error
+	getClient(id string) (*clientRecord, bool, error)
+	saveDesiredState(clientId string, ds *desiredState) error
+	getDesiredState(clientId string) (*desiredState, bool, error)
+	saveCommand(c *command) error
+	getCommand(id string) (*command, bool, error)
+	appendEvent(event *clientEvent) error
+	listEvents(clientId string) ([]*clientEvent, error)
+	appendAudit(entry *auditEntry) error
+	listAudit() ([]*auditEntry, error)
+	saveToken(t *token) error
+	getToken(hash string) (*token, bool, error)
+	listTokens() ([]*token, error)
+	deleteToken(id string) (bool, error)
+	saveEnrollmentToken(t *enrollmentToken) error
+	getEnrollmentToken(hash string) (*enrollmentToken, bool, error)
+	listEnrollmentTokens() ([]*enrollmentToken, error)
+	deleteEnrollmentToken(id string) (bool, error)
+	saveCredential(c *clientCredential) error
+	getCredential(hash string) (*clientCredential, bool, error)
+	listCredentials() ([]*clientCredential, error)
+	saveSchedule(sch *schedule) error
+	listSchedules() ([]*schedule, error)
+	deleteSchedule(id string) (bool, error)
+	saveRule(r *rule) error
+	listRules() ([]*rule, error)
+	deleteRule(id string) (bool, error)
+	// Returns false if a profile with the same name exists
+	createProfile(p *profile) (bool, error)
+	getProfile(name string) (*profile, bool, error)
+	listProfiles() ([]*profile, error)
+	deleteProfile(name string) (bool, error)
+	// Returns an error if the store cannot be read
+	ping() error
+	close() error
+}
+
+type memoryStore struct {
+	clients       map[string]*clientRecord
+	desiredStates map[string]*desiredState
+	commands      map[string]*command
+	events        map[string][]*clientEvent
+	audit         []*auditEntry
+	tokens        map[string]*token
+	enrollments   map[string]*enrollmentToken
+	credentials   map[string]*clientCredential
+	schedules     map[string]*schedule
+	rules         map[string]*rule
+	profiles      map[string]*profile
+	mutex         *sync.Mutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		clients:       map[string]*clientRecord{},
+		desiredStates: map[string]*desiredState{},
+		commands:      map[string]*command{},
+		events:        map[string][]*clientEvent{},
+		tokens:        map[string]*token{},
+		enrollments:   map[string]*enrollmentToken{},
+		credentials:   map[string]*clientCredential{},
+		schedules:     map[string]*schedule{},
+		rules:         map[string]*rule{},
+		profiles:      map[string]*profile{},
+		mutex:         &sync.Mutex{},
+	}
+}
+
+func (ms *memoryStore) saveClient(
+	record *clientRecord,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *record
+	ms.clients[record.Id] = &copied
+	return nil
+}
+
+func (ms *memoryStore) getClient(
+	id string,
+) (
+	*clientRecord,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	record, ok := ms.clients[id]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *record
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) saveDesiredState(
+	clientId string,
+	ds *desiredState,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *ds
+	ms.desiredStates[clientId] = &copied
+	return nil
+}
+
+func (ms *memoryStore) getDesiredState(
+	clientId string,
+) (
+	*desiredState,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ds, ok := ms.desiredStates[clientId]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *ds
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) saveCommand(
+	c *command,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.commands[c.Id] = c.copy()
+	return nil
+}
+
+func (ms *memoryStore) getCommand(
+	id string,
+) (
+	*command,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	c, ok := ms.commands[id]
+	if !ok {
+		return nil, false, nil
+	}
+	return c.copy(), true, nil
+}
+
+func (ms *memoryStore) appendEvent(
+	event *clientEvent,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *event
+	ms.events[event.ClientId] = append(ms.events[event.ClientId], &copied)
+	return nil
+}
+
+func (ms *memoryStore) listEvents(
+	clientId string,
+) (
+	[]*clientEvent,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	events := make([]*clientEvent, 0, len(ms.events[clientId]))
+	for _, event := range ms.events[clientId] {
+		copied := *event
+		events = append(events, &copied)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
+
+func (ms *memoryStore) appendAudit(
+	entry *auditEntry,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *entry
+	ms.audit = append(ms.audit, &copied)
+	return nil
+}
+
+func (ms *memoryStore) listAudit() (
+	[]*auditEntry,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	entries := make([]*auditEntry, 0, len(ms.audit))
+	for _, entry := range ms.audit {
+		copied := *entry
+		entries = append(entries, &copied)
+	}
+	return entries, nil
+}
+
+func (ms *memoryStore) saveToken(
+	t *token,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *t
+	ms.tokens[t.Hash] = &copied
+	return nil
+}
+
+func (ms *memoryStore) getToken(
+	hash string,
+) (
+	*token,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	t, ok := ms.tokens[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *t
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) listTokens() (
+	[]*token,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	tokens := make([]*token, 0, len(ms.tokens))
+	for _, t := range ms.tokens {
+		copied := *t
+		tokens = append(tokens, &copied)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (ms *memoryStore) deleteToken(
+	id string,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for hash, t := range ms.tokens {
+		if t.Id == id {
+			delete(ms.tokens, hash)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ms *memoryStore) saveEnrollmentToken(
+	t *enrollmentToken,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *t
+	ms.enrollments[t.Hash] = &copied
+	return nil
+}
+
+func (ms *memoryStore) getEnrollmentToken(
+	hash string,
+) (
+	*enrollmentToken,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	t, ok := ms.enrollments[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *t
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) listEnrollmentTokens() (
+	[]*enrollmentToken,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	tokens := make([]*enrollmentToken, 0, len(ms.enrollments))
+	for _, t := range ms.enrollments {
+		copied := *t
+		tokens = append(tokens, &copied)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (ms *memoryStore) deleteEnrollmentToken(
+	id string,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for hash, t := range ms.enrollments {
+		if t.Id == id {
+			delete(ms.enrollments, hash)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ms *memoryStore) saveCredential(
+	c *clientCredential,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *c
+	ms.credentials[c.Hash] = &copied
+	return nil
+}
+
+func (ms *memoryStore) getCredential(
+	hash string,
+) (
+	*clientCredential,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	c, ok := ms.credentials[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *c
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) listCredentials() (
+	[]*clientCredential,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	credentials := make([]*clientCredential, 0, len(ms.credentials))
+	for _, c := range ms.credentials {
+		copied := *c
+		credentials = append(credentials, &copied)
+	}
+	return credentials, nil
+}
+
+func (ms *memoryStore) saveSchedule(
+	sch *schedule,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *sch
+	ms.schedules[sch.Id] = &copied
+	return nil
+}
+
+func (ms *memoryStore) listSchedules() (
+	[]*schedule,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	schedules := make([]*schedule, 0, len(ms.schedules))
+	for _, sch := range ms.schedules {
+		copied := *sch
+		schedules = append(schedules, &copied)
+	}
+	return schedules, nil
+}
+
+func (ms *memoryStore) deleteSchedule(
+	id string,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.schedules[id]; !ok {
+		return false, nil
+	}
+	delete(ms.schedules, id)
+	return true, nil
+}
+
+func (ms *memoryStore) saveRule(
+	r *rule,
+) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	copied := *r
+	ms.rules[r.Id] = &copied
+	return nil
+}
+
+func (ms *memoryStore) listRules() (
+	[]*rule,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	rules := make([]*rule, 0, len(ms.rules))
+	for _, r := range ms.rules {
+		copied := *r
+		rules = append(rules, &copied)
+	}
+	return rules, nil
+}
+
+func (ms *memoryStore) deleteRule(
+	id string,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.rules[id]; !ok {
+		return false, nil
+	}
+	delete(ms.rules, id)
+	return true, nil
+}
+
+func (ms *memoryStore) createProfile(
+	p *profile,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.profiles[p.Name]; ok {
+		return false, nil
+	}
+	copied := *p
+	ms.profiles[p.Name] = &copied
+	return true, nil
+}
+
+func (ms *memoryStore) getProfile(
+	name string,
+) (
+	*profile,
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	p, ok := ms.profiles[name]
+	if !ok {
+		return nil, false, nil
+	}
+	copied := *p
+	return &copied, true, nil
+}
+
+func (ms *memoryStore) listProfiles() (
+	[]*profile,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	profiles := make([]*profile, 0, len(ms.profiles))
+	for _, p := range ms.profiles {
+		copied := *p
+		profiles = append(profiles, &copied)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
+
+func (ms *memoryStore) deleteProfile(
+	name string,
+) (
+	bool,
+	error,
+) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.profiles[name]; !ok {
+		return false, nil
+	}
+	delete(ms.profiles, name)
+	return true, nil
+}
+
+func (ms *memoryStore) ping() error {
+	return nil
+}
+
+func (ms *memoryStore) close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the stores which the tests run against.
+func newTestStores(
+	t *testing.T,
+) map[string]store {
+	bs, err := newBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bs.close()
+	})
+
+	return map[string]store{
+		"memory": newMemoryStore(),
+		"bolt":   bs,
+	}
+}
+
+// Both kinds of tokens are looked up by the hash of their secret but
+// deleted by their ID, so the deletion has to find them in the bucket.
+func TestStoreDeletesTokens(t *testing.T) {
+	kinds := []struct {
+		name   string
+		save   func(st store, id string, createdAt time.Time) error
+		exists func(st store, id string) (bool, error)
+		delete func(st store, id string) (bool, error)
+		list   func(st store) ([]string, error)
+	}{
+		{
+			name: "token",
+			save: func(st store, id string, createdAt time.Time) error {
+				return st.saveToken(&token{Id: id, Name: id, Role: ROLE_VIEWER, Hash: "hash-" + id, CreatedAt: createdAt})
+			},
+			exists: func(st store, id string) (bool, error) {
+				_, ok, err := st.getToken("hash-" + id)
+				return ok, err
+			},
+			delete: func(st store, id string) (bool, error) {
+				return st.deleteToken(id)
+			},
+			list: func(st store) ([]string, error) {
+				tokens, err := st.listTokens()
+				ids := []string{}
+				for _, t := range tokens {
+					ids = append(ids, t.Id)
+				}
+				return ids, err
+			},
+		},
+		{
+			name: "enrollment token",
+			save: func(st store, id string, createdAt time.Time) error {
+				return st.saveEnrollmentToken(&enrollmentToken{Id: id, Name: id, Hash: "hash-" + id, CreatedAt: createdAt})
+			},
+			exists: func(st store, id string) (bool, error) {
+				_, ok, err := st.getEnrollmentToken("hash-" + id)
+				return ok, err
+			},
+			delete: func(st store, id string) (bool, error) {
+				return st.deleteEnrollmentToken(id)
+			},
+			list: func(st store) ([]string, error) {
+				tokens, err := st.listEnrollmentTokens()
+				ids := []string{}
+				for _, t := range tokens {
+					ids = append(ids, t.Id)
+				}
+				return ids, err
+			},
+		},
+	}
+
+	// The steps run in order against the same tokens.
+	steps := []struct {
+		name     string
+		id       string
+		deleted  bool
+		expected []string
+	}{
+		{name: "unknown", id: "unknown", deleted: false, expected: []string{"first", "second", "third"}},
+		{name: "middle", id: "second", deleted: true, expected: []string{"first", "third"}},
+		{name: "again", id: "second", deleted: false, expected: []string{"first", "third"}},
+		{name: "first", id: "first", deleted: true, expected: []string{"third"}},
+		{name: "last", id: "third", deleted: true, expected: []string{}},
+	}
+
+	for storeName, st := range newTestStores(t) {
+		for _, kind := range kinds {
+			t.Run(storeName+"/"+kind.name, func(t *testing.T) {
+				createdAt := time.Now().UTC()
+				for i, id := range []string{"first", "second", "third"} {
+					err := kind.save(st, id, createdAt.Add(time.Duration(i)*time.Second))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				for _, step := range steps {
+					deleted, err := kind.delete(st, step.id)
+					if err != nil {
+						t.Fatalf("%s: %v", step.name, err)
+					}
+					if deleted != step.deleted {
+						t.Errorf("%s: expected deleted to be %v, got %v", step.name, step.deleted, deleted)
+					}
+					if step.deleted {
+						ok, err := kind.exists(st, step.id)
+						if err != nil || ok {
+							t.Errorf("%s: expected the %s to be gone, got %v, %v", step.name, kind.name, ok, err)
+						}
+					}
+
+					ids, err := kind.list(st)
+					if err != nil {
+						t.Fatalf("%s: %v", step.name, err)
+					}
+					if !equalStrings(ids, step.expected) {
+						t.Errorf("%s: expected %v, got %v", step.name, step.expected, ids)
+					}
+				}
+			})
+		}
+	}
+}
+
+func equalStrings(
+	a []string,
+	b []string,
+) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// Creates the TLS config of the web socket server. If the client CA
+// bundle is given, the clients have to present a certificate which is
+// signed by one of its CAs.
+func newServerTlsConfig(
+	certFile string,
+	keyFile string,
+	clientCaFile string,
+) (
+	*tls.Config,
+	error,
+) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCaFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA bundle does not contain any certificate")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// Returns the common name of the verified client certificate, which is
+// the identity of the client. Returns empty if the client did not
+// present a verified certificate.
+func peerIdentity(
+	state *tls.ConnectionState,
+) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type tokenRequest struct {
+	Name string `json:"name"`
+	Role role   `json:"role"`
+	Ttl  string `json:"ttl"`
+}
+
+type tokenResponse struct {
+	*token
+	Secret string `json:"secret"`
+}
+
+func (hs *HttpServer) handleTokens(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := hs.authenticator.list()
+		if err != nil {
+			msg := "Tokens could not be loaded."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(msg))
+			return
+		}
+		hs.writeJson(w, http.StatusOK, tokens)
+
+	case http.MethodPost:
+		requestBody := &tokenRequest{}
+		err := json.NewDecoder(r.Body).Decode(requestBody)
+		if err != nil {
+			msg := "HTTP request body parsing failed."
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+					"error.message":  err.Error(),
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		var ttl time.Duration
+		if requestBody.Ttl != "" {
+			ttl, err = time.ParseDuration(requestBody.Ttl)
+			if err != nil {
+				msg := "TTL is not valid!"
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(msg))
+				return
+			}
+		}
+
+		t, secret, err := hs.authenticator.create(requestBody.Name, requestBody.Role, ttl)
+		if err != nil {
+			msg := "Token is not valid: " + err.Error()
+			hs.logger.LogWithFields(
+				logrus.ErrorLevel,
+				msg,
+				map[string]string{
+					"component.name": "httpserver",
+				})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+
+		hs.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Token is created.",
+			map[string]string{
+				"component.name": "httpserver",
+				"token.id":       t.Id,
+				"token.role":     string(t.Role),
+			})
+		hs.writeJson(w, http.StatusCreated, &tokenResponse{
+			token:  t,
+			Secret: secret,
+		})
+
+	default:
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+	}
+}
+
+func (hs *HttpServer) handleToken(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	tokenId := r.PathValue("id")
+
+	if r.Method != http.MethodDelete {
+		msg := "HTTP request method is not allowed."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":      "httpserver",
+				"http.request.method": r.Method,
+			})
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(msg))
+		return
+	}
+
+	ok, err := hs.authenticator.delete(tokenId)
+	if err != nil {
+		msg := "Token could not be deleted."
+		hs.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name": "httpserver",
+				"token.id":       tokenId,
+				"error.message":  err.Error(),
+			})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(msg))
+		return
+	}
+	if !ok {
+		msg := "Token is not found!"
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+
+	msg := "Token is deleted."
+	hs.logger.LogWithFields(
+		logrus.InfoLevel,
+		msg,
+		map[string]string{
+			"component.name": "httpserver",
+			"token.id":       tokenId,
+		})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(msg))
+}
@@ -1,139 +1,624 @@
 package controller
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
+	"github.com/utr1903/remotely-controlled-telemetry/protocol"
 )
 
+const WEB_SOCKET_PING_INTERVAL = 10 * time.Second
+const WEB_SOCKET_HELLO_TIMEOUT = 10 * time.Second
+
+// Time which the clients are given to reply to the close frame.
+const WEB_SOCKET_CLOSE_TIMEOUT = time.Second
+
 type webSocketServer struct {
-	logger                *logger.Logger
-	webSocketReadyChannel chan bool
-	controllerChannel     chan bool
-	wg                    *sync.WaitGroup
-	port                  string
-	upgrader              *websocket.Upgrader
+	logger     *logger.Logger
+	registry   *clientRegistry
+	commands   *commandTracker
+	dispatcher *commandDispatcher
+	rules      *ruleEngine
+	opamp      *opampServer
+	enroller   *enroller
+	metrics    *serverMetrics
+	health     *serverHealth
+	tlsConfig  *tls.Config
+	wg         *sync.WaitGroup
+	port       string
+	upgrader   *websocket.Upgrader
+	server     *http.Server
+	// Connections which are served, they are not tracked by the HTTP
+	// server once they are upgraded
+	connections *sync.WaitGroup
+	closing     chan struct{}
+	isClosing   bool
+	mutex       *sync.Mutex
 }
 
 func newWebSocketServer(
 	logger *logger.Logger,
 	wg *sync.WaitGroup,
-	webSocketReadyChannel chan bool,
-	controllerChannel chan bool,
+	registry *clientRegistry,
+	commands *commandTracker,
+	dispatcher *commandDispatcher,
+	rules *ruleEngine,
+	opamp *opampServer,
+	enroller *enroller,
+	metrics *serverMetrics,
+	health *serverHealth,
+	tlsConfig *tls.Config,
 	port string,
 ) *webSocketServer {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
+	// The default origin check rejects the cross-origin requests of the
+	// browsers. The clients do not send an origin at all.
+	upgrader := websocket.Upgrader{}
 	return &webSocketServer{
-		logger:                logger,
-		webSocketReadyChannel: webSocketReadyChannel,
-		controllerChannel:     controllerChannel,
-		wg:                    wg,
-		port:                  port,
-		upgrader:              &upgrader,
+		logger:     logger,
+		registry:   registry,
+		commands:   commands,
+		dispatcher: dispatcher,
+		rules:      rules,
+		opamp:      opamp,
+		enroller:   enroller,
+		metrics:    metrics,
+		health:     health,
+		tlsConfig:  tlsConfig,
+		wg:         wg,
+		port:       port,
+		upgrader:   &upgrader,
+		server: &http.Server{
+			Addr:        "localhost:" + port,
+			ConnContext: opamp.connContext,
+			TLSConfig:   tlsConfig,
+		},
+		connections: &sync.WaitGroup{},
+		closing:     make(chan struct{}),
+		mutex:       &sync.Mutex{},
 	}
 }
 
 func (ws *webSocketServer) run() {
 	defer ws.wg.Done()
 
-	http.HandleFunc("/ws", ws.handleConnections)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", ws.handleConnections)
+	mux.HandleFunc(OPAMP_PATH, ws.opamp.handler)
 
 	ws.logger.LogWithFields(
 		logrus.InfoLevel,
 		"Web socket server is running on localhost:"+ws.port,
 		map[string]string{
 			"component.name": "websocketserver",
+			"tls.enabled":    strconv.FormatBool(ws.tlsConfig != nil),
 		})
 
-	err := http.ListenAndServe("localhost:"+ws.port, nil)
-	if err != nil {
+	ws.server.Handler = mux
+
+	listener, err := net.Listen("tcp", ws.server.Addr)
+	if err == nil {
+		ws.health.listening(LISTENER_WEBSOCKET)
+		if ws.tlsConfig != nil {
+			// The certificates are already loaded into the TLS config
+			err = ws.server.ServeTLS(listener, "", "")
+		} else {
+			err = ws.server.Serve(listener)
+		}
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		ws.health.listenerFailed(LISTENER_WEBSOCKET, err)
 		fmt.Println(err)
 	}
 }
 
+// Stops accepting connections and closes the ones which are served.
+// The clients receive a close frame, the OpAMP agents are disconnected.
+func (ws *webSocketServer) shutdown(
+	ctx context.Context,
+) error {
+	err := ws.server.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	ws.mutex.Lock()
+	ws.isClosing = true
+	close(ws.closing)
+	ws.mutex.Unlock()
+
+	err = ws.opamp.shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ws.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Tracks the connection so that the shutdown waits for it. Returns
+// false if the server already shuts down.
+func (ws *webSocketServer) track() bool {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	if ws.isClosing {
+		return false
+	}
+	ws.connections.Add(1)
+	return true
+}
+
 func (ws *webSocketServer) handleConnections(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
+	// Only the enrolled clients and the ones which enroll are accepted
+	admission, err := ws.enroller.admit(r)
+	if err != nil {
+		msg := "Client is not authenticated: " + err.Error()
+		ws.logger.LogWithFields(
+			logrus.ErrorLevel,
+			msg,
+			map[string]string{
+				"component.name":    "websocketserver",
+				"client.address":    r.RemoteAddr,
+				"client.identity":   peerIdentity(r.TLS),
+				"http.request.path": r.URL.Path,
+			})
+		ws.metrics.handshakeFailed(TRANSPORT_WEBSOCKET, HANDSHAKE_FAILURE_UNAUTHENTICATED)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="remotely-controlled-telemetry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(msg))
+		return
+	}
+
+	if !ws.track() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(errServerShuttingDown.Error()))
+		return
+	}
+	defer ws.connections.Done()
+
 	conn, err := ws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		ws.metrics.handshakeFailed(TRANSPORT_WEBSOCKET, HANDSHAKE_FAILURE_UPGRADE)
 		fmt.Println(err)
 		return
 	}
 	defer conn.Close()
 
-	// Reset socket connection to false
-	conn.SetCloseHandler(
-		func(code int, text string) error {
+	// Wait for the client to introduce itself
+	hello, err := ws.readHello(conn)
+	if err != nil {
+		ws.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Hello message is not received from the client.",
+			map[string]string{
+				"component.name": "websocketserver",
+				"error.message":  err.Error(),
+			})
+		ws.metrics.handshakeFailed(TRANSPORT_WEBSOCKET, HANDSHAKE_FAILURE_HELLO)
+		return
+	}
+
+	// The ID which the credential or the client certificate is bound to
+	// takes precedence over the instance ID which the client claims
+	clientId := hello.InstanceId
+	if admission.clientId != "" {
+		if clientId != admission.clientId {
+			ws.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Client ID is taken from the client credential.",
+				map[string]string{
+					"component.name":    "websocketserver",
+					"client.id":         admission.clientId,
+					"client.instanceId": clientId,
+				})
+		}
+		clientId = admission.clientId
+		hello.InstanceId = admission.clientId
+	}
+	if clientId == "" {
+		clientId = generateId()
+	}
+
+	if admission.isEnrolling() {
+		err := ws.enroll(conn, clientId, admission)
+		if err != nil {
 			ws.logger.LogWithFields(
 				logrus.ErrorLevel,
-				"Web socket connection is lost.",
+				"Client could not be enrolled.",
 				map[string]string{
 					"component.name": "websocketserver",
+					"client.id":      clientId,
+					"error.message":  err.Error(),
 				})
-			ws.webSocketReadyChannel <- false
-			return nil
-		})
+			ws.metrics.handshakeFailed(TRANSPORT_WEBSOCKET, HANDSHAKE_FAILURE_ENROLLMENT)
+			ws.write(conn, protocol.NewErrorEnvelope(nil, protocol.ErrorCodeEnrollmentFailed, err.Error()))
+			return
+		}
+	}
+
+	client := ws.registry.register(clientId, TRANSPORT_WEBSOCKET, hello)
+	defer ws.registry.unregister(client)
 
 	ws.logger.LogWithFields(
 		logrus.InfoLevel,
 		"Web socket connection is established.",
 		map[string]string{
-			"component.name": "websocketserver",
+			"component.name":           "websocketserver",
+			"client.id":                clientId,
+			"client.hostname":          hello.Hostname,
+			"client.os":                hello.Os,
+			"client.arch":              hello.Arch,
+			"client.version":           hello.ClientVersion,
+			"client.service.name":      hello.ServiceName,
+			"client.collector.version": hello.CollectorVersion,
+			"otelcol.mode":             string(hello.Mode),
 		})
 
-	ws.webSocketReadyChannel <- true
+	// Restore the desired state of the client, if it has drifted
+	ws.dispatcher.reconcile(clientId, hello.Mode)
+
+	conn.SetPongHandler(
+		func(string) error {
+			ws.registry.touch(clientId)
+			return nil
+		})
 
-	// Check for incoming messages in case the client disconnects
+	// Read incoming messages until the client disconnects
+	readDone := make(chan struct{})
 	go func() {
+		defer close(readDone)
 		for {
-			_, _, err := conn.ReadMessage()
+			_, data, err := conn.ReadMessage()
 			if err != nil {
 				ws.logger.LogWithFields(
 					logrus.ErrorLevel,
-					"Error occurred during reading message from the client.",
+					"Web socket connection is lost.",
 					map[string]string{
 						"component.name": "websocketserver",
+						"client.id":      clientId,
 						"error.message":  err.Error(),
 					})
 				return
 			}
+			ws.registry.touch(clientId)
+			ws.handleMessage(client, data)
 		}
 	}()
 
-	for isDebug := range ws.controllerChannel {
+	ping := time.NewTicker(WEB_SOCKET_PING_INTERVAL)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-readDone:
+			return
+
+		case <-ws.closing:
+			ws.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Web socket connection is closed since the server shuts down.",
+				map[string]string{
+					"component.name": "websocketserver",
+					"client.id":      clientId,
+				})
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(WEB_SOCKET_CLOSE_TIMEOUT))
+
+			// The connection is closed once the client replies
+			select {
+			case <-readDone:
+			case <-time.After(WEB_SOCKET_CLOSE_TIMEOUT):
+			}
+			return
+
+		case <-client.done:
+			if client.isRevoked {
+				ws.logger.LogWithFields(
+					logrus.InfoLevel,
+					"Web socket connection is closed since the client is revoked.",
+					map[string]string{
+						"component.name": "websocketserver",
+						"client.id":      clientId,
+					})
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client is revoked"), time.Now().Add(time.Second))
+				return
+			}
+			ws.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Web socket connection is replaced by a newer one.",
+				map[string]string{
+					"component.name": "websocketserver",
+					"client.id":      clientId,
+				})
+			return
+
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WEB_SOCKET_PING_INTERVAL))
+			if err != nil {
+				ws.logger.LogWithFields(
+					logrus.ErrorLevel,
+					"Error occurred during pinging the client.",
+					map[string]string{
+						"component.name": "websocketserver",
+						"client.id":      clientId,
+						"error.message":  err.Error(),
+					})
+				return
+			}
+
+		case message := <-client.sendQueue:
+			ws.logger.LogWithFields(
+				logrus.InfoLevel,
+				"Sending message to the client.",
+				map[string]string{
+					"component.name":     "websocketserver",
+					"client.id":          clientId,
+					"message.type":       string(message.Type),
+					"message.command.id": message.CommandId,
+				})
+
+			err := ws.write(conn, message)
+			if err != nil {
+				ws.logger.LogWithFields(
+					logrus.ErrorLevel,
+					"Error occurred during writing message to web socket.",
+					map[string]string{
+						"component.name": "websocketserver",
+						"client.id":      clientId,
+						"error.message":  err.Error(),
+					})
+			}
+		}
+	}
+}
+
+func (ws *webSocketServer) readHello(
+	conn *websocket.Conn,
+) (
+	*protocol.HelloPayload,
+	error,
+) {
+	conn.SetReadDeadline(time.Now().Add(WEB_SOCKET_HELLO_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := protocol.Decode(data)
+	ws.observeReceived(message, data)
+	if err != nil {
+		ws.write(conn, protocol.NewErrorEnvelope(message, protocol.DecodeErrorCode(err), err.Error()))
+		return nil, err
+	}
+
+	if message.Type != protocol.MessageTypeHello {
+		err := fmt.Errorf("expected %s message but received %s", protocol.MessageTypeHello, message.Type)
+		ws.write(conn, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidMessage, err.Error()))
+		return nil, err
+	}
+
+	hello := &protocol.HelloPayload{}
+	err = message.DecodePayload(hello)
+	if err != nil {
+		ws.write(conn, protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+		return nil, err
+	}
+	return hello, nil
+}
+
+// Writes the message to the connection and records it in the metrics.
+func (ws *webSocketServer) write(
+	conn *websocket.Conn,
+	message *protocol.Envelope,
+) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	ws.metrics.message(TRANSPORT_WEBSOCKET, MESSAGE_DIRECTION_SENT, string(message.Type), len(data))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Records the received message in the metrics. Messages which cannot
+// be decoded are recorded with the type invalid.
+func (ws *webSocketServer) observeReceived(
+	message *protocol.Envelope,
+	data []byte,
+) {
+	messageType := "invalid"
+	if message != nil {
+		messageType = messageTypeLabel(message.Type)
+	}
+	ws.metrics.message(TRANSPORT_WEBSOCKET, MESSAGE_DIRECTION_RECEIVED, messageType, len(data))
+}
+
+// Issues the credential of the client and sends it to the client.
+func (ws *webSocketServer) enroll(
+	conn *websocket.Conn,
+	clientId string,
+	admission *admission,
+) error {
+	credential, err := ws.enroller.enroll(clientId, admission)
+	if err != nil {
+		return err
+	}
+
+	message, err := protocol.NewEnvelope(
+		protocol.MessageTypeEnrolled,
+		"",
+		&protocol.EnrolledPayload{
+			ClientId:   clientId,
+			Credential: credential,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return ws.write(conn, message)
+}
+
+func (ws *webSocketServer) handleMessage(
+	client *registeredClient,
+	data []byte,
+) {
+	message, err := protocol.Decode(data)
+	ws.observeReceived(message, data)
+	if err != nil {
 		ws.logger.LogWithFields(
-			logrus.InfoLevel,
-			"Controller channel input received.",
+			logrus.ErrorLevel,
+			"Message from the client could not be decoded.",
 			map[string]string{
-				"component.name":     "websocketserver",
-				"otelcol.mode.debug": strconv.FormatBool(isDebug),
+				"component.name": "websocketserver",
+				"client.id":      client.id,
+				"error.message":  err.Error(),
 			})
+		client.enqueue(protocol.NewErrorEnvelope(message, protocol.DecodeErrorCode(err), err.Error()))
+		return
+	}
 
-		var message []byte
-		if isDebug {
-			message = []byte("debug")
-		} else {
-			message = []byte("default")
-		}
-		err := conn.WriteMessage(websocket.TextMessage, message)
+	switch message.Type {
+	case protocol.MessageTypeAck:
+		payload := &protocol.AckPayload{}
+		err := message.DecodePayload(payload)
 		if err != nil {
+			client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+			return
+		}
+
+		ok := ws.commands.update(message.CommandId, client.id, payload.Status, payload.Error)
+		if !ok {
 			ws.logger.LogWithFields(
 				logrus.ErrorLevel,
-				"Error occurred during writing message to web socket.",
+				"Acknowledged command is unknown.",
 				map[string]string{
-					"component.name": "websocketserver",
-					"error.message":  err.Error(),
+					"component.name":     "websocketserver",
+					"client.id":          client.id,
+					"message.command.id": message.CommandId,
 				})
+			return
+		}
+
+		lvl := logrus.InfoLevel
+		if payload.Status == protocol.CommandStatusFailed {
+			lvl = logrus.ErrorLevel
+		}
+		ws.logger.LogWithFields(
+			lvl,
+			"Command is acknowledged by the client.",
+			map[string]string{
+				"component.name":     "websocketserver",
+				"client.id":          client.id,
+				"message.command.id": message.CommandId,
+				"command.status":     string(payload.Status),
+				"error.message":      payload.Error,
+			})
+
+	case protocol.MessageTypeState:
+		payload := &protocol.StatePayload{}
+		err := message.DecodePayload(payload)
+		if err != nil {
+			client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+			return
+		}
+
+		ws.registry.updateMode(client.id, payload.Mode)
+		ws.dispatcher.reconcile(client.id, payload.Mode)
+
+	case protocol.MessageTypeHealth:
+		payload := &protocol.HealthPayload{}
+		err := message.DecodePayload(payload)
+		if err != nil {
+			client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+			return
 		}
+
+		ws.rules.observe(client.id, payload)
+
+	case protocol.MessageTypeCollectorCrashed:
+		payload := &protocol.CollectorCrashedPayload{}
+		err := message.DecodePayload(payload)
+		if err != nil {
+			client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+			return
+		}
+
+		ws.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Collector of the client crashed.",
+			map[string]string{
+				"component.name": "websocketserver",
+				"client.id":      client.id,
+				"error.message":  payload.Error,
+			})
+		ws.registry.collectorCrashed(client.id, payload)
+
+	case protocol.MessageTypeModeExpired:
+		payload := &protocol.ModeExpiredPayload{}
+		err := message.DecodePayload(payload)
+		if err != nil {
+			client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeInvalidPayload, err.Error()))
+			return
+		}
+
+		ws.logger.LogWithFields(
+			logrus.InfoLevel,
+			"Client reverted to default mode since the TTL elapsed.",
+			map[string]string{
+				"component.name":     "websocketserver",
+				"client.id":          client.id,
+				"message.command.id": message.CommandId,
+				"error.message":      payload.Error,
+			})
+		ws.registry.updateMode(client.id, payload.Mode)
+		ws.dispatcher.expire(client.id, message.CommandId, payload.ExpiredAt)
+
+	case protocol.MessageTypeError:
+		payload := &protocol.ErrorPayload{}
+		message.DecodePayload(payload)
+		ws.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Client replied with an error.",
+			map[string]string{
+				"component.name":     "websocketserver",
+				"client.id":          client.id,
+				"message.command.id": message.CommandId,
+				"error.code":         string(payload.Code),
+				"error.message":      payload.Message,
+			})
+
+	default:
+		ws.logger.LogWithFields(
+			logrus.ErrorLevel,
+			"Message type is unknown.",
+			map[string]string{
+				"component.name": "websocketserver",
+				"client.id":      client.id,
+				"message.type":   string(message.Type),
+			})
+		client.enqueue(protocol.NewErrorEnvelope(message, protocol.ErrorCodeUnknownMessageType, "message type is unknown: "+string(message.Type)))
 	}
 }
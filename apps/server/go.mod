@@ -1,11 +1,35 @@
 module github.com/utr1903/remotely-controlled-telemetry/apps/server
 
-go 1.21.5
+go 1.22
 
-require github.com/gorilla/websocket v1.5.1
+require (
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/open-telemetry/opamp-go v0.19.0
+	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.3.11
+)
+
+require (
+	github.com/kr/text v0.2.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.16.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_golang v1.20.5
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 )
+
+require (
+	github.com/utr1903/remotely-controlled-telemetry/protocol v0.0.0
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.36.2
+)
+
+replace github.com/utr1903/remotely-controlled-telemetry/protocol => ../../protocol
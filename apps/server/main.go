@@ -1,16 +1,68 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/server/controller"
 	"github.com/utr1903/remotely-controlled-telemetry/apps/server/logger"
 )
 
 func main() {
 
+	// The controller shuts down once the process is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Instantiate logger
 	l := logger.New()
 
 	// Run the controller
-	c := controller.New(l)
-	c.Run()
+	alertDebugTtl := controller.ALERT_DEBUG_TTL
+	if value := os.Getenv("SERVER_ALERT_DEBUG_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			l.LogWithFields(
+				logrus.ErrorLevel,
+				"Alert debug TTL is not valid: "+value,
+				map[string]string{
+					"component.name": "main",
+				})
+			os.Exit(1)
+		}
+		alertDebugTtl = ttl
+	}
+
+	c, err := controller.New(l, &controller.Config{
+		StorePath:  os.Getenv("SERVER_STORE_PATH"),
+		AdminToken: os.Getenv("SERVER_ADMIN_TOKEN"),
+
+		EnrollmentToken: os.Getenv("SERVER_ENROLLMENT_TOKEN"),
+
+		TlsCertFile:     os.Getenv("SERVER_TLS_CERT_FILE"),
+		TlsKeyFile:      os.Getenv("SERVER_TLS_KEY_FILE"),
+		TlsClientCaFile: os.Getenv("SERVER_TLS_CLIENT_CA_FILE"),
+
+		SigningKeyFile: os.Getenv("SERVER_SIGNING_KEY_FILE"),
+
+		TrustedProxies: strings.Split(os.Getenv("SERVER_TRUSTED_PROXIES"), ","),
+
+		AlertDebugTtl: alertDebugTtl,
+	})
+	if err != nil {
+		l.LogWithFields(
+			logrus.ErrorLevel,
+			"Controller could not be created.",
+			map[string]string{
+				"component.name": "main",
+				"error.message":  err.Error(),
+			})
+		os.Exit(1)
+	}
+	c.Run(ctx)
 }
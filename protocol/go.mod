@@ -0,0 +1,3 @@
+module github.com/utr1903/remotely-controlled-telemetry/protocol
+
+go 1.21
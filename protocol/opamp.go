@@ -0,0 +1,129 @@
+package protocol
+
+import "time"
+
+// Name of the file in the OpAMP remote config map which carries the
+// mode to the agents. The agents report it back in their effective
+// config once it is applied.
+const OpampModeConfigName = "remotely-controlled-telemetry/mode"
+
+const OpampModeConfigContentType = "text/yaml"
+
+// Log levels of the collector which the modes are mapped to.
+const (
+	OpampLogLevelDebug   = "debug"
+	OpampLogLevelDefault = "info"
+)
+
+// Resource attributes of the mode file which carry the command.
+const (
+	OpampAttributeCommandId          = "remotely-controlled-telemetry.command.id"
+	OpampAttributeTtl                = "remotely-controlled-telemetry.ttl"
+	OpampAttributeSignatureNonce     = "remotely-controlled-telemetry.signature.nonce"
+	OpampAttributeSignatureExpiresAt = "remotely-controlled-telemetry.signature.expires_at"
+	OpampAttributeSignatureValue     = "remotely-controlled-telemetry.signature.value"
+)
+
+// Body of the mode file in the OpAMP remote config map. It is a fragment
+// of the collector config so that the supervisors which merge the remote
+// config into the config of their collector accept it. The mode sets the
+// log level of the collector and the command is carried as the resource
+// attributes of its own telemetry.
+type OpampModeConfig struct {
+	Service OpampModeConfigService `yaml:"service"`
+}
+
+type OpampModeConfigService struct {
+	Telemetry OpampModeConfigTelemetry `yaml:"telemetry"`
+}
+
+type OpampModeConfigTelemetry struct {
+	Logs     OpampModeConfigLogs `yaml:"logs"`
+	Resource map[string]string   `yaml:"resource,omitempty"`
+}
+
+type OpampModeConfigLogs struct {
+	Level string `yaml:"level"`
+}
+
+// Creates the mode file of the command. The command ID, the TTL and the
+// signature are left out if they are not given.
+func NewOpampModeConfig(
+	commandId string,
+	mode Mode,
+	ttl string,
+	signature *CommandSignature,
+) *OpampModeConfig {
+	c := &OpampModeConfig{}
+	c.Service.Telemetry.Logs.Level = OpampLogLevelDefault
+	if mode == ModeDebug {
+		c.Service.Telemetry.Logs.Level = OpampLogLevelDebug
+	}
+
+	resource := map[string]string{}
+	if commandId != "" {
+		resource[OpampAttributeCommandId] = commandId
+	}
+	if ttl != "" {
+		resource[OpampAttributeTtl] = ttl
+	}
+	if signature != nil {
+		resource[OpampAttributeSignatureNonce] = signature.Nonce
+		resource[OpampAttributeSignatureExpiresAt] = signature.ExpiresAt.UTC().Format(time.RFC3339Nano)
+		resource[OpampAttributeSignatureValue] = signature.Value
+	}
+	if len(resource) != 0 {
+		c.Service.Telemetry.Resource = resource
+	}
+	return c
+}
+
+// Returns the debug mode if the log level is debug and the default mode
+// otherwise.
+func (c *OpampModeConfig) Mode() Mode {
+	if c.Service.Telemetry.Logs.Level == OpampLogLevelDebug {
+		return ModeDebug
+	}
+	return ModeDefault
+}
+
+func (c *OpampModeConfig) CommandId() string {
+	return c.Service.Telemetry.Resource[OpampAttributeCommandId]
+}
+
+func (c *OpampModeConfig) Ttl() string {
+	return c.Service.Telemetry.Resource[OpampAttributeTtl]
+}
+
+// Returns the signature of the command or nil if it is not signed. An
+// expiry which cannot be parsed is left as zero so that the signature
+// does not verify.
+func (c *OpampModeConfig) Signature() *CommandSignature {
+	resource := c.Service.Telemetry.Resource
+	if resource[OpampAttributeSignatureValue] == "" {
+		return nil
+	}
+	expiresAt, _ := time.Parse(time.RFC3339Nano, resource[OpampAttributeSignatureExpiresAt])
+	return &CommandSignature{
+		Nonce:     resource[OpampAttributeSignatureNonce],
+		ExpiresAt: expiresAt,
+		Value:     resource[OpampAttributeSignatureValue],
+	}
+}
+
+// Attributes of the OpAMP agent description which carry the metadata
+// of the hello message that has no semantic convention.
+const (
+	OpampAttributeCollectorVersion = "otelcol.version"
+	OpampAttributeGroup            = "client.group"
+	OpampAttributeTimeZoneOffset   = "client.timezone.offset"
+)
+
+// Custom capability and message types which the OpAMP agents send the
+// health summary and the crashes of the collector with. The data of the
+// messages is the JSON encoded health and collector crashed payload.
+const (
+	OpampHealthCapability            = "io.github.utr1903.remotely-controlled-telemetry.health"
+	OpampHealthMessageType           = "health"
+	OpampCollectorCrashedMessageType = "collector_crashed"
+)
@@ -0,0 +1,240 @@
+// Package protocol defines the messages which the server and the
+// clients exchange over the web socket connection.
+//
+// The clients authenticate the connection request with a bearer token
+// in the Authorization header. On their first connection it is an
+// enrollment token, which the server replies to with the credential of
+// the client in an enrolled message.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Version of the protocol. Messages with a different version are
+// rejected by the receiver.
+const Version = 1
+
+type MessageType string
+
+const (
+	MessageTypeHello       MessageType = "hello"
+	MessageTypeSetMode     MessageType = "set_mode"
+	MessageTypeAck         MessageType = "ack"
+	MessageTypeState       MessageType = "state"
+	MessageTypeModeExpired MessageType = "mode_expired"
+	MessageTypeError       MessageType = "error"
+	MessageTypeEnrolled    MessageType = "enrolled"
+	MessageTypeHealth      MessageType = "health"
+	// Sent by the client when its collector exits without being stopped
+	MessageTypeCollectorCrashed MessageType = "collector_crashed"
+)
+
+type Mode string
+
+const (
+	ModeDefault Mode = "default"
+	ModeDebug   Mode = "debug"
+)
+
+type CommandStatus string
+
+const (
+	CommandStatusAccepted CommandStatus = "accepted"
+	CommandStatusApplied  CommandStatus = "applied"
+	CommandStatusFailed   CommandStatus = "failed"
+	// The client dropped the command since a newer one arrived before
+	// it could be applied
+	CommandStatusSuperseded CommandStatus = "superseded"
+)
+
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidMessage     ErrorCode = "invalid_message"
+	ErrorCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	ErrorCodeUnknownMessageType ErrorCode = "unknown_message_type"
+	ErrorCodeInvalidPayload     ErrorCode = "invalid_payload"
+	ErrorCodeEnrollmentFailed   ErrorCode = "enrollment_failed"
+)
+
+var ErrUnsupportedVersion = errors.New("protocol version is not supported")
+
+// Envelope wraps every message which is sent over the connection.
+type Envelope struct {
+	Version   int             `json:"version"`
+	Type      MessageType     `json:"type"`
+	CommandId string          `json:"commandId,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// Sent by the client right after it connects to the server. The time
+// zone offset is given in seconds east of UTC.
+type HelloPayload struct {
+	InstanceId       string `json:"instanceId"`
+	Hostname         string `json:"hostname"`
+	Os               string `json:"os"`
+	Arch             string `json:"arch"`
+	ClientVersion    string `json:"clientVersion"`
+	ServiceName      string `json:"serviceName"`
+	CollectorVersion string `json:"collectorVersion"`
+	Mode             Mode   `json:"mode"`
+	Group            string `json:"group,omitempty"`
+	TimeZoneOffset   int    `json:"timeZoneOffset"`
+}
+
+// Sent by the server to switch the collector of the client. If the TTL
+// is set, the client reverts to the default mode after it elapses. The
+// signature covers the ID of the client, the command ID of the envelope,
+// the mode and the TTL.
+type SetModePayload struct {
+	Mode      Mode              `json:"mode"`
+	Ttl       string            `json:"ttl,omitempty"`
+	Signature *CommandSignature `json:"signature,omitempty"`
+}
+
+// Sent by the client to report the progress of a command. The command
+// is referred to by the command ID of the envelope.
+type AckPayload struct {
+	Status CommandStatus `json:"status"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Sent by the client after it reverted to the default mode because the
+// TTL of a command has elapsed. The command is referred to by the
+// command ID of the envelope.
+type ModeExpiredPayload struct {
+	Mode      Mode      `json:"mode"`
+	ExpiredAt time.Time `json:"expiredAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Sent by the client to report the actual state of its collector.
+type StatePayload struct {
+	Mode      Mode `json:"mode"`
+	IsRunning bool `json:"isRunning"`
+}
+
+// Sent by the client after its collector exited unexpectedly. The error
+// is the exit status of the collector process.
+type CollectorCrashedPayload struct {
+	Mode      Mode      `json:"mode"`
+	CrashedAt time.Time `json:"crashedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Sent by the client periodically to summarize the health of its
+// application over the last window. The latencies are given in
+// milliseconds and are zero if nothing is recorded in the window.
+type HealthPayload struct {
+	Window       string  `json:"window"`
+	Count        int     `json:"count"`
+	LatencyP50Ms float64 `json:"latencyP50Ms"`
+	LatencyP95Ms float64 `json:"latencyP95Ms"`
+	LatencyP99Ms float64 `json:"latencyP99Ms"`
+}
+
+// Sent by the server after the client connected with an enrollment
+// token. The client authenticates with the credential afterwards.
+type EnrolledPayload struct {
+	ClientId   string `json:"clientId"`
+	Credential string `json:"credential"`
+}
+
+// Sent by either side as a reply to a message which it cannot handle.
+type ErrorPayload struct {
+	Code        ErrorCode   `json:"code"`
+	Message     string      `json:"message"`
+	MessageType MessageType `json:"messageType,omitempty"`
+}
+
+func NewEnvelope(
+	messageType MessageType,
+	commandId string,
+	payload interface{},
+) (
+	*Envelope,
+	error,
+) {
+	e := &Envelope{
+		Version:   Version,
+		Type:      messageType,
+		CommandId: commandId,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = data
+	}
+	return e, nil
+}
+
+// Creates the error reply for the given message. The message can be
+// nil if it could not be decoded at all.
+func NewErrorEnvelope(
+	request *Envelope,
+	code ErrorCode,
+	message string,
+) *Envelope {
+	payload := &ErrorPayload{
+		Code:    code,
+		Message: message,
+	}
+
+	commandId := ""
+	if request != nil {
+		commandId = request.CommandId
+		payload.MessageType = request.Type
+	}
+
+	// Marshalling the error payload cannot fail
+	e, _ := NewEnvelope(MessageTypeError, commandId, payload)
+	return e
+}
+
+// Decodes the envelope. If the version is not supported, the decoded
+// envelope is returned together with ErrUnsupportedVersion so that the
+// receiver can still reply to it.
+func Decode(
+	data []byte,
+) (
+	*Envelope,
+	error,
+) {
+	e := &Envelope{}
+	err := json.Unmarshal(data, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Version != Version {
+		return e, ErrUnsupportedVersion
+	}
+	return e, nil
+}
+
+// Returns the error code which is replied for the given decoding error.
+func DecodeErrorCode(
+	err error,
+) ErrorCode {
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return ErrorCodeUnsupportedVersion
+	}
+	return ErrorCodeInvalidMessage
+}
+
+func (e *Envelope) DecodePayload(
+	payload interface{},
+) error {
+	if len(e.Payload) == 0 {
+		return errors.New("payload is empty")
+	}
+	return json.Unmarshal(e.Payload, payload)
+}
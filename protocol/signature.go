@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSignatureIsMissing = errors.New("command is not signed")
+	ErrSignatureIsInvalid = errors.New("signature of the command is invalid")
+	ErrCommandIsExpired   = errors.New("command is expired")
+)
+
+// Signature of a command. The server signs the command together with
+// the ID of the target client, a nonce and an expiry with its Ed25519
+// key so that the clients can verify that the command is issued by the
+// server for them and is neither replayed nor stale.
+type CommandSignature struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Value     string    `json:"value"`
+}
+
+// Signs the command for the given client with the given key. The
+// signature expires after the given validity.
+func SignCommand(
+	key ed25519.PrivateKey,
+	clientId string,
+	commandId string,
+	mode Mode,
+	ttl string,
+	validity time.Duration,
+) (
+	*CommandSignature,
+	error,
+) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	s := &CommandSignature{
+		Nonce:     hex.EncodeToString(nonce),
+		ExpiresAt: time.Now().UTC().Add(validity),
+	}
+	s.Value = base64.StdEncoding.EncodeToString(
+		ed25519.Sign(key, s.signedBytes(clientId, commandId, mode, ttl)))
+	return s, nil
+}
+
+// Verifies the signature of the command against the given key and
+// checks that it is signed for the given client and is not expired at
+// the given time. The nonce has to be checked for replays by the
+// caller.
+func VerifyCommand(
+	key ed25519.PublicKey,
+	clientId string,
+	commandId string,
+	mode Mode,
+	ttl string,
+	s *CommandSignature,
+	now time.Time,
+) error {
+	if s == nil || s.Value == "" {
+		return ErrSignatureIsMissing
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(s.Value)
+	if err != nil || !ed25519.Verify(key, s.signedBytes(clientId, commandId, mode, ttl), signature) {
+		return ErrSignatureIsInvalid
+	}
+	if !now.Before(s.ExpiresAt) {
+		return ErrCommandIsExpired
+	}
+	return nil
+}
+
+// Returns the canonical form of the command which is signed.
+func (s *CommandSignature) signedBytes(
+	clientId string,
+	commandId string,
+	mode Mode,
+	ttl string,
+) []byte {
+	return []byte(strings.Join([]string{
+		"rct-command-v2",
+		clientId,
+		commandId,
+		string(mode),
+		ttl,
+		s.Nonce,
+		s.ExpiresAt.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+}
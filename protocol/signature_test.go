@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyCommand(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := SignCommand(privateKey, "client", "command", ModeDebug, "30m", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		clientId  string
+		commandId string
+		mode      Mode
+		ttl       string
+		signature *CommandSignature
+		now       time.Time
+		expected  error
+	}{
+		{
+			name:      "valid",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: signature,
+			now:       time.Now(),
+		},
+		{
+			name:      "missing signature",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: nil,
+			now:       time.Now(),
+			expected:  ErrSignatureIsMissing,
+		},
+		{
+			name:      "empty signature",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: &CommandSignature{Nonce: signature.Nonce, ExpiresAt: signature.ExpiresAt},
+			now:       time.Now(),
+			expected:  ErrSignatureIsMissing,
+		},
+		{
+			name:      "wrong client",
+			key:       publicKey,
+			clientId:  "other",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: signature,
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "tampered command ID",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "other",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: signature,
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "tampered mode",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDefault,
+			ttl:       "30m",
+			signature: signature,
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "tampered ttl",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "24h",
+			signature: signature,
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "tampered nonce",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: &CommandSignature{Nonce: "other", ExpiresAt: signature.ExpiresAt, Value: signature.Value},
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "extended expiry",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: &CommandSignature{Nonce: signature.Nonce, ExpiresAt: signature.ExpiresAt.Add(time.Hour), Value: signature.Value},
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "malformed value",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: &CommandSignature{Nonce: signature.Nonce, ExpiresAt: signature.ExpiresAt, Value: "not base64!"},
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "wrong key",
+			key:       otherKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: signature,
+			now:       time.Now(),
+			expected:  ErrSignatureIsInvalid,
+		},
+		{
+			name:      "expired",
+			key:       publicKey,
+			clientId:  "client",
+			commandId: "command",
+			mode:      ModeDebug,
+			ttl:       "30m",
+			signature: signature,
+			now:       signature.ExpiresAt,
+			expected:  ErrCommandIsExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyCommand(test.key, test.clientId, test.commandId, test.mode, test.ttl, test.signature, test.now)
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestSignCommandUsesFreshNonces(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := SignCommand(privateKey, "client", "command", ModeDebug, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SignCommand(privateKey, "client", "command", ModeDebug, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Nonce == second.Nonce {
+		t.Errorf("expected different nonces, got %s twice", first.Nonce)
+	}
+}